@@ -5,32 +5,118 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/backends/clientcert"
+	"github.com/freman/caddy2-reauth/backends/exec"
 	"github.com/freman/caddy2-reauth/backends/gitlabci"
+	"github.com/freman/caddy2-reauth/backends/header"
 	"github.com/freman/caddy2-reauth/backends/ldap"
+	"github.com/freman/caddy2-reauth/backends/radius"
+	"github.com/freman/caddy2-reauth/backends/signedurl"
 	"github.com/freman/caddy2-reauth/backends/simple"
+	"github.com/freman/caddy2-reauth/backends/sql"
+	"github.com/freman/caddy2-reauth/backends/totp"
 	"github.com/freman/caddy2-reauth/backends/upstream"
+	"github.com/freman/caddy2-reauth/backends/webhook"
 )
 
-// Backend is an authentication backend.
+// Backend is an authentication backend, optionally with a second factor.
 type Backend struct {
-	Type   string `json:"type,omitempty"`
+	Type   string     `json:"type,omitempty"`
+	TOTP   *totp.TOTP `json:"totp,omitempty"`
 	driver backends.Driver
 }
 
+// Provision sets up anything the backend needs from caddy.
+func (b *Backend) Provision(ctx caddy.Context) error {
+	if p, ok := b.driver.(caddy.Provisioner); ok {
+		if err := p.Provision(ctx); err != nil {
+			return err
+		}
+	}
+
+	if b.TOTP != nil {
+		return b.TOTP.Provision(ctx)
+	}
+
+	return nil
+}
+
+// Cleanup releases anything held by the backend.
+func (b *Backend) Cleanup() error {
+	if c, ok := b.driver.(caddy.CleanerUpper); ok {
+		return c.Cleanup()
+	}
+	return nil
+}
+
 // Authenticate performs authentication with an authentication provider.
-func (b *Backend) Authenticate(r *http.Request) (string, error) {
-	return b.driver.Authenticate(r)
+func (b *Backend) Authenticate(r *http.Request) (*backends.Identity, error) {
+	if b.TOTP != nil {
+		return b.TOTP.Authenticate(r, b.authenticate)
+	}
+	return b.authenticate(r)
+}
+
+func (b *Backend) authenticate(r *http.Request) (*backends.Identity, error) {
+	if d, ok := b.driver.(backends.IdentityDriver); ok {
+		return d.AuthenticateIdentity(r)
+	}
+
+	user, err := b.driver.Authenticate(r)
+	if err != nil || user == "" {
+		return nil, err
+	}
+
+	return &backends.Identity{ID: user}, nil
+}
+
+// Sanitize removes anything from the request the authentication provider
+// doesn't trust, before any backend has a chance to authenticate it.
+func (b *Backend) Sanitize(r *http.Request) {
+	if s, ok := b.driver.(backends.Sanitizer); ok {
+		s.Sanitize(r)
+	}
 }
 
 // Validate checks whether an authentication provider is functional.
 func (b *Backend) Validate() error {
+	if b.TOTP != nil {
+		if err := b.TOTP.Validate(); err != nil {
+			return fmt.Errorf("totp: %v", err)
+		}
+	}
 	return b.driver.Validate()
 }
 
 // MarshalJSON packs configuration info JSON byte array
 func (b Backend) MarshalJSON() ([]byte, error) {
-	return json.Marshal(b.driver)
+	data, err := json.Marshal(b.driver)
+	if err != nil {
+		return nil, err
+	}
+
+	// The type and totp layer sit alongside the driver's configuration
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = map[string]json.RawMessage{}
+	}
+
+	if config["type"], err = json.Marshal(b.Type); err != nil {
+		return nil, err
+	}
+
+	if b.TOTP != nil {
+		if config["totp"], err = json.Marshal(b.TOTP); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(config)
 }
 
 // UnmarshalJSON unpacks configuration into appropriate structures.
@@ -48,14 +134,28 @@ func (b *Backend) UnmarshalJSON(data []byte) error {
 
 	var driver backends.Driver
 	switch backend.Type {
+	case clientcert.BackendName:
+		driver = clientcert.NewDriver()
+	case exec.BackendName:
+		driver = exec.NewDriver()
 	case gitlabci.BackendName:
 		driver = gitlabci.NewDriver()
+	case header.BackendName:
+		driver = header.NewDriver()
 	case ldap.BackendName:
 		driver = ldap.NewDriver()
+	case radius.BackendName:
+		driver = radius.NewDriver()
+	case signedurl.BackendName:
+		driver = signedurl.NewDriver()
 	case simple.BackendName:
 		driver = simple.NewDriver()
+	case sql.BackendName:
+		driver = sql.NewDriver()
 	case upstream.BackendName:
 		driver = upstream.NewDriver()
+	case webhook.BackendName:
+		driver = webhook.NewDriver()
 	default:
 		return fmt.Errorf("invalid reauth configuration, error: unknown backend %q, config: %s", backend.Type, data)
 	}
@@ -68,7 +168,14 @@ func (b *Backend) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("invalid reauth:%s configuration, error: %s, config: %s", backend.Type, err, data)
 	}
 
+	if backend.TOTP != nil {
+		if err := backend.TOTP.Validate(); err != nil {
+			return fmt.Errorf("invalid reauth:%s totp configuration, error: %s, config: %s", backend.Type, err, data)
+		}
+	}
+
 	b.Type = backend.Type
+	b.TOTP = backend.TOTP
 	b.driver = driver
 
 	return nil
@@ -0,0 +1,231 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Interface guard
+var _ backends.IdentityDriver = (*ClientCert)(nil)
+
+// BackendName name
+const BackendName = "clientcert"
+
+// Sources a rule can map the user from
+const (
+	SourceCN    = "cn"
+	SourceEmail = "email"
+	SourceURI   = "uri"
+	SourceDNS   = "dns"
+	SourceOU    = "ou"
+)
+
+// ClientCert backend provides authentication using the certificate presented
+// by the client during the TLS handshake. Caddy should be configured to
+// request client certificates in its TLS connection policies, if it hasn't
+// verified them then the configured CA bundle is used instead.
+//
+// The user is derived from the certificate by the first matching rule.
+type ClientCert struct {
+	CAFiles []string `json:"ca_files,omitempty"`
+	Rules   []*Rule  `json:"rules,omitempty"`
+
+	pool *x509.CertPool
+}
+
+// Rule maps a value from the certificate to a user. Match is optional and
+// when given the user is produced by expanding User with the submatches
+// (default $0), otherwise the value is used as is.
+type Rule struct {
+	Source string            `json:"source,omitempty"`
+	Match  *jsontypes.Regexp `json:"match,omitempty"`
+	User   string            `json:"user,omitempty"`
+}
+
+// NewDriver returns a new instance of ClientCert with some defaults
+func NewDriver() *ClientCert {
+	return &ClientCert{}
+}
+
+// Validate verifies that this module is functional with the given configuration
+func (h *ClientCert) Validate() error {
+	if len(h.Rules) == 0 {
+		h.Rules = []*Rule{{Source: SourceCN}}
+	}
+
+	for i, rule := range h.Rules {
+		switch rule.Source {
+		case SourceCN, SourceEmail, SourceURI, SourceDNS, SourceOU:
+		default:
+			return fmt.Errorf("rules[%d]: unknown source %q", i, rule.Source)
+		}
+	}
+
+	if len(h.CAFiles) == 0 {
+		h.pool = nil
+		return nil
+	}
+
+	h.pool = x509.NewCertPool()
+	for _, file := range h.CAFiles {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read ca file: %v", err)
+		}
+
+		if !h.pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in ca file %q", file)
+		}
+	}
+
+	return nil
+}
+
+// Authenticate fulfils the backend interface
+func (h *ClientCert) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *ClientCert) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+
+	if len(r.TLS.VerifiedChains) == 0 {
+		if err := h.verify(r.TLS.PeerCertificates); err != nil {
+			return nil, nil
+		}
+	}
+
+	user := h.mapUser(cert)
+	if user == "" {
+		return nil, nil
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	return &backends.Identity{
+		ID: user,
+		Metadata: map[string]string{
+			"cert_subject":     cert.Subject.String(),
+			"cert_serial":      cert.SerialNumber.String(),
+			"cert_issuer":      cert.Issuer.String(),
+			"cert_fingerprint": hex.EncodeToString(fingerprint[:]),
+		},
+	}, nil
+}
+
+func (h *ClientCert) verify(chain []*x509.Certificate) error {
+	if h.pool == nil {
+		return errors.New("certificate was not verified and no ca files are configured")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         h.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return err
+}
+
+func (h *ClientCert) mapUser(cert *x509.Certificate) string {
+	for _, rule := range h.Rules {
+		for _, value := range values(cert, rule.Source) {
+			if user := rule.apply(value); user != "" {
+				return user
+			}
+		}
+	}
+
+	return ""
+}
+
+func (r *Rule) apply(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	if r.Match == nil || r.Match.Regexp == nil {
+		return value
+	}
+
+	match := r.Match.FindStringSubmatchIndex(value)
+	if match == nil {
+		return ""
+	}
+
+	template := r.User
+	if template == "" {
+		template = "$0"
+	}
+
+	return strings.TrimSpace(string(r.Match.ExpandString(nil, template, value, match)))
+}
+
+func values(cert *x509.Certificate, source string) []string {
+	switch source {
+	case SourceCN:
+		return []string{cert.Subject.CommonName}
+	case SourceEmail:
+		return cert.EmailAddresses
+	case SourceDNS:
+		return cert.DNSNames
+	case SourceOU:
+		return cert.Subject.OrganizationalUnit
+	case SourceURI:
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		return uris
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// testCA issues client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "reauth-clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue a client certificate, configure may change the template
+func (ca *testCA) issue(t *testing.T, configure func(c *x509.Certificate)) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spiffe, _ := url.Parse("spiffe://example.com/workload/billing")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject: pkix.Name{
+			CommonName:         "alice",
+			OrganizationalUnit: []string{"engineering", "team-platform"},
+		},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:       []string{"billing.internal.example.com"},
+		EmailAddresses: []string{"alice@example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	if configure != nil {
+		configure(template)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func newRequest(verified bool, chain ...*x509.Certificate) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: chain}
+	if verified {
+		r.TLS.VerifiedChains = [][]*x509.Certificate{chain}
+	}
+	return r
+}
+
+func regexp(t *testing.T, expr string) *jsontypes.Regexp {
+	r := &jsontypes.Regexp{}
+	if err := r.Unmarshal(expr); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVerification(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	other := newTestCA(t, "other ca")
+
+	valid := ca.issue(t, nil)
+	untrusted := other.issue(t, nil)
+	expired := ca.issue(t, func(c *x509.Certificate) {
+		c.NotBefore = time.Now().Add(-2 * time.Hour)
+		c.NotAfter = time.Now().Add(-time.Hour)
+	})
+	serverOnly := ca.issue(t, func(c *x509.Certificate) {
+		c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+
+	tests := []struct {
+		name    string
+		caFiles []string
+		request *http.Request
+		ok      bool
+	}{
+		{name: "no tls", request: httptest.NewRequest("GET", "/", nil)},
+		{name: "no certificate", request: newRequest(false)},
+		{name: "verified by caddy", request: newRequest(true, untrusted), ok: true},
+		{name: "verified by caddy with ca files", caFiles: []string{ca.file}, request: newRequest(true, untrusted), ok: true},
+		{name: "unverified without ca files", request: newRequest(false, valid)},
+		{name: "ca pool", caFiles: []string{ca.file}, request: newRequest(false, valid), ok: true},
+		{name: "ca pool with other ca", caFiles: []string{other.file, ca.file}, request: newRequest(false, valid), ok: true},
+		{name: "untrusted", caFiles: []string{ca.file}, request: newRequest(false, untrusted)},
+		{name: "expired", caFiles: []string{ca.file}, request: newRequest(false, expired)},
+		{name: "not for client auth", caFiles: []string{ca.file}, request: newRequest(false, serverOnly)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.CAFiles = test.caFiles
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			identity, err := h.AuthenticateIdentity(test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.ok != (identity != nil) {
+				t.Errorf("expected authenticated to be %v, got %+v", test.ok, identity)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	cert := ca.issue(t, nil)
+
+	tests := []struct {
+		name  string
+		rules []*Rule
+		user  string
+	}{
+		{name: "default", user: "alice"},
+		{name: "cn", rules: []*Rule{{Source: SourceCN}}, user: "alice"},
+		{name: "dns", rules: []*Rule{{Source: SourceDNS}}, user: "billing.internal.example.com"},
+		{name: "email", rules: []*Rule{{Source: SourceEmail}}, user: "alice@example.com"},
+		{name: "uri", rules: []*Rule{{Source: SourceURI}}, user: "spiffe://example.com/workload/billing"},
+		{name: "ou", rules: []*Rule{{Source: SourceOU}}, user: "engineering"},
+		{name: "match", rules: []*Rule{{Source: SourceOU, Match: regexp(t, `^team-`)}}, user: "team-"},
+		{name: "capture", rules: []*Rule{{Source: SourceEmail, Match: regexp(t, `^(\w+)@(example)\.com$`), User: "$2/$1"}}, user: "example/alice"},
+		{
+			name:  "named capture",
+			rules: []*Rule{{Source: SourceURI, Match: regexp(t, `^spiffe://example\.com/workload/(?P<name>[a-z]+)$`), User: "svc-${name}"}},
+			user:  "svc-billing",
+		},
+		{
+			name: "first matching rule",
+			rules: []*Rule{
+				{Source: SourceDNS, Match: regexp(t, `\.external\.`)},
+				{Source: SourceOU, Match: regexp(t, `^team-(.+)$`), User: "$1"},
+				{Source: SourceCN},
+			},
+			user: "platform",
+		},
+		{name: "no match", rules: []*Rule{{Source: SourceEmail, Match: regexp(t, `@example\.org$`)}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.Rules = test.rules
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			identity, err := h.AuthenticateIdentity(newRequest(true, cert))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.user == "" {
+				if identity != nil {
+					t.Errorf("expected no user, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil || identity.ID != test.user {
+				t.Errorf("expected %q, got %+v", test.user, identity)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	cert := ca.issue(t, nil)
+
+	h := NewDriver()
+	h.CAFiles = []string{ca.file}
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := h.AuthenticateIdentity(newRequest(false, cert))
+	if err != nil || identity == nil {
+		t.Fatalf("expected to authenticate, got %+v, %v", identity, err)
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	for key, expected := range map[string]string{
+		"cert_subject":     "CN=alice,OU=engineering+OU=team-platform",
+		"cert_serial":      "42",
+		"cert_issuer":      "CN=test ca",
+		"cert_fingerprint": hex.EncodeToString(fingerprint[:]),
+	} {
+		if v := identity.Metadata[key]; v != expected {
+			t.Errorf("expected %s to be %q, got %q", key, expected, v)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reauth-clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		h    *ClientCert
+	}{
+		{name: "unknown source", h: &ClientCert{Rules: []*Rule{{Source: "serial"}}}},
+		{name: "missing ca file", h: &ClientCert{CAFiles: []string{filepath.Join(dir, "missing.pem")}}},
+		{name: "no certificates", h: &ClientCert{CAFiles: []string{empty}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.h.Validate(); err == nil {
+				t.Error("expected validation to fail")
+			}
+		})
+	}
+}
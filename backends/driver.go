@@ -9,3 +9,58 @@ type Driver interface {
 	Authenticate(r *http.Request) (string, error)
 	Validate() error
 }
+
+// Identity is an authenticated user along with anything else the
+// authentication provider was able to tell us about them.
+//
+// RequestHeader is set on the request before it is passed on, headers
+// without values are removed, and ResponseHeader is added to the response
+// sent to the client.
+type Identity struct {
+	ID             string
+	Metadata       map[string]string
+	RequestHeader  http.Header
+	ResponseHeader http.Header
+}
+
+// IdentityDriver is implemented by authentication providers that can
+// return more than just the user id.
+type IdentityDriver interface {
+	Driver
+	AuthenticateIdentity(r *http.Request) (*Identity, error)
+}
+
+// Sanitizer is implemented by authentication providers that trust
+// something in the request which must be removed when it can't be trusted,
+// whether or not the provider ends up authenticating the request.
+type Sanitizer interface {
+	Sanitize(r *http.Request)
+}
+
+// Reasons a driver may reject a request with.
+const (
+	ReasonChallenge          = "challenge"
+	ReasonAccountDisabled    = "account_disabled"
+	ReasonAccountLocked      = "account_locked"
+	ReasonAccountExpired     = "account_expired"
+	ReasonPasswordExpired    = "password_expired"
+	ReasonPasswordMustChange = "password_must_change"
+	ReasonLogonRestricted    = "logon_restricted"
+)
+
+// Rejection is returned as an error by drivers that know why a request
+// can't be authenticated and want the failure mode to be able to tell the
+// client, as opposed to failing for a technical reason. ResponseHeader is
+// added to the response before the failure mode handles it.
+type Rejection struct {
+	Reason         string
+	Message        string
+	ResponseHeader http.Header
+}
+
+func (r *Rejection) Error() string {
+	if r.Message == "" {
+		return "rejected: " + r.Reason
+	}
+	return "rejected: " + r.Reason + ": " + r.Message
+}
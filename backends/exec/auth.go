@@ -0,0 +1,345 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Interface guards
+var (
+	_ backends.IdentityDriver = (*Exec)(nil)
+	_ caddy.Provisioner       = (*Exec)(nil)
+	_ caddy.CleanerUpper      = (*Exec)(nil)
+)
+
+// BackendName name
+const BackendName = "exec"
+
+const defaultTimeout = 10 * time.Second
+const defaultMaxConcurrent = 4
+const maxOutput = 64 << 10
+
+// Exit codes understood from the program
+const (
+	ExitAuthenticated = 0
+	ExitRejected      = 1
+)
+
+var defaultEnv = []string{"PATH"}
+
+// Exec backend provides authentication by running an external program.
+//
+// The credentials and some details of the request are written to the
+// program's stdin as JSON, they are never passed as arguments. An exit code
+// of 0 authenticates the user, 1 rejects them and anything else is treated
+// as an error. The program may write a JSON object to stdout naming the
+// user, their groups and any metadata.
+//
+// In persistent mode the program is kept running and is sent one JSON
+// request per line, answering each with a JSON response line that includes
+// "authenticated": true or false.
+//
+// Only the environment variables named in Env are passed to the program.
+type Exec struct {
+	Command        []string           `json:"command,omitempty"`
+	Dir            string             `json:"dir,omitempty"`
+	Env            []string           `json:"env,omitempty"`
+	ForwardHeaders []string           `json:"forward_headers,omitempty"`
+	Timeout        jsontypes.Duration `json:"timeout,omitempty"`
+	MaxConcurrent  int                `json:"max_concurrent,omitempty"`
+	Persistent     bool               `json:"persistent,omitempty"`
+
+	env   []string
+	slots chan struct{}
+	idle  chan *worker
+
+	mu      sync.Mutex
+	workers map[*worker]struct{}
+}
+
+// Request is written to the program's stdin
+type Request struct {
+	Username   string            `json:"username"`
+	Password   string            `json:"password"`
+	Method     string            `json:"method"`
+	URI        string            `json:"uri"`
+	Host       string            `json:"host"`
+	RemoteAddr string            `json:"remote_addr"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// Response is read from the program's stdout, all fields are optional except
+// Authenticated in persistent mode. A one shot program that exits 0 is taken
+// to have authenticated the user unless it says otherwise.
+type Response struct {
+	Authenticated bool              `json:"authenticated,omitempty"`
+	User          string            `json:"user,omitempty"`
+	Groups        []string          `json:"groups,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// NewDriver returns a new instance of Exec with some defaults
+func NewDriver() *Exec {
+	return &Exec{
+		Env:           defaultEnv,
+		Timeout:       jsontypes.Duration{Duration: defaultTimeout},
+		MaxConcurrent: defaultMaxConcurrent,
+	}
+}
+
+// Validate verifies that this module is functional with the given configuration
+func (h *Exec) Validate() error {
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		return errors.New("command is a required parameter")
+	}
+
+	if _, err := exec.LookPath(h.Command[0]); err != nil {
+		return fmt.Errorf("command: %v", err)
+	}
+
+	if h.Timeout.Duration <= 0 {
+		return errors.New("timeout must be greater than 0")
+	}
+
+	if h.MaxConcurrent <= 0 {
+		return errors.New("max concurrent must be greater than 0")
+	}
+
+	return nil
+}
+
+// Provision prepares the environment and concurrency limits
+func (h *Exec) Provision(ctx caddy.Context) error {
+	// A nil environment would give the program all of Caddy's
+	h.env = []string{}
+	for _, name := range h.Env {
+		if v, found := os.LookupEnv(name); found {
+			h.env = append(h.env, name+"="+v)
+		}
+	}
+
+	h.slots = make(chan struct{}, h.MaxConcurrent)
+	h.idle = make(chan *worker, h.MaxConcurrent)
+	h.workers = map[*worker]struct{}{}
+
+	return nil
+}
+
+// Cleanup stops any persistent workers
+func (h *Exec) Cleanup() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.workers {
+		w.kill()
+	}
+	h.workers = map[*worker]struct{}{}
+
+	return nil
+}
+
+// Authenticate fulfils the backend interface
+func (h *Exec) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *Exec) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	un, pw, k := r.BasicAuth()
+	if !k {
+		return nil, nil
+	}
+
+	if h.slots == nil {
+		return nil, errors.New("exec has not been provisioned")
+	}
+
+	input, err := json.Marshal(h.request(r, un, pw))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout.Duration)
+	defer cancel()
+
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	case <-ctx.Done():
+		return nil, errors.New("timed out waiting for a free slot")
+	}
+
+	var resp *Response
+	if h.Persistent {
+		resp, err = h.ask(ctx, input)
+	} else {
+		resp, err = h.run(ctx, input)
+	}
+
+	if resp == nil || err != nil {
+		return nil, err
+	}
+
+	identity := &backends.Identity{ID: resp.User}
+	if identity.ID == "" {
+		identity.ID = un
+	}
+
+	if len(resp.Metadata) > 0 || len(resp.Groups) > 0 {
+		identity.Metadata = map[string]string{}
+		for k, v := range resp.Metadata {
+			identity.Metadata[k] = v
+		}
+		if len(resp.Groups) > 0 {
+			identity.Metadata["groups"] = strings.Join(resp.Groups, ",")
+		}
+	}
+
+	return identity, nil
+}
+
+func (h *Exec) request(r *http.Request, un, pw string) *Request {
+	req := &Request{
+		Username:   un,
+		Password:   pw,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	for _, header := range h.ForwardHeaders {
+		if v := r.Header.Get(header); v != "" {
+			if req.Headers == nil {
+				req.Headers = map[string]string{}
+			}
+			req.Headers[header] = v
+		}
+	}
+
+	return req
+}
+
+func (h *Exec) command() *exec.Cmd {
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Dir = h.Dir
+	cmd.Env = h.env
+	setProcessGroup(cmd)
+
+	return cmd
+}
+
+// run starts the program for a single request
+func (h *Exec) run(ctx context.Context, input []byte) (*Response, error) {
+	var stdout, stderr limitedBuffer
+	stdout.limit, stderr.limit = maxOutput, maxOutput
+
+	cmd := h.command()
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %q: %v", h.Command[0], err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return nil, fmt.Errorf("%q timed out", h.Command[0])
+	}
+
+	code := ExitAuthenticated
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, err
+		}
+		code = exitErr.ExitCode()
+	}
+
+	switch code {
+	case ExitAuthenticated:
+	case ExitRejected:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%q exited with %d: %s", h.Command[0], code, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := &Response{Authenticated: true}
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		if err := json.Unmarshal(out, resp); err != nil {
+			return nil, fmt.Errorf("invalid response from %q: %v", h.Command[0], err)
+		}
+	}
+
+	if !resp.Authenticated {
+		return nil, nil
+	}
+
+	return resp, nil
+}
+
+// limitedBuffer discards anything written beyond its limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.limit - b.Len(); n < len(p) {
+		if n > 0 {
+			b.Buffer.Write(p[:n])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
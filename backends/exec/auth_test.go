@@ -0,0 +1,169 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package exec
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+const oneShot = `
+input=$(cat)
+case "$input" in
+	*'"password":"password"'*) echo '{"user":"alice","groups":["admins","users"],"metadata":{"mail":"alice@example.com"}}' ;;
+	*'"password":"slow"'*) sleep 10 ;;
+	*'"password":"broken"'*) echo oops >&2; exit 3 ;;
+	*'"password":"denied"'*) echo '{"authenticated":false}' ;;
+	*) exit 1 ;;
+esac
+`
+
+const persistent = `
+while read -r line; do
+	case "$line" in
+		*'"password":"password"'*) echo '{"authenticated":true,"groups":["workers"]}' ;;
+		*'"password":"slow"'*) sleep 10 ;;
+		*) echo '{"authenticated":false}' ;;
+	esac
+done
+`
+
+func newTestDriver(t *testing.T, script string, persistent bool) *Exec {
+	h := NewDriver()
+	h.Command = []string{"/bin/sh", "-c", script}
+	h.Timeout = jsontypes.Duration{Duration: 500 * time.Millisecond}
+	h.Persistent = persistent
+
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Cleanup() })
+
+	return h
+}
+
+func authenticate(h *Exec, pw string) (*backends.Identity, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", pw)
+	return h.AuthenticateIdentity(r)
+}
+
+func TestOneShot(t *testing.T) {
+	h := newTestDriver(t, oneShot, false)
+
+	identity, err := authenticate(h, "password")
+	if err != nil || identity == nil {
+		t.Fatalf("expected to be authenticated, got %+v, %v", identity, err)
+	}
+
+	if identity.ID != "alice" || identity.Metadata["groups"] != "admins,users" || identity.Metadata["mail"] != "alice@example.com" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	if identity, err := authenticate(h, "wrong"); err != nil || identity != nil {
+		t.Errorf("expected to be rejected, got %+v, %v", identity, err)
+	}
+
+	if identity, err := authenticate(h, "denied"); err != nil || identity != nil {
+		t.Errorf("expected authenticated false to reject despite exiting 0, got %+v, %v", identity, err)
+	}
+
+	if _, err := authenticate(h, "broken"); err == nil {
+		t.Error("expected an error for an unexpected exit code")
+	}
+
+	start := time.Now()
+	if _, err := authenticate(h, "slow"); err == nil {
+		t.Error("expected a timeout")
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("expected the process group to be killed at the timeout")
+	}
+}
+
+func TestPersistent(t *testing.T) {
+	h := newTestDriver(t, persistent, true)
+
+	for i := 0; i < 3; i++ {
+		identity, err := authenticate(h, "password")
+		if err != nil || identity == nil || identity.ID != "bob" || identity.Metadata["groups"] != "workers" {
+			t.Fatalf("expected to be authenticated, got %+v, %v", identity, err)
+		}
+	}
+
+	if len(h.workers) != 1 {
+		t.Errorf("expected the worker to be reused, have %d", len(h.workers))
+	}
+
+	if identity, err := authenticate(h, "wrong"); err != nil || identity != nil {
+		t.Errorf("expected to be rejected, got %+v, %v", identity, err)
+	}
+
+	if _, err := authenticate(h, "slow"); err == nil {
+		t.Error("expected a timeout")
+	}
+
+	if len(h.workers) != 0 {
+		t.Errorf("expected the timed out worker to be stopped, have %d", len(h.workers))
+	}
+
+	if identity, err := authenticate(h, "password"); err != nil || identity == nil {
+		t.Fatalf("expected a new worker to authenticate, got %+v, %v", identity, err)
+	}
+}
+
+const environment = `cat >/dev/null; echo "{\"metadata\":{\"listed\":\"$REAUTH_LISTED\",\"secret\":\"$REAUTH_SECRET\"}}"`
+
+func TestEnvironment(t *testing.T) {
+	os.Setenv("REAUTH_LISTED", "listed")
+	os.Setenv("REAUTH_SECRET", "secret")
+	defer os.Unsetenv("REAUTH_LISTED")
+	defer os.Unsetenv("REAUTH_SECRET")
+
+	tests := []struct {
+		name   string
+		env    []string
+		listed string
+	}{
+		{name: "listed", env: []string{"REAUTH_LISTED"}, listed: "listed"},
+		{name: "empty", env: []string{}},
+		{name: "unset", env: []string{"REAUTH_UNSET"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.Command = []string{"/bin/sh", "-c", environment}
+			h.Env = test.env
+
+			if err := h.Provision(caddy.Context{}); err != nil {
+				t.Fatal(err)
+			}
+
+			identity, err := authenticate(h, "password")
+			if err != nil || identity == nil {
+				t.Fatalf("expected to be authenticated, got %+v, %v", identity, err)
+			}
+
+			if identity.Metadata["listed"] != test.listed || identity.Metadata["secret"] != "" {
+				t.Errorf("expected only the listed variables, got %v", identity.Metadata)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package exec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// worker is a persistent instance of the program
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func (w *worker) kill() {
+	w.stdin.Close()
+	killProcessGroup(w.cmd)
+	go w.cmd.Wait()
+}
+
+// ask sends the request to an idle worker, starting one if needed. Workers
+// that fail or time out are killed rather than returned to the pool.
+func (h *Exec) ask(ctx context.Context, input []byte) (*Response, error) {
+	var w *worker
+	select {
+	case w = <-h.idle:
+	default:
+		var err error
+		if w, err = h.startWorker(); err != nil {
+			return nil, err
+		}
+	}
+
+	type result struct {
+		line []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		if _, err := w.stdin.Write(append(input, '\n')); err != nil {
+			done <- result{err: err}
+			return
+		}
+		line, err := w.stdout.ReadBytes('\n')
+		done <- result{line: line, err: err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		h.stopWorker(w)
+		return nil, fmt.Errorf("%q timed out", h.Command[0])
+	}
+
+	if res.err != nil {
+		h.stopWorker(w)
+		return nil, fmt.Errorf("%q worker: %v", h.Command[0], res.err)
+	}
+
+	resp := &Response{}
+	if err := json.Unmarshal(res.line, resp); err != nil {
+		h.stopWorker(w)
+		return nil, fmt.Errorf("invalid response from %q: %v", h.Command[0], err)
+	}
+
+	h.idle <- w
+
+	if !resp.Authenticated {
+		return nil, nil
+	}
+
+	return resp, nil
+}
+
+func (h *Exec) startWorker() (*worker, error) {
+	cmd := h.command()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %q: %v", h.Command[0], err)
+	}
+
+	w := &worker{cmd: cmd, stdin: stdin, stdout: bufio.NewReaderSize(stdout, maxOutput)}
+
+	h.mu.Lock()
+	h.workers[w] = struct{}{}
+	h.mu.Unlock()
+
+	return w, nil
+}
+
+func (h *Exec) stopWorker(w *worker) {
+	h.mu.Lock()
+	delete(h.workers, w)
+	h.mu.Unlock()
+
+	w.kill()
+}
@@ -25,24 +25,40 @@
 package gitlabci
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/freman/caddy2-reauth/backends"
 	"github.com/freman/caddy2-reauth/jsontypes"
 )
 
-// Interface guard
-var _ backends.Driver = (*GitlabCI)(nil)
+// Interface guards
+var (
+	_ backends.IdentityDriver = (*GitlabCI)(nil)
+	_ caddy.Provisioner       = (*GitlabCI)(nil)
+	_ caddy.CleanerUpper      = (*GitlabCI)(nil)
+)
 
 // BackendName name
 const BackendName = "gitlabci"
 
 const defaultTimeout = time.Minute
 const defaultUsername = "gitlab-ci-token"
+const maxBodySize = 1 << 20
+
+// Modes of validating tokens
+const (
+	ModeRefs  = "refs"
+	ModeJob   = "job"
+	ModeToken = "token"
+)
 
 // GitlabCI backend provides authentication against gitlab paths, primarily to make
 // it easier to dynamically authenticate the gitlab-ci against gitlab permitting
@@ -53,23 +69,57 @@ const defaultUsername = "gitlab-ci-token"
 // the username and the token as the password.
 //
 // Example: docker login docker.example.com -u "$CI_PROJECT_PATH" -p "$CI_BUILD_TOKEN"
+//
+// In job mode the token is instead given to GitLab's /api/v4/job endpoint
+// which tells us the project, pipeline, ref, user and environment of the job
+// it belongs to. The username may then be either the configured Username or
+// the project path. Access can be restricted to Projects, Namespaces (and
+// their subgroups), Refs, Environments and, given an APIToken able to read
+// the project, ProtectedRefs.
+//
+// Example: docker login docker.example.com -u gitlab-ci-token -p "$CI_JOB_TOKEN"
+//
+// In token mode the password is a personal, project or group access token
+// which is looked up with /api/v4/user and /api/v4/personal_access_tokens/self.
+// The token must carry all the RequiredScopes and, with RequiredGroups, the
+// user must be a member of one of them, or of a parent group, with at least
+// MinAccessLevel, which needs a token with the api or read_api scope to look
+// up. The username, if given, must be the token's GitLab username.
+//
+// Example: docker login docker.example.com -u "$GITLAB_USER" -p "$PERSONAL_ACCESS_TOKEN"
 type GitlabCI struct {
-	URL                *jsontypes.URL     `json:"url,omitempty"`
-	Timeout            jsontypes.Duration `json:"timeout,omitempty"`
-	Username           string             `json:"username,omitempty"`
-	InsecureSkipVerify bool               `json:"insecure_skip_verify,omitempty"`
+	URL                *jsontypes.URL       `json:"url,omitempty"`
+	Timeout            jsontypes.Duration   `json:"timeout,omitempty"`
+	Username           string               `json:"username,omitempty"`
+	InsecureSkipVerify bool                 `json:"insecure_skip_verify,omitempty"`
+	TLSClient          *jsontypes.TLSClient `json:"tls_client,omitempty"`
+	Transport          backends.Transport   `json:"transport,omitempty"`
+	Mode               string               `json:"mode,omitempty"`
+	Projects           []string             `json:"projects,omitempty"`
+	Namespaces         []string             `json:"namespaces,omitempty"`
+	Refs               []string             `json:"refs,omitempty"`
+	ProtectedRefs      bool                 `json:"protected_refs,omitempty"`
+	Environments       []string             `json:"environments,omitempty"`
+	APIToken           string               `json:"api_token,omitempty"`
+	RequiredScopes     []string             `json:"required_scopes,omitempty"`
+	RequiredGroups     []string             `json:"required_groups,omitempty"`
+	MinAccessLevel     AccessLevel          `json:"min_access_level,omitempty"`
+
+	client *http.Client
 }
 
 // NewDriver returns a GitlabCI instance with some defaults
 func NewDriver() *GitlabCI {
 	return &GitlabCI{
-		Timeout:  jsontypes.Duration{Duration: defaultTimeout},
-		Username: defaultUsername,
+		Timeout:   jsontypes.Duration{Duration: defaultTimeout},
+		Username:  defaultUsername,
+		Transport: backends.NewTransport(),
+		Mode:      ModeRefs,
 	}
 }
 
 // Validate that this module is ready to go
-func (h GitlabCI) Validate() error {
+func (h *GitlabCI) Validate() error {
 	if h.Username == "" {
 		return errors.New("username is a required option")
 	}
@@ -82,6 +132,62 @@ func (h GitlabCI) Validate() error {
 		return errors.New("url to auth against is a required parameter")
 	}
 
+	jobOnly := len(h.Refs) > 0 || h.ProtectedRefs || len(h.Environments) > 0
+	tokenOnly := len(h.RequiredScopes) > 0 || len(h.RequiredGroups) > 0 || h.MinAccessLevel > 0
+
+	switch h.Mode {
+	case ModeRefs:
+		if jobOnly {
+			return errors.New("refs, protected_refs and environments restrictions require job mode")
+		}
+		if tokenOnly {
+			return errors.New("required_scopes, required_groups and min_access_level require token mode")
+		}
+	case ModeJob:
+		if tokenOnly {
+			return errors.New("required_scopes, required_groups and min_access_level require token mode")
+		}
+		if h.ProtectedRefs && h.APIToken == "" {
+			return errors.New("protected_refs requires an api_token to look up the project's protected refs")
+		}
+	case ModeToken:
+		if jobOnly || len(h.Projects) > 0 || len(h.Namespaces) > 0 {
+			return errors.New("project, namespace, ref and environment restrictions don't apply to token mode")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", h.Mode)
+	}
+
+	for _, ref := range h.Refs {
+		if _, err := path.Match(ref, ""); err != nil {
+			return fmt.Errorf("bad ref pattern %q: %v", ref, err)
+		}
+	}
+
+	return h.Transport.Validate()
+}
+
+// Provision builds the client shared by all requests
+func (h *GitlabCI) Provision(ctx caddy.Context) error {
+	tlsConfig, err := h.TLSClient.ConfigSkipVerify(h.InsecureSkipVerify)
+	if err != nil {
+		return fmt.Errorf("tls client: %v", err)
+	}
+
+	h.client = &http.Client{
+		Timeout:       h.Timeout.Duration,
+		CheckRedirect: noRedirectsPolicy,
+		Transport:     h.Transport.New(tlsConfig),
+	}
+
+	return nil
+}
+
+// Cleanup closes idle connections
+func (h *GitlabCI) Cleanup() error {
+	if h.client != nil {
+		h.client.CloseIdleConnections()
+	}
 	return nil
 }
 
@@ -90,45 +196,91 @@ func noRedirectsPolicy(req *http.Request, via []*http.Request) error {
 }
 
 // Authenticate fulfils the backend interface
-func (h GitlabCI) Authenticate(r *http.Request) (string, error) {
+func (h *GitlabCI) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *GitlabCI) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
 	un, pw, k := r.BasicAuth()
 	if !k {
-		return "", nil
+		return nil, nil
 	}
 
-	repo, err := h.URL.Parse(un + ".git/info/refs?service=git-upload-pack")
-	if err != nil {
-		return "", fmt.Errorf("unable to parse repo path: %v", err)
+	if h.client == nil {
+		return nil, errors.New("gitlabci has not been provisioned")
 	}
 
-	c := &http.Client{
-		Timeout:       h.Timeout.Duration,
-		CheckRedirect: noRedirectsPolicy,
+	switch h.Mode {
+	case ModeJob:
+		return h.authenticateJob(r, un, pw)
+	case ModeToken:
+		return h.authenticateToken(r, un, pw)
 	}
 
-	if repo.Scheme == "https" && h.InsecureSkipVerify {
-		c.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	if !h.allowedProject(un) {
+		return nil, nil
+	}
+
+	if err := h.authenticateRefs(r, un, pw); err != nil {
+		return nil, err
+	}
+
+	return &backends.Identity{ID: un}, nil
+}
+
+func (h *GitlabCI) authenticateRefs(r *http.Request, un, pw string) error {
+	repo, err := h.URL.Parse(un + ".git/info/refs?service=git-upload-pack")
+	if err != nil {
+		return fmt.Errorf("unable to parse repo path: %v", err)
 	}
 
 	req, err := http.NewRequest("GET", repo.String(), nil)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	req.SetBasicAuth(h.Username, pw)
 
-	resp, err := c.Do(req)
+	resp, err := h.client.Do(req.WithContext(r.Context()))
 	if err != nil {
-		return "", err
+		return err
 	}
 
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodySize))
 	resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("unexpected status code from gitlabci: %d (%s)", resp.StatusCode, resp.Status)
+		return fmt.Errorf("unexpected status code from gitlabci: %d (%s)", resp.StatusCode, resp.Status)
+	}
+
+	return nil
+}
+
+// allowedProject checks the project path against the Projects and Namespaces
+// restrictions, if any.
+func (h *GitlabCI) allowedProject(project string) bool {
+	if len(h.Projects) == 0 && len(h.Namespaces) == 0 {
+		return true
+	}
+
+	for _, p := range h.Projects {
+		if strings.EqualFold(p, project) {
+			return true
+		}
+	}
+
+	for _, ns := range h.Namespaces {
+		if strings.HasPrefix(strings.ToLower(project), strings.ToLower(strings.TrimSuffix(ns, "/"))+"/") {
+			return true
+		}
 	}
 
-	return un, nil
+	return false
 }
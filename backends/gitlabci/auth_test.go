@@ -0,0 +1,314 @@
+package gitlabci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+const testJob = `{
+	"id": 42,
+	"name": "deploy",
+	"ref": "main",
+	"tag": false,
+	"web_url": "%s/group/sub/project/-/jobs/42",
+	"pipeline": {"id": 7, "project_id": 3, "ref": "main", "sha": "abc123"},
+	"user": {"username": "alice"},
+	"environment": {"name": "production"}
+}`
+
+// jobAPI answers like GitLab's job and protected branches endpoints
+func jobAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/v4/job":
+		if r.Header.Get("JOB-TOKEN") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, testJob, "http://"+r.Host)
+	case "/api/v4/projects/3/protected_branches":
+		if r.Header.Get("PRIVATE-TOKEN") != "api" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[{"name": "release/*"}, {"name": "main"}]`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestJobMode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(jobAPI))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		namespaces   []string
+		refs         []string
+		environments []string
+		protected    bool
+		username     string
+		password     string
+		ok           bool
+	}{
+		{name: "token user", username: "gitlab-ci-token", password: "token", ok: true},
+		{name: "project path", username: "group/sub/project", password: "token", ok: true},
+		{name: "other project", username: "group/other", password: "token"},
+		{name: "bad token", username: "gitlab-ci-token", password: "nope"},
+		{name: "namespace", namespaces: []string{"group"}, username: "gitlab-ci-token", password: "token", ok: true},
+		{name: "wrong namespace", namespaces: []string{"gro"}, username: "gitlab-ci-token", password: "token"},
+		{name: "ref", refs: []string{"release/*"}, username: "gitlab-ci-token", password: "token"},
+		{name: "environment", environments: []string{"production"}, username: "gitlab-ci-token", password: "token", ok: true},
+		{name: "protected", protected: true, username: "gitlab-ci-token", password: "token", ok: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.Mode = ModeJob
+			h.URL = &jsontypes.URL{}
+			if err := h.URL.Unmarshal(srv.URL + "/"); err != nil {
+				t.Fatal(err)
+			}
+			h.Namespaces = test.namespaces
+			h.Refs = test.refs
+			h.Environments = test.environments
+			if test.protected {
+				h.ProtectedRefs, h.APIToken = true, "api"
+			}
+
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer h.Cleanup()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(test.username, test.password)
+
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.ok {
+				if identity != nil {
+					t.Fatalf("expected to be refused, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil {
+				t.Fatal("expected to authenticate")
+			}
+
+			if identity.ID != "group/sub/project" {
+				t.Errorf("unexpected id %q", identity.ID)
+			}
+
+			for k, v := range map[string]string{"namespace": "group/sub", "ref": "main", "pipeline_id": "7", "gitlab_user": "alice", "environment": "production"} {
+				if identity.Metadata[k] != v {
+					t.Errorf("expected metadata %s=%q, got %q", k, v, identity.Metadata[k])
+				}
+			}
+		})
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for pattern, names := range map[string]map[string]bool{
+		"main":      {"main": true, "mainline": false},
+		"release/*": {"release/1.0": true, "release/1.0/hotfix": true, "releases": false},
+		"*-stable":  {"1-0-stable": true, "stable": false},
+	} {
+		for name, expected := range names {
+			if got := wildcardMatch(pattern, name); got != expected {
+				t.Errorf("wildcardMatch(%q, %q) = %v", pattern, name, got)
+			}
+		}
+	}
+}
+
+// tokenAPI answers like GitLab's user, token and groups endpoints
+func tokenAPI(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("PRIVATE-TOKEN")
+	if token != "glpat" && token != "glpat-sub" && token != "glpat-registry" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v4/user":
+		w.Write([]byte(`{"id": 5, "username": "alice", "state": "active"}`))
+	case "/api/v4/personal_access_tokens/self":
+		w.Write([]byte(`{"name": "registry", "scopes": ["read_registry", "read_api"], "active": true, "revoked": false}`))
+	case "/api/v4/groups":
+		if token == "glpat-registry" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("min_access_level") == "40" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		if token == "glpat-sub" {
+			w.Write([]byte(`[{"full_path": "platform/registry"}]`))
+			return
+		}
+		w.Write([]byte(`[{"full_path": "platform"}, {"full_path": "platform/registry"}]`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestTokenMode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(tokenAPI))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		scopes   []string
+		required []string
+		level    AccessLevel
+		username string
+		password string
+		groups   string
+		ok       bool
+		rejected bool
+	}{
+		{name: "token", username: "alice", password: "glpat", ok: true},
+		{name: "no username", username: "", password: "glpat", ok: true},
+		{name: "wrong username", username: "bob", password: "glpat"},
+		{name: "bad token", username: "alice", password: "nope"},
+		{
+			name:     "scopes",
+			scopes:   []string{"read_registry"},
+			username: "alice", password: "glpat", ok: true,
+		},
+		{
+			name:     "missing scope",
+			scopes:   []string{"write_registry"},
+			username: "alice", password: "glpat",
+		},
+		{
+			name:     "groups",
+			required: []string{"platform"},
+			username: "alice", password: "glpat", groups: "platform,platform/registry", ok: true,
+		},
+		{
+			name:     "other group",
+			required: []string{"plat"},
+			username: "alice", password: "glpat",
+		},
+		{
+			name:     "inherited subgroup",
+			required: []string{"Platform/Registry/Mirrors"},
+			username: "alice", password: "glpat", groups: "platform,platform/registry", ok: true,
+		},
+		{
+			name:     "subgroup member",
+			required: []string{"platform/registry"},
+			username: "alice", password: "glpat-sub", groups: "platform/registry", ok: true,
+		},
+		{
+			name:     "subgroup member of parent",
+			required: []string{"platform"},
+			username: "alice", password: "glpat-sub",
+		},
+		{
+			name:     "access level",
+			level:    accessLevels["maintainer"],
+			username: "alice", password: "glpat",
+		},
+		{
+			name:     "groups without api scope",
+			required: []string{"platform"},
+			username: "alice", password: "glpat-registry", rejected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.Mode = ModeToken
+			h.URL = &jsontypes.URL{}
+			if err := h.URL.Unmarshal(srv.URL + "/"); err != nil {
+				t.Fatal(err)
+			}
+			h.RequiredScopes = test.scopes
+			h.RequiredGroups = test.required
+			h.MinAccessLevel = test.level
+
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer h.Cleanup()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(test.username, test.password)
+
+			identity, err := h.AuthenticateIdentity(r)
+
+			var rejection *backends.Rejection
+			if test.rejected {
+				if !errors.As(err, &rejection) || identity != nil {
+					t.Fatalf("expected a rejection, got %+v, %v", identity, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.ok {
+				if identity != nil {
+					t.Fatalf("expected to be refused, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil || identity.ID != "alice" {
+				t.Fatalf("expected to authenticate as alice, got %+v", identity)
+			}
+
+			if identity.Metadata["groups"] != test.groups {
+				t.Errorf("expected groups %q, got %q", test.groups, identity.Metadata["groups"])
+			}
+		})
+	}
+}
+
+func TestAccessLevelUnmarshal(t *testing.T) {
+	var h GitlabCI
+	if err := json.Unmarshal([]byte(`{"min_access_level": "Developer"}`), &h); err != nil || h.MinAccessLevel != 30 {
+		t.Errorf("expected developer to be 30, got %d, %v", h.MinAccessLevel, err)
+	}
+	if err := json.Unmarshal([]byte(`{"min_access_level": 40}`), &h); err != nil || h.MinAccessLevel != 40 {
+		t.Errorf("expected 40, got %d, %v", h.MinAccessLevel, err)
+	}
+	if err := json.Unmarshal([]byte(`{"min_access_level": "admin"}`), &h); err == nil {
+		t.Error("expected unknown level to fail")
+	}
+}
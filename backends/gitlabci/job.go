@@ -0,0 +1,271 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gitlabci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/freman/caddy2-reauth/backends"
+)
+
+// job is the subset of GitLab's job entity we care about
+type job struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Stage    string `json:"stage"`
+	Status   string `json:"status"`
+	Ref      string `json:"ref"`
+	Tag      bool   `json:"tag"`
+	WebURL   string `json:"web_url"`
+	Pipeline struct {
+		ID        int    `json:"id"`
+		ProjectID int    `json:"project_id"`
+		Ref       string `json:"ref"`
+		SHA       string `json:"sha"`
+	} `json:"pipeline"`
+	User *struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Environment *struct {
+		Name string `json:"name"`
+	} `json:"environment"`
+}
+
+// projectPath extracts the path of the project from the job's web url,
+// the job entity doesn't otherwise name the project.
+func (j *job) projectPath(base *url.URL) (string, error) {
+	u, err := url.Parse(j.WebURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse job web_url: %v", err)
+	}
+
+	p := u.Path
+	if i := strings.Index(p, "/-/jobs/"); i >= 0 {
+		p = p[:i]
+	} else {
+		return "", fmt.Errorf("unexpected job web_url %q", j.WebURL)
+	}
+
+	p = strings.TrimPrefix(p, strings.TrimSuffix(base.Path, "/"))
+
+	return strings.Trim(p, "/"), nil
+}
+
+func (j *job) environment() string {
+	if j.Environment == nil {
+		return ""
+	}
+	return j.Environment.Name
+}
+
+func (h *GitlabCI) authenticateJob(r *http.Request, un, pw string) (*backends.Identity, error) {
+	api, err := h.URL.Parse("api/v4/job")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", api.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("JOB-TOKEN", pw)
+
+	var j job
+	if ok, err := h.getJSON(r, req, &j); !ok {
+		return nil, err
+	}
+
+	project, err := j.projectPath(h.URL.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The username is either the conventional token user or must name the
+	// project the job belongs to.
+	if un != h.Username && !strings.EqualFold(un, project) {
+		return nil, nil
+	}
+
+	if !h.allowedProject(project) || !h.allowedRef(j.Ref) || !h.allowedEnvironment(j.environment()) {
+		return nil, nil
+	}
+
+	if h.ProtectedRefs {
+		protected, err := h.protectedRef(r, j.Pipeline.ProjectID, j.Ref, j.Tag)
+		if err != nil || !protected {
+			return nil, err
+		}
+	}
+
+	identity := &backends.Identity{
+		ID: project,
+		Metadata: map[string]string{
+			"project_path": project,
+			"project_id":   strconv.Itoa(j.Pipeline.ProjectID),
+			"namespace":    path.Dir(project),
+			"pipeline_id":  strconv.Itoa(j.Pipeline.ID),
+			"job_id":       strconv.Itoa(j.ID),
+			"job_name":     j.Name,
+			"ref":          j.Ref,
+			"sha":          j.Pipeline.SHA,
+			"tag":          strconv.FormatBool(j.Tag),
+		},
+	}
+
+	if j.User != nil {
+		identity.Metadata["gitlab_user"] = j.User.Username
+	}
+
+	if env := j.environment(); env != "" {
+		identity.Metadata["environment"] = env
+	}
+
+	return identity, nil
+}
+
+// getJSON performs the request decoding the response into v. It reports
+// false without an error if GitLab refused the token.
+func (h *GitlabCI) getJSON(r *http.Request, req *http.Request, v interface{}) (bool, error) {
+	resp, err := h.client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodySize))
+		resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code from gitlabci: %d (%s)", resp.StatusCode, resp.Status)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(v); err != nil {
+		return false, fmt.Errorf("unable to decode gitlab response: %v", err)
+	}
+
+	return true, nil
+}
+
+func (h *GitlabCI) allowedRef(ref string) bool {
+	if len(h.Refs) == 0 {
+		return true
+	}
+
+	for _, pattern := range h.Refs {
+		if ok, _ := path.Match(pattern, ref); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *GitlabCI) allowedEnvironment(env string) bool {
+	if len(h.Environments) == 0 {
+		return true
+	}
+
+	for _, e := range h.Environments {
+		if e == env {
+			return true
+		}
+	}
+
+	return false
+}
+
+type protectedRef struct {
+	Name string `json:"name"`
+}
+
+// protectedRef looks up whether the branch or tag is protected in the
+// project, GitLab's protected refs may contain * wildcards.
+func (h *GitlabCI) protectedRef(r *http.Request, projectID int, ref string, tag bool) (bool, error) {
+	kind := "protected_branches"
+	if tag {
+		kind = "protected_tags"
+	}
+
+	api, err := h.URL.Parse(fmt.Sprintf("api/v4/projects/%d/%s?per_page=100", projectID, kind))
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("GET", api.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("PRIVATE-TOKEN", h.APIToken)
+
+	var refs []protectedRef
+	ok, err := h.getJSON(r, req, &refs)
+	if !ok {
+		if err == nil {
+			err = errors.New("api_token was refused while looking up protected refs")
+		}
+		return false, err
+	}
+
+	for _, p := range refs {
+		if wildcardMatch(p.Name, ref) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// wildcardMatch matches GitLab's protected ref names where * matches
+// anything, including slashes.
+func wildcardMatch(pattern, name string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == name
+	}
+
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+
+	ok, _ := regexp.MatchString("^"+strings.Join(parts, ".*")+"$", name)
+	return ok
+}
@@ -0,0 +1,228 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gitlabci
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/freman/caddy2-reauth/backends"
+)
+
+// AccessLevel is a GitLab membership role, it may be configured by name or
+// by its numeric value.
+type AccessLevel int
+
+var accessLevels = map[string]AccessLevel{
+	"guest":      10,
+	"reporter":   20,
+	"developer":  30,
+	"maintainer": 40,
+	"owner":      50,
+}
+
+// UnmarshalJSON accepts either a role name or its numeric value
+func (a *AccessLevel) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var level int
+		if err := json.Unmarshal(data, &level); err != nil {
+			return fmt.Errorf("access level must be a role name or number: %v", err)
+		}
+		*a = AccessLevel(level)
+		return nil
+	}
+
+	level, found := accessLevels[strings.ToLower(name)]
+	if !found {
+		return fmt.Errorf("unknown access level %q", name)
+	}
+
+	*a = level
+	return nil
+}
+
+// maxGroupPages limits how many pages of groups are fetched for a user
+const maxGroupPages = 10
+const groupsPerPage = 100
+
+type user struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	State    string `json:"state"`
+	Bot      bool   `json:"bot"`
+}
+
+type accessToken struct {
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	Active  bool     `json:"active"`
+	Revoked bool     `json:"revoked"`
+}
+
+type group struct {
+	FullPath string `json:"full_path"`
+}
+
+func (h *GitlabCI) authenticateToken(r *http.Request, un, pw string) (*backends.Identity, error) {
+	var u user
+	if ok, err := h.getToken(r, "api/v4/user", pw, &u); !ok {
+		return nil, err
+	}
+
+	if u.State != "active" {
+		return nil, nil
+	}
+
+	if un != "" && !strings.EqualFold(un, u.Username) {
+		return nil, nil
+	}
+
+	var token accessToken
+	if ok, err := h.getToken(r, "api/v4/personal_access_tokens/self", pw, &token); !ok {
+		return nil, err
+	}
+
+	if !token.Active || token.Revoked || !hasScopes(token.Scopes, h.RequiredScopes) {
+		return nil, nil
+	}
+
+	identity := &backends.Identity{
+		ID: u.Username,
+		Metadata: map[string]string{
+			"gitlab_user":    u.Username,
+			"gitlab_user_id": strconv.Itoa(u.ID),
+			"token_name":     token.Name,
+			"token_scopes":   strings.Join(token.Scopes, ","),
+		},
+	}
+
+	if len(h.RequiredGroups) > 0 || h.MinAccessLevel > 0 {
+		groups, err := h.groups(r, pw)
+		if err != nil {
+			return nil, err
+		}
+
+		if !memberOf(groups, h.RequiredGroups) {
+			return nil, nil
+		}
+
+		if len(groups) > 0 {
+			identity.Metadata["groups"] = strings.Join(groups, ",")
+		}
+	}
+
+	return identity, nil
+}
+
+func (h *GitlabCI) getToken(r *http.Request, endpoint, token string, v interface{}) (bool, error) {
+	api, err := h.URL.Parse(endpoint)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("GET", api.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("PRIVATE-TOKEN", token)
+
+	return h.getJSON(r, req, v)
+}
+
+// groups returns the full paths of the groups the token's user is a member
+// of with at least MinAccessLevel, this requires the token to have api or
+// read_api scope and tokens without are rejected.
+func (h *GitlabCI) groups(r *http.Request, token string) ([]string, error) {
+	level := h.MinAccessLevel
+	if level <= 0 {
+		level = accessLevels["guest"]
+	}
+
+	var paths []string
+	for page := 1; page <= maxGroupPages; page++ {
+		var groups []group
+		endpoint := fmt.Sprintf("api/v4/groups?min_access_level=%d&per_page=%d&page=%d", level, groupsPerPage, page)
+		ok, err := h.getToken(r, endpoint, token, &groups)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &backends.Rejection{Reason: backends.ReasonLogonRestricted, Message: "the token needs the api or read_api scope to check group membership"}
+		}
+
+		for _, g := range groups {
+			paths = append(paths, g.FullPath)
+		}
+
+		if len(groups) < groupsPerPage {
+			break
+		}
+	}
+
+	return paths, nil
+}
+
+func hasScopes(scopes, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, s := range scopes {
+			if s == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// memberOf reports whether any of the groups is, or is a parent of, one of
+// the required groups, as members of a group inherit membership of its
+// subgroups but not the other way around. No required groups means any group
+// will do, but there must be at least one.
+func memberOf(groups, required []string) bool {
+	if len(required) == 0 {
+		return len(groups) > 0
+	}
+
+	for _, g := range groups {
+		g = strings.ToLower(g)
+		for _, r := range required {
+			r = strings.ToLower(strings.TrimSuffix(r, "/"))
+			if g == r || strings.HasPrefix(r, g+"/") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
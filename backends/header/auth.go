@@ -0,0 +1,222 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package header
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Interface guards
+var (
+	_ backends.IdentityDriver = (*Header)(nil)
+	_ backends.Sanitizer      = (*Header)(nil)
+)
+
+// BackendName name
+const BackendName = "header"
+
+const defaultGroupSeparator = ","
+
+var defaultUserHeaders = []string{"X-Remote-User", "X-Forwarded-User"}
+var defaultGroupHeaders = []string{"X-Remote-Groups", "X-Forwarded-Groups"}
+
+// Header backend trusts the identity asserted in request headers by a gateway
+// that has already authenticated the user, but only when the request comes
+// directly from one of the TrustedProxies.
+//
+// Requests from anywhere else have the identity headers removed before any
+// backend runs so they can't be passed on to upstream applications, even when
+// another backend authenticates the request.
+//
+// When an HMACKey is configured the gateway must also send a base64 encoded
+// HMAC-SHA256 of the user and groups, separated by a newline, in HMACHeader.
+type Header struct {
+	TrustedProxies  []*jsontypes.CIDR `json:"trusted_proxies,omitempty"`
+	UserHeaders     []string          `json:"user_headers,omitempty"`
+	GroupHeaders    []string          `json:"group_headers,omitempty"`
+	GroupSeparator  string            `json:"group_separator,omitempty"`
+	MetadataHeaders map[string]string `json:"metadata_headers,omitempty"`
+	HMACHeader      string            `json:"hmac_header,omitempty"`
+	HMACKey         string            `json:"hmac_key,omitempty"`
+
+	key []byte
+}
+
+// NewDriver returns a new instance of Header with some defaults
+func NewDriver() *Header {
+	return &Header{
+		UserHeaders:    defaultUserHeaders,
+		GroupHeaders:   defaultGroupHeaders,
+		GroupSeparator: defaultGroupSeparator,
+	}
+}
+
+// Validate verifies that this module is functional with the given configuration
+func (h *Header) Validate() error {
+	if len(h.TrustedProxies) == 0 {
+		return errors.New("at least one trusted proxy is required")
+	}
+
+	if len(h.UserHeaders) == 0 {
+		return errors.New("at least one user header is required")
+	}
+
+	if h.GroupSeparator == "" {
+		return errors.New("group separator must not be empty")
+	}
+
+	h.key = nil
+	if h.HMACKey != "" {
+		key, err := base64.StdEncoding.DecodeString(h.HMACKey)
+		if err != nil {
+			return fmt.Errorf("hmac key is not valid base64: %v", err)
+		}
+
+		if h.HMACHeader == "" {
+			return errors.New("hmac header is required with an hmac key")
+		}
+
+		h.key = key
+	}
+
+	return nil
+}
+
+// Authenticate fulfils the backend interface
+func (h *Header) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *Header) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	if !h.trusted(r) {
+		h.strip(r)
+		return nil, nil
+	}
+
+	user := first(r.Header, h.UserHeaders)
+	if user == "" {
+		return nil, nil
+	}
+
+	groups := first(r.Header, h.GroupHeaders)
+
+	identity := &backends.Identity{ID: user, Metadata: map[string]string{}}
+
+	if groups != "" {
+		var list []string
+		for _, g := range strings.Split(groups, h.GroupSeparator) {
+			if g = strings.TrimSpace(g); g != "" {
+				list = append(list, g)
+			}
+		}
+		identity.Metadata["groups"] = strings.Join(list, ",")
+	}
+
+	for header, key := range h.MetadataHeaders {
+		if v := r.Header.Get(header); v != "" {
+			identity.Metadata[key] = v
+		}
+	}
+
+	return identity, nil
+}
+
+// Sanitize fulfils the sanitizer interface, removing the identity headers
+// from requests that aren't trusted
+func (h *Header) Sanitize(r *http.Request) {
+	if !h.trusted(r) {
+		h.strip(r)
+	}
+}
+
+// trusted reports whether the request came from a trusted proxy and, with an
+// hmac key, carries a valid signature of the identity
+func (h *Header) trusted(r *http.Request) bool {
+	if !jsontypes.ContainsAddr(h.TrustedProxies, r.RemoteAddr) {
+		return false
+	}
+
+	if h.key == nil {
+		return true
+	}
+
+	user := first(r.Header, h.UserHeaders)
+	groups := first(r.Header, h.GroupHeaders)
+
+	return user != "" && h.verify(r.Header.Get(h.HMACHeader), user, groups)
+}
+
+func (h *Header) verify(signature, user, groups string) bool {
+	given, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(user + "\n" + groups))
+
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// strip removes the identity headers from requests that aren't trusted
+func (h *Header) strip(r *http.Request) {
+	for _, list := range [][]string{h.UserHeaders, h.GroupHeaders} {
+		for _, header := range list {
+			r.Header.Del(header)
+		}
+	}
+
+	for header := range h.MetadataHeaders {
+		r.Header.Del(header)
+	}
+
+	if h.HMACHeader != "" {
+		r.Header.Del(h.HMACHeader)
+	}
+}
+
+func first(header http.Header, names []string) string {
+	for _, name := range names {
+		if v := strings.TrimSpace(header.Get(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,212 @@
+package header
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func cidrs(t *testing.T, networks ...string) []*jsontypes.CIDR {
+	var out []*jsontypes.CIDR
+	for _, n := range networks {
+		c := &jsontypes.CIDR{}
+		if err := c.UnmarshalJSON([]byte(`"` + n + `"`)); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func sign(user, groups string) string {
+	mac := hmac.New(sha256.New, testKey)
+	mac.Write([]byte(user + "\n" + groups))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newRequest(remote string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remote
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+var identityHeaders = map[string]string{
+	"X-Remote-User":   "alice",
+	"X-Remote-Groups": "admins, users",
+	"X-Remote-Email":  "alice@example.com",
+}
+
+func stripped(r *http.Request) bool {
+	for _, header := range []string{"X-Remote-User", "X-Remote-Groups", "X-Remote-Email", "X-Signature"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		remote  string
+		ok      bool
+	}{
+		{name: "trusted", proxies: []string{"10.0.0.1"}, remote: "10.0.0.1:1234", ok: true},
+		{name: "untrusted", proxies: []string{"10.0.0.1"}, remote: "10.0.0.2:1234"},
+		{name: "cidr", proxies: []string{"192.168.0.0/24", "10.0.0.0/8"}, remote: "10.20.30.40:1234", ok: true},
+		{name: "outside cidr", proxies: []string{"10.0.0.0/8"}, remote: "11.0.0.1:1234"},
+		{name: "ipv6", proxies: []string{"fd00::/8"}, remote: "[fd00::1]:1234", ok: true},
+		{name: "bare address", proxies: []string{"10.0.0.0/8"}, remote: "10.0.0.1", ok: true},
+		{name: "unparsable", proxies: []string{"10.0.0.0/8"}, remote: "proxy:1234"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.TrustedProxies = cidrs(t, test.proxies...)
+			h.MetadataHeaders = map[string]string{"X-Remote-Email": "email"}
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := newRequest(test.remote, identityHeaders)
+
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.ok {
+				if identity != nil {
+					t.Errorf("expected to be rejected, got %+v", identity)
+				}
+				if !stripped(r) {
+					t.Errorf("expected the identity headers to be stripped, have %v", r.Header)
+				}
+				return
+			}
+
+			if identity == nil || identity.ID != "alice" {
+				t.Fatalf("expected alice, got %+v", identity)
+			}
+
+			if identity.Metadata["groups"] != "admins,users" || identity.Metadata["email"] != "alice@example.com" {
+				t.Errorf("unexpected metadata %v", identity.Metadata)
+			}
+
+			if stripped(r) {
+				t.Error("expected the identity headers to be left for the upstream")
+			}
+		})
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	h := NewDriver()
+	h.TrustedProxies = cidrs(t, "10.0.0.0/8")
+	h.MetadataHeaders = map[string]string{"X-Remote-Email": "email"}
+	h.HMACHeader = "X-Signature"
+	h.HMACKey = base64.StdEncoding.EncodeToString(testKey)
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		signature string
+		ok        bool
+	}{
+		{name: "valid", signature: sign("alice", "admins, users"), ok: true},
+		{name: "other user", signature: sign("bob", "admins, users")},
+		{name: "other groups", signature: sign("alice", "users")},
+		{name: "missing"},
+		{name: "not base64", signature: "!"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRequest("10.0.0.1:1234", identityHeaders)
+			if test.signature != "" {
+				r.Header.Set("X-Signature", test.signature)
+			}
+
+			h.Sanitize(r)
+			if stripped(r) == test.ok {
+				t.Errorf("expected stripped to be %v, have %v", !test.ok, r.Header)
+			}
+
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (identity != nil) != test.ok {
+				t.Errorf("expected authenticated to be %v, got %+v", test.ok, identity)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	h := NewDriver()
+	h.TrustedProxies = cidrs(t, "10.0.0.0/8")
+	h.MetadataHeaders = map[string]string{"X-Remote-Email": "email"}
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRequest("192.168.1.1:1234", identityHeaders)
+	r.Header.Set("X-Other", "kept")
+	h.Sanitize(r)
+
+	if !stripped(r) {
+		t.Errorf("expected the identity headers to be stripped, have %v", r.Header)
+	}
+
+	if r.Header.Get("X-Other") != "kept" {
+		t.Error("expected other headers to be left alone")
+	}
+
+	r = newRequest("10.0.0.1:1234", identityHeaders)
+	h.Sanitize(r)
+
+	if stripped(r) {
+		t.Error("expected the identity headers from a trusted proxy to be kept")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(h *Header)
+	}{
+		{name: "no proxies", configure: func(h *Header) { h.TrustedProxies = nil }},
+		{name: "no user headers", configure: func(h *Header) { h.UserHeaders = nil }},
+		{name: "no separator", configure: func(h *Header) { h.GroupSeparator = "" }},
+		{name: "bad key", configure: func(h *Header) { h.HMACKey, h.HMACHeader = "!", "X-Signature" }},
+		{name: "key without header", configure: func(h *Header) { h.HMACKey = "a2V5" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.TrustedProxies = []*jsontypes.CIDR{{}}
+			test.configure(h)
+
+			if err := h.Validate(); err == nil {
+				t.Error("expected validation to fail")
+			}
+		})
+	}
+}
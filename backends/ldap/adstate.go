@@ -0,0 +1,196 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freman/caddy2-reauth/backends"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// Attributes describing the state of an Active Directory account
+const (
+	attrUserAccountControl         = "userAccountControl"
+	attrUserAccountControlComputed = "msDS-User-Account-Control-Computed"
+	attrPwdLastSet                 = "pwdLastSet"
+	attrAccountExpires             = "accountExpires"
+)
+
+// userAccountControl flags
+const (
+	uacAccountDisable   = 0x2
+	uacLockout          = 0x10
+	uacDontExpirePasswd = 0x10000
+	uacPasswordExpired  = 0x800000
+)
+
+// neverExpires is the largest interval, AD's way of saying never alongside 0
+const neverExpires = math.MaxInt64
+
+// epochDelta is the number of 100ns intervals between 1601 and 1970
+const epochDelta = 116444736000000000
+
+// subCode matches the sub-code in the diagnostic message of a failed AD bind
+// like "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 775, v3839"
+var subCode = regexp.MustCompile(`\bdata ([0-9a-fA-F]{3,8})\b`)
+
+// rejections are the outcomes of the AD sub-codes, others (525 no such user,
+// 52e bad password) are simply invalid credentials.
+var rejections = map[string]*backends.Rejection{
+	"530": {Reason: backends.ReasonLogonRestricted, Message: "Logging in is not permitted at this time"},
+	"531": {Reason: backends.ReasonLogonRestricted, Message: "Logging in is not permitted from this workstation"},
+	"532": {Reason: backends.ReasonPasswordExpired, Message: "Your password has expired"},
+	"533": {Reason: backends.ReasonAccountDisabled, Message: "Your account is disabled"},
+	"701": {Reason: backends.ReasonAccountExpired, Message: "Your account has expired"},
+	"773": {Reason: backends.ReasonPasswordMustChange, Message: "You must change your password"},
+	"775": {Reason: backends.ReasonAccountLocked, Message: "Your account is locked"},
+}
+
+// bindRejection decodes the sub-code of an AD bind failure into a rejection,
+// it returns nil if the failure is just invalid credentials.
+func bindRejection(err error) *backends.Rejection {
+	var lerr *ldp.Error
+	if !errors.As(err, &lerr) || lerr.ResultCode != ldp.LDAPResultInvalidCredentials || lerr.Err == nil {
+		return nil
+	}
+
+	m := subCode.FindStringSubmatch(lerr.Err.Error())
+	if m == nil {
+		return nil
+	}
+
+	if r, found := rejections[strings.ToLower(m[1])]; found {
+		copy := *r
+		return &copy
+	}
+
+	return nil
+}
+
+// accountStateAttributes are read with the user's entry to check their state
+func accountStateAttributes() []string {
+	return []string{attrUserAccountControl, attrUserAccountControlComputed, attrPwdLastSet, attrAccountExpires}
+}
+
+// readComputedState reads msDS-User-Account-Control-Computed into the entry
+// if it's missing, AD only constructs it when an entry is read with a base
+// scope search so it's never returned when the user was found by a subtree
+// search. It holds the lockout and password expiry flags, which AD works
+// out from lockoutTime and pwdLastSet against the domain's policy.
+func (h *LDAP) readComputedState(c ldp.Client, entry *ldp.Entry) error {
+	if entry.GetAttributeValue(attrUserAccountControlComputed) != "" {
+		return nil
+	}
+
+	sr, err := c.Search(ldp.NewSearchRequest(
+		entry.DN,
+		ldp.ScopeBaseObject, ldp.NeverDerefAliases, 0, int(h.Timeout.Duration/time.Second), false,
+		"(objectClass=*)",
+		[]string{attrUserAccountControlComputed},
+		nil,
+	))
+	if err != nil {
+		return fmt.Errorf("read account state of %q: %v", entry.DN, err)
+	}
+
+	if len(sr.Entries) == 1 {
+		if values := sr.Entries[0].GetAttributeValues(attrUserAccountControlComputed); len(values) > 0 {
+			entry.Attributes = append(entry.Attributes, ldp.NewEntryAttribute(attrUserAccountControlComputed, values))
+		}
+	}
+
+	return nil
+}
+
+// accountState checks the state of the account from the attributes of its
+// entry, catching what a bind may not, returning nil if the account is fine.
+//
+// Lockouts and expired passwords are only seen through the computed flags,
+// pwdLastSet is only checked for a password that must be changed as whether
+// it has expired depends on the domain's maximum password age.
+func accountState(entry *ldp.Entry, now time.Time) *backends.Rejection {
+	uac := intAttribute(entry, attrUserAccountControl)
+	computed := intAttribute(entry, attrUserAccountControlComputed)
+	flags := uac | computed
+
+	switch {
+	case flags&uacAccountDisable != 0:
+		return rejection("533")
+	case flags&uacLockout != 0:
+		return rejection("775")
+	}
+
+	if expires := intAttribute(entry, attrAccountExpires); expires != 0 && expires != neverExpires && !now.Before(fileTime(expires)) {
+		return rejection("701")
+	}
+
+	if entry.GetAttributeValue(attrPwdLastSet) == "0" {
+		return rejection("773")
+	}
+
+	if flags&uacPasswordExpired != 0 && uac&uacDontExpirePasswd == 0 {
+		return rejection("532")
+	}
+
+	return nil
+}
+
+func rejection(code string) *backends.Rejection {
+	copy := *rejections[code]
+	return &copy
+}
+
+func intAttribute(entry *ldp.Entry, name string) int64 {
+	v, _ := strconv.ParseInt(entry.GetAttributeValue(name), 10, 64)
+	return v
+}
+
+// fileTime converts a Windows file time, 100ns intervals since 1601, to a time
+func fileTime(v int64) time.Time {
+	v -= epochDelta
+	return time.Unix(v/1e7, (v%1e7)*100)
+}
+
+// bindFailed turns a failed bind into the error to return, nil if the
+// credentials were simply wrong.
+func bindFailed(name string, err error) error {
+	if rejection := bindRejection(err); rejection != nil {
+		return rejection
+	}
+
+	if ldp.IsErrorWithCode(err, ldp.LDAPResultInvalidCredentials) {
+		return nil
+	}
+
+	return fmt.Errorf("bind with %q: %v", name, err)
+}
@@ -0,0 +1,149 @@
+package ldap
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/freman/caddy2-reauth/backends"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+func adBindError(code string) string {
+	return "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data " + code + ", v3839"
+}
+
+func TestBindRejection(t *testing.T) {
+	for code, reason := range map[string]string{
+		"525": "",
+		"52e": "",
+		"530": backends.ReasonLogonRestricted,
+		"531": backends.ReasonLogonRestricted,
+		"532": backends.ReasonPasswordExpired,
+		"533": backends.ReasonAccountDisabled,
+		"701": backends.ReasonAccountExpired,
+		"773": backends.ReasonPasswordMustChange,
+		"775": backends.ReasonAccountLocked,
+	} {
+		err := ldp.NewError(ldp.LDAPResultInvalidCredentials, errors.New(adBindError(code)))
+		rejection := bindRejection(err)
+
+		switch {
+		case reason == "" && rejection != nil:
+			t.Errorf("%s: expected invalid credentials, got %v", code, rejection)
+		case reason != "" && (rejection == nil || rejection.Reason != reason):
+			t.Errorf("%s: expected %s, got %v", code, reason, rejection)
+		}
+	}
+
+	if rejection := bindRejection(ldp.NewError(ldp.LDAPResultOperationsError, errors.New(adBindError("775")))); rejection != nil {
+		t.Errorf("expected other result codes to be left alone, got %v", rejection)
+	}
+}
+
+// toFileTime converts a time to a Windows file time
+func toFileTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/100+epochDelta, 10)
+}
+
+func TestAccountState(t *testing.T) {
+	now := time.Now()
+
+	for _, test := range []struct {
+		name       string
+		attributes map[string][]string
+		reason     string
+	}{
+		{name: "fine", attributes: map[string][]string{"userAccountControl": {"512"}, "pwdLastSet": {"132000000000000000"}, "accountExpires": {"9223372036854775807"}}},
+		{name: "never expires", attributes: map[string][]string{"accountExpires": {"0"}}},
+		{name: "disabled", attributes: map[string][]string{"userAccountControl": {"514"}}, reason: backends.ReasonAccountDisabled},
+		{name: "locked", attributes: map[string][]string{"msDS-User-Account-Control-Computed": {"16"}}, reason: backends.ReasonAccountLocked},
+		{name: "expired", attributes: map[string][]string{"accountExpires": {toFileTime(now.Add(-time.Hour))}}, reason: backends.ReasonAccountExpired},
+		{name: "expires later", attributes: map[string][]string{"accountExpires": {toFileTime(now.Add(time.Hour))}}},
+		{name: "must change", attributes: map[string][]string{"pwdLastSet": {"0"}}, reason: backends.ReasonPasswordMustChange},
+		{name: "password expired", attributes: map[string][]string{"msDS-User-Account-Control-Computed": {"8388608"}}, reason: backends.ReasonPasswordExpired},
+		{
+			name:       "password never expires",
+			attributes: map[string][]string{"userAccountControl": {"66048"}, "msDS-User-Account-Control-Computed": {"8388608"}},
+		},
+	} {
+		rejection := accountState(ldp.NewEntry("cn=test", test.attributes), now)
+
+		switch {
+		case test.reason == "" && rejection != nil:
+			t.Errorf("%s: expected no rejection, got %v", test.name, rejection)
+		case test.reason != "" && (rejection == nil || rejection.Reason != test.reason):
+			t.Errorf("%s: expected %s, got %v", test.name, test.reason, rejection)
+		}
+	}
+}
+
+func TestAccountStateRejections(t *testing.T) {
+	now := time.Now()
+
+	user := func(name string, attributes map[string][]string) *testEntry {
+		attributes["objectClass"] = []string{"user"}
+		attributes["sAMAccountName"] = []string{name}
+		return &testEntry{
+			DN:         "cn=" + name + ",ou=people,dc=example,dc=com",
+			Password:   name + "-password",
+			Attributes: attributes,
+		}
+	}
+
+	locked := user("locked", map[string][]string{})
+	locked.BindError = adBindError("775")
+
+	entries := append(testDirectory(),
+		locked,
+		user("computedlock", map[string][]string{"lockoutTime": {toFileTime(now)}, "msDS-User-Account-Control-Computed": {"16"}}),
+		user("disabled", map[string][]string{"userAccountControl": {"514"}}),
+		user("expired", map[string][]string{"accountExpires": {toFileTime(now.Add(-time.Hour))}}),
+		user("mustchange", map[string][]string{"pwdLastSet": {"0"}}),
+		user("pwexpired", map[string][]string{"pwdLastSet": {"132000000000000000"}, "msDS-User-Account-Control-Computed": {"8388608"}}),
+		user("noexpiry", map[string][]string{"userAccountControl": {"66048"}, "msDS-User-Account-Control-Computed": {"8388608"}}),
+	)
+
+	s := newTestServer(t, entries...)
+	h := testDriver(t, s)
+	h.AccountState = true
+	provision(t, h)
+
+	for user, reason := range map[string]string{
+		"locked":       backends.ReasonAccountLocked,
+		"computedlock": backends.ReasonAccountLocked,
+		"disabled":     backends.ReasonAccountDisabled,
+		"expired":      backends.ReasonAccountExpired,
+		"mustchange":   backends.ReasonPasswordMustChange,
+		"pwexpired":    backends.ReasonPasswordExpired,
+		"noexpiry":     "",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(user, user+"-password")
+
+		identity, err := h.AuthenticateIdentity(r)
+
+		if reason == "" {
+			if err != nil || identity == nil {
+				t.Errorf("%s: expected to authenticate, got %+v, %v", user, identity, err)
+			}
+			continue
+		}
+
+		if identity != nil {
+			t.Errorf("%s: expected to be refused, got %+v", user, identity)
+		}
+
+		var rejection *backends.Rejection
+		if !errors.As(err, &rejection) || rejection.Reason != reason {
+			t.Errorf("%s: expected %s, got %v", user, reason, err)
+		}
+	}
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Errorf("expected alice to authenticate, got %q", id)
+	}
+}
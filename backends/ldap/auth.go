@@ -28,68 +28,209 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
 	"time"
+	"unicode"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/freman/caddy2-reauth/backends"
 	"github.com/freman/caddy2-reauth/jsontypes"
 
 	ldp "github.com/go-ldap/ldap/v3"
 )
 
-// Interface guard
-var _ backends.Driver = (*LDAP)(nil)
+// Interface guards
+var (
+	_ backends.IdentityDriver = (*LDAP)(nil)
+	_ caddy.Provisioner       = (*LDAP)(nil)
+	_ caddy.CleanerUpper      = (*LDAP)(nil)
+)
 
 // BackendName name
 const BackendName = "ldap"
 
 const defaultPoolSize = 10
+const defaultDialTimeout = 5 * time.Second
+const defaultHealthBackoff = 10 * time.Second
+const defaultSRVService = "ldap"
+const defaultSRVRefresh = 5 * time.Minute
+const defaultIdleTimeout = 5 * time.Minute
+const defaultMaxLifetime = time.Hour
+const defaultPingInterval = 30 * time.Second
 const defaultTimeout = time.Minute
-const defaultFilter = "(&(objectClass=user)(sAMAccountName=%s))"
+const defaultFilter = "(&(objectClass=user)(sAMAccountName={principal}))"
+const defaultGroupAttribute = "memberOf"
+const defaultGroupNameAttribute = "cn"
 
 // LDAP backend provides authentication against LDAP paths, for example for Microsoft AD.
+//
+// The servers are the URL followed by the URLs and, with an SRVDomain, those
+// found in the _ldap._tcp (or SRVService) SRV records of the domain, which
+// are looked up again every SRVRefresh. Each server has its own connection
+// pool. Selection is either failover, the first healthy server in order, or
+// round_robin. A server that can't be connected to is avoided for
+// HealthBackoff, doubling with each consecutive failure, unless every
+// server is failing.
+//
+// The service account binds with its BindDN and BindPassword, or with
+// BindMethod external by SASL EXTERNAL with the TLSClient certificate over
+// ldaps or TLS, or digest_md5 by SASL DIGEST-MD5 with the BindDN as the
+// user name.
+//
+// Connections are bound as the service account once, users are bound on a
+// separate set of connections. Up to ConnectionPoolSize idle connections
+// of each are kept per server, closed once idle for IdleTimeout or older
+// than MaxLifetime. Connections idle for longer than PingInterval are
+// checked before they are used again.
+//
+// Failed binds against Active Directory are decoded to tell users their
+// password has expired or their account is locked, disabled or expired,
+// which the failure mode can show them. With AccountState the
+// userAccountControl, msDS-User-Account-Control-Computed, pwdLastSet and
+// accountExpires attributes of the user's entry are checked as well.
+//
+// A forest of several domains is configured with Domains, each with its own
+// servers and base DN. Users are routed to their home domain by naming it,
+// CORP\alice or alice@corp.example.com, or by searching the GlobalCatalog
+// servers (port 3268, or 3269 for ldaps) across the forest with the
+// GlobalCatalogFilter. Bare names otherwise belong to the DefaultDomain.
+// The domain is added to the metadata, and with an IdentityFormat of upn or
+// netbios the user is identified as alice@corp.example.com or CORP\alice
+// however they gave their name.
+//
+// PasswordChange picks how ChangePassword changes passwords, either with
+// the Password Modify extended operation or AD's unicodePwd attribute.
+//
+// FilterDN is searched for under BaseDN to find the user, it may contain the
+// placeholders {username} for the name the user gave, {principal} for that
+// name with the PrincipalSuffix and {domain} for the domain part of either.
+// Values are escaped before they are placed in the filter. The GroupFilter
+// may also use {dn} for the DN of the user. A single %s in older
+// configuration is taken as {principal} and {dn} respectively.
+//
+// Directories without a service account can use BindTemplate to bind as
+// the user directly with either a DN, uid={username},ou=people,dc=example,dc=com,
+// or a user principal name, {username}@corp.example.com. With ReadEntry the
+// user's own entry is then read for the attributes and groups, found by the
+// DN or by searching under BaseDN with FilterDN for a principal name.
+//
+// The user's groups are read from GroupAttribute (memberOf by default) of
+// their entry and, with a GroupFilter, searched for under GroupBaseDN. With
+// NestedGroups the search instead uses AD's LDAP_MATCHING_RULE_IN_CHAIN to
+// find every group the user is a member of, directly or not. Groups are
+// named by GroupNameAttribute, users outside all of the RequiredGroups are
+// refused. A required group given by DN matches only that group while one
+// given by name matches any group of that name anywhere in the directory, so
+// prefer DNs where the names aren't unique.
+//
+// The user is identified by their DN unless UserAttribute names another
+// attribute of their entry, such as sAMAccountName, uid, userPrincipalName or
+// mail. Attributes maps further attributes of the entry into the user's
+// metadata, keyed by the given name or the snake cased attribute name if that
+// is empty. These are all fetched in the same search as the DN.
 type LDAP struct {
-	URL                *jsontypes.URL     `json:"url,omitempty"`
-	BaseDN             string             `json:"base_dn,omitempty"`
-	FilterDN           string             `json:"filter_dn,omitempty"`
-	PrincipalSuffix    string             `json:"principal_suffix,omitempty"`
-	BindDN             string             `json:"bind_dn,omitempty"`
-	BindPassword       string             `json:"bind_password,omitempty"`
-	TLS                bool               `json:"tls,omitempty"`
-	InsecureSkipVerify bool               `json:"insecure_skip_verify,omitempty"`
-	Timeout            jsontypes.Duration `json:"timeout,omitempty"`
-	ConnectionPoolSize int                `json:"connection_pool_size,omitempty"`
-
-	pool chan ldp.Client
+	URL                *jsontypes.URL       `json:"url,omitempty"`
+	URLs               []*jsontypes.URL     `json:"urls,omitempty"`
+	SRVDomain          string               `json:"srv_domain,omitempty"`
+	SRVService         string               `json:"srv_service,omitempty"`
+	SRVRefresh         jsontypes.Duration   `json:"srv_refresh,omitempty"`
+	Selection          string               `json:"selection,omitempty"`
+	HealthBackoff      jsontypes.Duration   `json:"health_backoff,omitempty"`
+	DialTimeout        jsontypes.Duration   `json:"dial_timeout,omitempty"`
+	BaseDN             string               `json:"base_dn,omitempty"`
+	FilterDN           string               `json:"filter_dn,omitempty"`
+	PrincipalSuffix    string               `json:"principal_suffix,omitempty"`
+	BindDN             string               `json:"bind_dn,omitempty"`
+	BindPassword       string               `json:"bind_password,omitempty"`
+	BindMethod         string               `json:"bind_method,omitempty"`
+	BindTemplate       string               `json:"bind_template,omitempty"`
+	ReadEntry          bool                 `json:"read_entry,omitempty"`
+	TLS                bool                 `json:"tls,omitempty"`
+	InsecureSkipVerify bool                 `json:"insecure_skip_verify,omitempty"`
+	TLSClient          *jsontypes.TLSClient `json:"tls_client,omitempty"`
+	Timeout            jsontypes.Duration   `json:"timeout,omitempty"`
+	ConnectionPoolSize int                  `json:"connection_pool_size,omitempty"`
+	IdleTimeout        jsontypes.Duration   `json:"idle_timeout,omitempty"`
+	MaxLifetime        jsontypes.Duration   `json:"max_lifetime,omitempty"`
+	PingInterval       jsontypes.Duration   `json:"ping_interval,omitempty"`
+	GroupAttribute     string               `json:"group_attribute,omitempty"`
+	GroupBaseDN        string               `json:"group_base_dn,omitempty"`
+	GroupFilter        string               `json:"group_filter,omitempty"`
+	NestedGroups       bool                 `json:"nested_groups,omitempty"`
+	GroupNameAttribute string               `json:"group_name_attribute,omitempty"`
+	RequiredGroups     []string             `json:"required_groups,omitempty"`
+	UserAttribute      string               `json:"user_attribute,omitempty"`
+	Attributes         map[string]string    `json:"attributes,omitempty"`
+	AccountState       bool                 `json:"account_state,omitempty"`
+	PasswordChange     string               `json:"password_change,omitempty"`
+
+	Domains             []*Domain        `json:"domains,omitempty"`
+	DefaultDomain       string           `json:"default_domain,omitempty"`
+	GlobalCatalog       []*jsontypes.URL `json:"global_catalog,omitempty"`
+	GlobalCatalogFilter string           `json:"global_catalog_filter,omitempty"`
+	IdentityFormat      string           `json:"identity_format,omitempty"`
+
+	servers             *servers
+	resolver            srvResolver
+	tlsConfig           *tls.Config
+	filter              *template
+	groupFilter         *template
+	bindTemplate        *template
+	domain              *Domain
+	globalCatalog       *LDAP
+	globalCatalogFilter *template
+	catalog             bool
+	requiredDNs         []*ldp.DN
 }
 
 // NewDriver returns a LDAP instance with some defaults
 func NewDriver() *LDAP {
 	return &LDAP{
-		Timeout:            jsontypes.Duration{Duration: defaultTimeout},
-		ConnectionPoolSize: defaultPoolSize,
-		FilterDN:           defaultFilter,
+		Timeout:             jsontypes.Duration{Duration: defaultTimeout},
+		ConnectionPoolSize:  defaultPoolSize,
+		SRVService:          defaultSRVService,
+		SRVRefresh:          jsontypes.Duration{Duration: defaultSRVRefresh},
+		Selection:           SelectionFailover,
+		HealthBackoff:       jsontypes.Duration{Duration: defaultHealthBackoff},
+		DialTimeout:         jsontypes.Duration{Duration: defaultDialTimeout},
+		IdleTimeout:         jsontypes.Duration{Duration: defaultIdleTimeout},
+		MaxLifetime:         jsontypes.Duration{Duration: defaultMaxLifetime},
+		PingInterval:        jsontypes.Duration{Duration: defaultPingInterval},
+		BindMethod:          BindSimple,
+		PasswordChange:      PasswordModify,
+		GlobalCatalogFilter: defaultGlobalCatalogFilter,
+		FilterDN:            defaultFilter,
+		GroupAttribute:      defaultGroupAttribute,
+		GroupNameAttribute:  defaultGroupNameAttribute,
 	}
 }
 
 // Validate that this module is ready to go
 func (h *LDAP) Validate() error {
 	var missing []string
-	if h.URL == nil {
+	domains := len(h.Domains) > 0
+
+	if h.URL == nil && len(h.URLs) == 0 && h.SRVDomain == "" && !domains {
 		missing = append(missing, "URL")
 	}
 
-	if h.BindDN == "" {
+	direct := h.BindTemplate != ""
+
+	// Domains may each have their own service account, which a client
+	// certificate identifies with external binds
+	external := h.BindMethod == BindExternal
+
+	if h.BindDN == "" && !direct && !domains && !external {
 		missing = append(missing, "BindDN")
 	}
 
-	if h.BindPassword == "" {
+	if h.BindPassword == "" && !direct && !domains && !external {
 		missing = append(missing, "BindPassword")
 	}
 
-	if h.BaseDN == "" {
+	// Only a principal name needs searching for the user's entry
+	if h.BaseDN == "" && !domains && (!direct || (h.ReadEntry && !strings.Contains(h.BindTemplate, "="))) {
 		missing = append(missing, "BaseDN")
 	}
 
@@ -109,7 +250,114 @@ func (h *LDAP) Validate() error {
 		return errors.New("connection pool size must be greater than 0")
 	}
 
-	h.pool = make(chan ldp.Client, h.ConnectionPoolSize)
+	if err := h.validateBindMethod(); err != nil {
+		return err
+	}
+
+	switch h.PasswordChange {
+	case PasswordModify, PasswordAD:
+	default:
+		return fmt.Errorf("unknown password change %q, expected %s or %s", h.PasswordChange, PasswordModify, PasswordAD)
+	}
+
+	if h.GroupNameAttribute == "" {
+		return errors.New("group name attribute must not be empty")
+	}
+
+	if h.GroupFilter != "" && h.NestedGroups {
+		return errors.New("group filter and nested groups are mutually exclusive")
+	}
+
+	var err error
+	if direct {
+		if h.bindTemplate, err = newBindTemplate(h.BindTemplate, "username", "principal", "domain"); err != nil {
+			return err
+		}
+
+		if !h.ReadEntry && (h.UserAttribute != "" || len(h.Attributes) > 0 || len(h.RequiredGroups) > 0 || h.GroupFilter != "" || h.NestedGroups || h.AccountState) {
+			return errors.New("user attribute, attributes, groups and account state need read entry in direct bind mode")
+		}
+
+		if (h.GroupFilter != "" || h.NestedGroups) && h.GroupBaseDN == "" && h.BaseDN == "" && !domains {
+			return errors.New("group filter and nested groups need a group base dn")
+		}
+	}
+
+	if h.filter, err = newTemplate(h.FilterDN, "principal", "username", "principal", "domain"); err != nil {
+		return err
+	}
+
+	if h.filter == nil {
+		return errors.New("filter dn must not be empty")
+	}
+
+	groupFilter := h.GroupFilter
+	if h.NestedGroups {
+		groupFilter = "(&(objectClass=group)(member:" + matchingRuleInChain + ":={dn}))"
+	}
+
+	if h.groupFilter, err = newTemplate(groupFilter, "dn", "dn", "username", "principal", "domain"); err != nil {
+		return err
+	}
+
+	if len(h.RequiredGroups) > 0 && h.GroupAttribute == "" && h.GroupFilter == "" && !h.NestedGroups {
+		return errors.New("required groups needs a group attribute, group filter or nested groups to resolve groups with")
+	}
+
+	h.requiredDNs = make([]*ldp.DN, len(h.RequiredGroups))
+	for i, required := range h.RequiredGroups {
+		if !strings.Contains(required, "=") {
+			continue
+		}
+		if h.requiredDNs[i], err = ldp.ParseDN(required); err != nil {
+			return fmt.Errorf("required group %q: %v", required, err)
+		}
+	}
+
+	if h.GroupBaseDN == "" {
+		h.GroupBaseDN = h.BaseDN
+	}
+
+	tlsConfig, err := h.TLSClient.ConfigSkipVerify(h.InsecureSkipVerify)
+	if err != nil {
+		return fmt.Errorf("tls client: %v", err)
+	}
+	h.tlsConfig = tlsConfig
+
+	if domains {
+		return h.validateDomains()
+	}
+
+	if h.DefaultDomain != "" || len(h.GlobalCatalog) > 0 || h.IdentityFormat != "" {
+		return errors.New("default domain, global catalog and identity format need domains")
+	}
+
+	return h.validateServers()
+}
+
+// Provision sets up the servers, and those of each domain, checking one of
+// them can be used. Validate only checks the configuration, as it may be
+// called any number of times while the configuration is loaded.
+func (h *LDAP) Provision(caddy.Context) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	// Anything provisioned before is replaced
+	h.Cleanup()
+
+	if len(h.Domains) > 0 {
+		return h.provisionDomains()
+	}
+
+	return h.connect()
+}
+
+// connect sets up the servers and checks one of them can be used
+func (h *LDAP) connect() error {
+	if err := h.newServers(); err != nil {
+		return err
+	}
 
 	c, err := h.getConnection()
 	if err != nil {
@@ -122,112 +370,220 @@ func (h *LDAP) Validate() error {
 
 // Authenticate fulfils the backend interface
 func (h *LDAP) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *LDAP) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
 	un, pw, k := r.BasicAuth()
-	if !k {
-		return "", nil
+	if !k || un == "" || pw == "" {
+		// An empty password would be an unauthenticated bind, which many
+		// servers allow.
+		return nil, nil
 	}
 
+	if len(h.Domains) > 0 {
+		return h.authenticateDomain(un, pw)
+	}
+
+	return h.authenticate(un, pw)
+}
+
+// authenticate finds and binds as the user in the directory
+func (h *LDAP) authenticate(un, pw string) (*backends.Identity, error) {
+	values := h.filterValues(un)
+
 	c, err := h.getConnection()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer h.stashConnection(c)
 
+	if h.bindTemplate != nil {
+		return h.authenticateDirect(c, pw, values)
+	}
+
 	// Search for the given username
+	filter := h.filter.expand(values)
 	searchRequest := ldp.NewSearchRequest(
 		h.BaseDN,
 		ldp.ScopeWholeSubtree, ldp.NeverDerefAliases, 0, int(h.Timeout.Duration/time.Second), false,
-		fmt.Sprintf(h.FilterDN, un+h.PrincipalSuffix),
-		[]string{"dn"},
+		filter,
+		h.userAttributes(),
 		nil,
 	)
 
 	sr, err := c.Search(searchRequest)
 	if err != nil {
-		return "", fmt.Errorf("search under %q for %q: %v", h.BaseDN, fmt.Sprintf(h.FilterDN, un+h.PrincipalSuffix), err)
+		return nil, fmt.Errorf("search under %q for %q: %v", h.BaseDN, filter, err)
 	}
 
 	if len(sr.Entries) == 0 {
-		return "", nil
+		return nil, nil
 	}
 
 	if len(sr.Entries) > 1 {
-		return "", errors.New("too many entries returned")
+		return nil, errors.New("too many entries returned")
 	}
 
-	userDN := sr.Entries[0].DN
+	entry := sr.Entries[0]
+	userDN := entry.DN
 
-	// Bind as the user to verify their password
-	err = c.Bind(userDN, pw)
+	// Groups are resolved while still bound as the service account
+	groups, err := h.groups(c, entry, values)
 	if err != nil {
-		if ldp.IsErrorWithCode(err, ldp.LDAPResultInvalidCredentials) {
-			return "", nil
-		}
-		return "", fmt.Errorf("bind with %q: %v", userDN, err)
+		return nil, err
 	}
 
-	return userDN, nil
+	// Bind as the user to verify their password, on another connection so
+	// this one stays bound as the service account
+	uc, err := h.getUserConnection(c.server)
+	if err != nil {
+		return nil, err
+	}
+	defer h.stashConnection(uc)
+
+	if err := uc.Bind(userDN, pw); err != nil {
+		return nil, bindFailed(userDN, err)
+	}
+
+	return h.identity(c, entry, groups, values)
 }
 
-func (h *LDAP) getConnection() (ldp.Client, error) {
-	var c ldp.Client
-	select {
-	case c = <-h.pool:
-		if err := c.Bind(h.BindDN, h.BindPassword); err == nil {
-			return c, nil
-		}
-		c.Close()
-	default:
+// filterValues returns the values for the filter placeholders
+func (h *LDAP) filterValues(un string) map[string]string {
+	values := map[string]string{
+		"username":  un,
+		"principal": un + h.PrincipalSuffix,
 	}
 
-	host, port, _ := net.SplitHostPort(h.URL.Host)
+	if i := strings.LastIndex(values["principal"], "@"); i >= 0 {
+		values["domain"] = values["principal"][i+1:]
+	} else if h.domain != nil {
+		values["domain"] = h.domain.DNSName
+	}
+
+	return values
+}
 
-	ldaps := port == "636" || port == "3269" || h.URL.Scheme == "ldaps"
-	if h.URL.Scheme == "ldap" {
-		ldaps = false
+func (h *LDAP) userAttributes() []string {
+	attributes := []string{"dn"}
+	if h.GroupAttribute != "" {
+		attributes = append(attributes, h.GroupAttribute)
+	}
+	if h.UserAttribute != "" {
+		attributes = append(attributes, h.UserAttribute)
+	}
+	for attribute := range h.Attributes {
+		attributes = append(attributes, attribute)
+	}
+	if h.AccountState {
+		attributes = append(attributes, accountStateAttributes()...)
+	}
+	if h.domain != nil {
+		attributes = append(attributes, "sAMAccountName")
 	}
-	if port == "" || port == "0" {
-		port = "389"
-		if ldaps {
-			port = "636"
+	return attributes
+}
+
+// identity builds the identity of the user from their entry, refusing them
+// if they're not in the required groups.
+func (h *LDAP) identity(c ldp.Client, entry *ldp.Entry, groups []group, values map[string]string) (*backends.Identity, error) {
+	if h.AccountState {
+		if err := h.readComputedState(c, entry); err != nil {
+			return nil, err
+		}
+		if rejection := accountState(entry, time.Now()); rejection != nil {
+			return nil, rejection
 		}
 	}
 
-	hostPort := fmt.Sprintf("%s:%s", host, port)
+	if !h.allowedGroups(groups) {
+		return nil, nil
+	}
 
-	var err error
-	if ldaps {
-		c, err = ldp.DialTLS("tcp", hostPort, &tls.Config{InsecureSkipVerify: h.InsecureSkipVerify})
-	} else {
-		c, err = ldp.Dial("tcp", hostPort)
+	identity := &backends.Identity{
+		ID:       entry.DN,
+		Metadata: map[string]string{"dn": entry.DN},
 	}
 
-	if err != nil {
-		return nil, fmt.Errorf("connect to %q: %v", hostPort, err)
+	if h.UserAttribute != "" {
+		identity.ID = entry.GetAttributeValue(h.UserAttribute)
+		if identity.ID == "" {
+			return nil, fmt.Errorf("entry %q has no %s attribute to identify the user by", entry.DN, h.UserAttribute)
+		}
 	}
 
-	// Technically it's not impossible to run tls over ssl... just excessive
-	if h.TLS {
-		if err = c.StartTLS(&tls.Config{InsecureSkipVerify: h.InsecureSkipVerify}); err != nil {
-			c.Close()
-			return nil, fmt.Errorf("StartTLS: %v", err)
+	for attribute, key := range h.Attributes {
+		if key == "" {
+			key = metadataKey(attribute)
+		}
+		if values := entry.GetAttributeValues(attribute); len(values) > 0 {
+			identity.Metadata[key] = strings.Join(values, ",")
 		}
 	}
 
-	if err := c.Bind(h.BindDN, h.BindPassword); err != nil {
-		c.Close()
-		return nil, fmt.Errorf("bind with %q: %v", h.BindDN, err)
+	if len(groups) > 0 {
+		identity.Metadata["groups"] = groupNames(groups)
 	}
 
-	return c, nil
+	if h.domain != nil {
+		account := entry.GetAttributeValue("sAMAccountName")
+		if account == "" {
+			account = values["username"]
+		}
+		h.normalise(identity, account)
+	}
+
+	return identity, nil
 }
 
-func (h *LDAP) stashConnection(c ldp.Client) {
-	select {
-	case h.pool <- c:
-		return
-	default:
-		c.Close()
-		return
+// metadataKey converts a camel cased attribute name into a snake cased
+// metadata key, displayName becomes display_name.
+func metadataKey(attribute string) string {
+	var b strings.Builder
+	prevUpper := true
+	for _, r := range attribute {
+		switch {
+		case unicode.IsUpper(r):
+			if !prevUpper {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			prevUpper = true
+			continue
+		case r == '-':
+			r = '_'
+		}
+		b.WriteRune(r)
+		prevUpper = false
+	}
+	return b.String()
+}
+
+// bind binds the connection as the service account, or leaves it unbound in
+// direct bind mode
+func (h *LDAP) bind(c *conn) error {
+	switch {
+	case h.bindTemplate != nil:
+		return nil
+	case h.BindMethod != BindSimple:
+		return h.saslBind(c)
+	}
+	return c.Bind(h.BindDN, h.BindPassword)
+}
+
+// tlsConfigFor returns the tls configuration with the server name defaulting
+// to the host, which StartTLS needs to verify the certificate.
+func (h *LDAP) tlsConfigFor(host string) *tls.Config {
+	cfg := h.tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
 	}
+	return cfg
 }
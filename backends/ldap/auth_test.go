@@ -0,0 +1,424 @@
+package ldap
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+const (
+	testBaseDN    = "dc=example,dc=com"
+	testServiceDN = "cn=reauth,ou=services,dc=example,dc=com"
+	testAliceDN   = "cn=alice,ou=people,dc=example,dc=com"
+	testBobDN     = "cn=bob,ou=people,dc=example,dc=com"
+)
+
+func testDirectory() []*testEntry {
+	return []*testEntry{
+		{DN: testServiceDN, Password: "service"},
+		{
+			DN:       testAliceDN,
+			Password: "alice-password",
+			Attributes: map[string][]string{
+				"objectClass":       {"user"},
+				"sAMAccountName":    {"alice"},
+				"uid":               {"alice"},
+				"userPrincipalName": {"alice@example.com"},
+				"mail":              {"alice@example.com"},
+				"displayName":       {"Alice Example"},
+				"memberOf":          {"cn=developers,ou=groups,dc=example,dc=com"},
+			},
+		},
+		{
+			DN:       testBobDN,
+			Password: "bob-password",
+			Attributes: map[string][]string{
+				"objectClass":    {"user"},
+				"sAMAccountName": {"bob"},
+				"uid":            {"bob"},
+			},
+		},
+		{
+			DN: "cn=developers,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass": {"group"},
+				"cn":          {"developers"},
+				"member":      {testAliceDN},
+			},
+		},
+		{
+			DN: "cn=staff,ou=groups,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"objectClass": {"group"},
+				"cn":          {"staff"},
+				"member":      {"cn=developers,ou=groups,dc=example,dc=com", testBobDN},
+			},
+		},
+	}
+}
+
+func testDriver(t *testing.T, s *testServer) *LDAP {
+	h := NewDriver()
+	h.URL = &jsontypes.URL{}
+	if err := h.URL.Unmarshal(s.URL()); err != nil {
+		t.Fatal(err)
+	}
+	h.BaseDN = testBaseDN
+	h.BindDN = testServiceDN
+	h.BindPassword = "service"
+
+	return h
+}
+
+func provision(t *testing.T, h *LDAP) {
+	if err := h.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Cleanup() })
+}
+
+func authenticate(t *testing.T, h *LDAP, un, pw string) string {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth(un, pw)
+
+	identity, err := h.AuthenticateIdentity(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity == nil {
+		return ""
+	}
+
+	return identity.ID
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	provision(t, h)
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Errorf("expected alice to authenticate, got %q", id)
+	}
+
+	if id := authenticate(t, h, "alice", "wrong"); id != "" {
+		t.Errorf("expected a wrong password to fail, got %q", id)
+	}
+
+	if id := authenticate(t, h, "alice", ""); id != "" {
+		t.Errorf("expected an empty password to fail, got %q", id)
+	}
+}
+
+func TestHostileUsernames(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	provision(t, h)
+
+	for _, un := range []string{
+		"*",
+		"*)(objectClass=*",
+		"alice)(|(sAMAccountName=*",
+		"al*",
+		"alice\x00",
+		`alice\2a`,
+		"*)(&",
+	} {
+		if id := authenticate(t, h, un, "alice-password"); id != "" {
+			t.Errorf("expected %q not to authenticate, got %q", un, id)
+		}
+	}
+
+	for _, filter := range s.Filters() {
+		if filter == "(&(objectClass=user)(sAMAccountName=*))" || strings.Count(filter, "(") != 3 {
+			t.Errorf("username changed the structure of the filter: %s", filter)
+		}
+	}
+}
+
+func TestFilterPlaceholders(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	h.FilterDN = "(|(uid={username})(mail={principal}))"
+	h.PrincipalSuffix = "@example.com"
+	provision(t, h)
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Errorf("expected alice to authenticate, got %q", id)
+	}
+
+	filters := s.Filters()
+	if expected := "(|(uid=alice)(mail=alice@example.com))"; filters[len(filters)-1] != expected {
+		t.Errorf("expected filter %s, got %s", expected, filters[len(filters)-1])
+	}
+}
+
+func TestFilterTemplateValidation(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+
+	for _, filter := range []string{
+		"(sAMAccountName={user})",
+		"(sAMAccountName=alice)",
+		"(sAMAccountName={username}",
+		"(sAMAccountName=%s)(uid=%s)",
+		"(sAMAccountName=%d)",
+	} {
+		h := NewDriver()
+		h.URL = &jsontypes.URL{}
+		h.URL.Unmarshal(s.URL())
+		h.BaseDN, h.BindDN, h.BindPassword = testBaseDN, testServiceDN, "service"
+		h.FilterDN = filter
+
+		if err := h.Validate(); err == nil {
+			t.Errorf("expected %q to be rejected", filter)
+		}
+	}
+
+	// Older configuration with a %s still works
+	h := testDriver(t, s)
+	h.FilterDN = "(&(objectClass=user)(uid=%s))"
+	provision(t, h)
+
+	if id := authenticate(t, h, "bob", "bob-password"); id != testBobDN {
+		t.Errorf("expected bob to authenticate, got %q", id)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+
+	tests := []struct {
+		name     string
+		filter   string
+		nested   bool
+		required []string
+		user     string
+		password string
+		groups   string
+		ok       bool
+	}{
+		{name: "member of", user: "alice", password: "alice-password", groups: "developers", ok: true},
+		{
+			name:   "group filter",
+			filter: "(&(objectClass=group)(member={dn}))",
+			user:   "bob", password: "bob-password", groups: "staff", ok: true,
+		},
+		{
+			name:   "nested",
+			nested: true,
+			user:   "alice", password: "alice-password", groups: "developers,staff", ok: true,
+		},
+		{
+			name:     "required",
+			required: []string{"developers"},
+			user:     "alice", password: "alice-password", groups: "developers", ok: true,
+		},
+		{
+			name:     "required by dn",
+			required: []string{"CN=Developers,OU=Groups,DC=example,DC=com"},
+			user:     "alice", password: "alice-password", groups: "developers", ok: true,
+		},
+		{
+			name:     "required by dn with spaces",
+			required: []string{"CN=Developers, OU=Groups, DC=example, DC=com"},
+			user:     "alice", password: "alice-password", groups: "developers", ok: true,
+		},
+		{
+			name:     "required by dn elsewhere",
+			required: []string{"cn=developers,ou=contractors,dc=example,dc=com"},
+			user:     "alice", password: "alice-password",
+		},
+		{
+			name:     "not required",
+			required: []string{"developers"},
+			user:     "bob", password: "bob-password",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := testDriver(t, s)
+			h.GroupFilter = test.filter
+			h.NestedGroups = test.nested
+			h.RequiredGroups = test.required
+			provision(t, h)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(test.user, test.password)
+
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.ok {
+				if identity != nil {
+					t.Fatalf("expected to be refused, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil {
+				t.Fatal("expected to authenticate")
+			}
+
+			if identity.Metadata["groups"] != test.groups {
+				t.Errorf("expected groups %q, got %q", test.groups, identity.Metadata["groups"])
+			}
+		})
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	h.UserAttribute = "uid"
+	h.Attributes = map[string]string{"displayName": "", "mail": "email", "employeeID": ""}
+	provision(t, h)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("alice", "alice-password")
+
+	identity, err := h.AuthenticateIdentity(r)
+	if err != nil || identity == nil {
+		t.Fatalf("expected to authenticate, got %+v, %v", identity, err)
+	}
+
+	if identity.ID != "alice" {
+		t.Errorf("expected id alice, got %q", identity.ID)
+	}
+
+	for k, v := range map[string]string{"display_name": "Alice Example", "email": "alice@example.com", "dn": testAliceDN} {
+		if identity.Metadata[k] != v {
+			t.Errorf("expected metadata %s=%q, got %q", k, v, identity.Metadata[k])
+		}
+	}
+
+	if _, found := identity.Metadata["employee_id"]; found {
+		t.Error("expected missing attributes to be left out")
+	}
+}
+
+func TestMetadataKey(t *testing.T) {
+	for attribute, expected := range map[string]string{
+		"mail":        "mail",
+		"displayName": "display_name",
+		"employeeID":  "employee_id",
+		"given-name":  "given_name",
+	} {
+		if got := metadataKey(attribute); got != expected {
+			t.Errorf("metadataKey(%q) = %q, expected %q", attribute, got, expected)
+		}
+	}
+}
+
+func TestDirectBind(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+
+	tests := []struct {
+		name      string
+		template  string
+		filter    string
+		readEntry bool
+		user      string
+		id        string
+		groups    string
+	}{
+		{
+			name:     "dn",
+			template: "cn={username},ou=people,dc=example,dc=com",
+			user:     "alice",
+			id:       testAliceDN,
+		},
+		{
+			name:     "upn",
+			template: "{username}@example.com",
+			user:     "alice",
+			id:       "alice@example.com",
+		},
+		{
+			name:      "dn read entry",
+			template:  "cn={username},ou=people,dc=example,dc=com",
+			readEntry: true,
+			user:      "alice",
+			id:        "alice",
+			groups:    "developers",
+		},
+		{
+			name:      "upn read entry",
+			template:  "{username}@example.com",
+			filter:    "(userPrincipalName={username}@example.com)",
+			readEntry: true,
+			user:      "alice",
+			id:        "alice",
+			groups:    "developers",
+		},
+		{
+			name:     "escaped dn",
+			template: "cn={username},ou=people,dc=example,dc=com",
+			user:     "alice,ou=people",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := testDriver(t, s)
+			h.BindDN, h.BindPassword = "", ""
+			h.BindTemplate = test.template
+			if test.filter != "" {
+				h.FilterDN = test.filter
+			}
+			if test.readEntry {
+				h.ReadEntry, h.UserAttribute = true, "uid"
+			}
+			provision(t, h)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(test.user, "alice-password")
+
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.id == "" {
+				if identity != nil {
+					t.Fatalf("expected to be refused, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil || identity.ID != test.id {
+				t.Fatalf("expected to authenticate as %q, got %+v", test.id, identity)
+			}
+
+			if identity.Metadata["groups"] != test.groups {
+				t.Errorf("expected groups %q, got %q", test.groups, identity.Metadata["groups"])
+			}
+		})
+	}
+
+	for _, bind := range s.Binds() {
+		if bind == testServiceDN {
+			t.Error("expected direct bind mode not to bind as the service account")
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	for value, expected := range map[string]string{
+		"alice":           "alice",
+		"alice,ou=people": `alice\,ou\=people`,
+		" alice ":         `\ alice\ `,
+		"#alice":          `\#alice`,
+		"a+b<c>;\"d\\":    `a\+b\<c\>\;\"d\\`,
+	} {
+		if got := escapeDN(value); got != expected {
+			t.Errorf("escapeDN(%q) = %q, expected %q", value, got, expected)
+		}
+	}
+}
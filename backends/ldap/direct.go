@@ -0,0 +1,99 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/freman/caddy2-reauth/backends"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// authenticateDirect binds as the user with the name from the BindTemplate
+// and, with ReadEntry, reads their entry as themselves.
+func (h *LDAP) authenticateDirect(c ldp.Client, pw string, values map[string]string) (*backends.Identity, error) {
+	name := h.bindTemplate.expand(values)
+
+	if err := c.Bind(name, pw); err != nil {
+		return nil, bindFailed(name, err)
+	}
+
+	if !h.ReadEntry {
+		identity := &backends.Identity{ID: name, Metadata: map[string]string{}}
+		if h.bindTemplate.isDN() {
+			identity.Metadata["dn"] = name
+		}
+		if h.domain != nil {
+			h.normalise(identity, values["username"])
+		}
+		return identity, nil
+	}
+
+	entry, err := h.ownEntry(c, name, values)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	groups, err := h.groups(c, entry, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.identity(c, entry, groups, values)
+}
+
+// ownEntry reads the entry of the user bound as name, either directly by
+// its DN or by searching for the principal name.
+func (h *LDAP) ownEntry(c ldp.Client, name string, values map[string]string) (*ldp.Entry, error) {
+	base, scope, filter := name, ldp.ScopeBaseObject, "(objectClass=*)"
+	if !h.bindTemplate.isDN() {
+		base, scope, filter = h.BaseDN, ldp.ScopeWholeSubtree, h.filter.expand(values)
+	}
+
+	searchRequest := ldp.NewSearchRequest(
+		base,
+		scope, ldp.NeverDerefAliases, 0, int(h.Timeout.Duration/time.Second), false,
+		filter,
+		h.userAttributes(),
+		nil,
+	)
+
+	sr, err := c.Search(searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("read entry of %q: %v", name, err)
+	}
+
+	switch len(sr.Entries) {
+	case 0:
+		// The user could bind but can't see themselves
+		return nil, fmt.Errorf("entry of %q is not readable by the user", name)
+	case 1:
+		return sr.Entries[0], nil
+	}
+
+	return nil, fmt.Errorf("too many entries returned for %q", name)
+}
@@ -0,0 +1,382 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// Formats of the identity of users in a multi-domain forest
+const (
+	IdentityUPN     = "upn"
+	IdentityNetBIOS = "netbios"
+)
+
+const defaultGlobalCatalogFilter = "(&(objectClass=user)(|(sAMAccountName={username})(userPrincipalName={username})))"
+
+// Domain is one of the domains of an Active Directory forest.
+//
+// Users name the domain by its NetBIOS Name, CORP\alice, or by its DNSName
+// or one of the UPNSuffixes, alice@corp.example.com. The Name defaults to
+// the first label of the DNSName and the BaseDN to the DNSName as DC
+// components. Without URLs the domain's servers are found by looking up
+// the SRV records of the SRVDomain, which defaults to the DNSName. The
+// service account defaults to that of the backend.
+type Domain struct {
+	Name         string           `json:"name,omitempty"`
+	DNSName      string           `json:"dns_name,omitempty"`
+	UPNSuffixes  []string         `json:"upn_suffixes,omitempty"`
+	BaseDN       string           `json:"base_dn,omitempty"`
+	URLs         []*jsontypes.URL `json:"urls,omitempty"`
+	SRVDomain    string           `json:"srv_domain,omitempty"`
+	BindDN       string           `json:"bind_dn,omitempty"`
+	BindPassword string           `json:"bind_password,omitempty"`
+
+	driver *LDAP
+	dn     *ldp.DN
+}
+
+// validateDomains checks the domains, filling in their defaults
+func (h *LDAP) validateDomains() error {
+	if h.URL != nil || len(h.URLs) > 0 || h.SRVDomain != "" || h.BaseDN != "" {
+		return errors.New("url, urls, srv domain and base dn are configured per domain with domains")
+	}
+
+	if h.PrincipalSuffix != "" {
+		return errors.New("principal suffix can't be used with domains")
+	}
+
+	switch h.IdentityFormat {
+	case "", IdentityUPN, IdentityNetBIOS:
+	default:
+		return fmt.Errorf("unknown identity format %q, expected %s or %s", h.IdentityFormat, IdentityUPN, IdentityNetBIOS)
+	}
+
+	if err := h.validateServers(); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for i, d := range h.Domains {
+		if d == nil || d.DNSName == "" {
+			return fmt.Errorf("domains[%d]: missing dns name", i)
+		}
+
+		d.DNSName = strings.TrimSuffix(d.DNSName, ".")
+		if d.Name == "" {
+			d.Name = strings.ToUpper(strings.SplitN(d.DNSName, ".", 2)[0])
+		}
+
+		for _, name := range append([]string{d.Name, d.DNSName}, d.UPNSuffixes...) {
+			if seen[strings.ToLower(name)] {
+				return fmt.Errorf("domains[%d]: %q names more than one domain", i, name)
+			}
+			seen[strings.ToLower(name)] = true
+		}
+
+		if err := h.validateDomain(d); err != nil {
+			return fmt.Errorf("domains[%d] (%s): %v", i, d.Name, err)
+		}
+	}
+
+	if h.DefaultDomain != "" && h.domainByName(h.DefaultDomain) == nil {
+		return fmt.Errorf("default domain %q is not one of the domains", h.DefaultDomain)
+	}
+
+	if len(h.GlobalCatalog) == 0 {
+		return nil
+	}
+
+	// The global catalog is searched with the top level service account as
+	// it belongs to no one domain
+	if h.bindTemplate != nil || (h.BindMethod != BindExternal && (h.BindDN == "" || h.BindPassword == "")) {
+		return errors.New("global catalog needs a bind dn and bind password to search with")
+	}
+
+	for _, u := range h.GlobalCatalog {
+		if u == nil || u.URL == nil {
+			return errors.New("global catalog urls must not be empty")
+		}
+	}
+
+	var err error
+	if h.globalCatalogFilter, err = newTemplate(h.GlobalCatalogFilter, "username", "username"); err != nil {
+		return fmt.Errorf("global catalog filter: %v", err)
+	}
+
+	return nil
+}
+
+func (h *LDAP) validateDomain(d *Domain) error {
+	if d.BaseDN == "" {
+		d.BaseDN = "DC=" + strings.Join(strings.Split(d.DNSName, "."), ",DC=")
+	}
+
+	var err error
+	if d.dn, err = ldp.ParseDN(d.BaseDN); err != nil {
+		return fmt.Errorf("base dn: %v", err)
+	}
+
+	for _, u := range d.URLs {
+		if u == nil || u.URL == nil {
+			return errors.New("urls must not be empty")
+		}
+	}
+
+	bindDN, bindPassword := h.BindDN, h.BindPassword
+	if d.BindDN != "" {
+		bindDN, bindPassword = d.BindDN, d.BindPassword
+	}
+
+	if h.bindTemplate == nil && h.BindMethod != BindExternal && (bindDN == "" || bindPassword == "") {
+		return errors.New("missing bind dn and bind password")
+	}
+
+	return nil
+}
+
+// provisionDomains sets up a driver for each of the domains, a copy of the
+// backend with the domain's servers, base and service account, and one for
+// the global catalog.
+func (h *LDAP) provisionDomains() error {
+	for i, d := range h.Domains {
+		dh := h.clone()
+		dh.domain = d
+		dh.BaseDN = d.BaseDN
+		dh.URLs = d.URLs
+		dh.SRVDomain = d.SRVDomain
+		if len(d.URLs) == 0 && d.SRVDomain == "" {
+			dh.SRVDomain = d.DNSName
+		}
+
+		if d.BindDN != "" {
+			dh.BindDN, dh.BindPassword = d.BindDN, d.BindPassword
+		}
+
+		if dh.GroupBaseDN == "" {
+			dh.GroupBaseDN = d.BaseDN
+		}
+
+		// Set before connecting so Cleanup finds it either way
+		d.driver = dh
+
+		if err := dh.connect(); err != nil {
+			return fmt.Errorf("domains[%d] (%s): %v", i, d.Name, err)
+		}
+	}
+
+	if len(h.GlobalCatalog) == 0 {
+		return nil
+	}
+
+	h.globalCatalog = h.clone()
+	h.globalCatalog.URLs = h.GlobalCatalog
+	h.globalCatalog.catalog = true
+
+	if err := h.globalCatalog.connect(); err != nil {
+		return fmt.Errorf("global catalog: %v", err)
+	}
+
+	return nil
+}
+
+// clone copies the backend's configuration without its servers or domains
+func (h *LDAP) clone() *LDAP {
+	c := *h
+	c.Domains = nil
+	c.GlobalCatalog = nil
+	c.servers = nil
+	c.globalCatalog = nil
+	return &c
+}
+
+// domainByName finds the domain by its NetBIOS or DNS name
+func (h *LDAP) domainByName(name string) *Domain {
+	for _, d := range h.Domains {
+		if strings.EqualFold(d.Name, name) || strings.EqualFold(d.DNSName, name) {
+			return d
+		}
+	}
+	return nil
+}
+
+// domainBySuffix finds the domain by the suffix of a user principal name
+func (h *LDAP) domainBySuffix(suffix string) *Domain {
+	for _, d := range h.Domains {
+		if strings.EqualFold(d.DNSName, suffix) {
+			return d
+		}
+		for _, s := range d.UPNSuffixes {
+			if strings.EqualFold(s, suffix) {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// domainOfDN finds the domain an entry belongs to, the one with the
+// longest base DN if they're nested.
+func (h *LDAP) domainOfDN(dn string) *Domain {
+	parsed, err := ldp.ParseDN(dn)
+	if err != nil {
+		return nil
+	}
+
+	var found *Domain
+	for _, d := range h.Domains {
+		if underDN(d.dn, parsed) && (found == nil || len(d.dn.RDNs) > len(found.dn.RDNs)) {
+			found = d
+		}
+	}
+	return found
+}
+
+// underDN reports whether dn is below base, ignoring case as AD does
+func underDN(base, dn *ldp.DN) bool {
+	return len(dn.RDNs) > len(base.RDNs) && endsWithDN(dn, base)
+}
+
+// sameDN reports whether the DNs are the same
+func sameDN(a, b *ldp.DN) bool {
+	return len(a.RDNs) == len(b.RDNs) && endsWithDN(a, b)
+}
+
+// endsWithDN reports whether the last RDNs of dn are those of suffix
+func endsWithDN(dn, suffix *ldp.DN) bool {
+	offset := len(dn.RDNs) - len(suffix.RDNs)
+	if offset < 0 {
+		return false
+	}
+
+	for i, rdn := range suffix.RDNs {
+		other := dn.RDNs[offset+i]
+		if len(rdn.Attributes) != len(other.Attributes) {
+			return false
+		}
+		for j, attr := range rdn.Attributes {
+			if !strings.EqualFold(attr.Type, other.Attributes[j].Type) || !strings.EqualFold(attr.Value, other.Attributes[j].Value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// route finds the domain of the user and their account name within it.
+// DOMAIN\user names the domain, user@domain does unless the global catalog
+// is there to find the user by their principal name, which may not be their
+// account name. Bare names are found in the global catalog or else belong
+// to the DefaultDomain.
+func (h *LDAP) route(un string) (*Domain, string, error) {
+	if i := strings.Index(un, `\`); i >= 0 {
+		return h.domainByName(un[:i]), un[i+1:], nil
+	}
+
+	if h.globalCatalog != nil {
+		return h.lookupGlobalCatalog(un)
+	}
+
+	if i := strings.LastIndex(un, "@"); i >= 0 {
+		return h.domainBySuffix(un[i+1:]), un[:i], nil
+	}
+
+	if h.DefaultDomain == "" {
+		return nil, "", nil
+	}
+
+	return h.domainByName(h.DefaultDomain), un, nil
+}
+
+// lookupGlobalCatalog searches the whole forest for the user to find their
+// home domain and account name.
+func (h *LDAP) lookupGlobalCatalog(un string) (*Domain, string, error) {
+	c, err := h.globalCatalog.getConnection()
+	if err != nil {
+		return nil, "", err
+	}
+	defer h.globalCatalog.stashConnection(c)
+
+	filter := h.globalCatalogFilter.expand(map[string]string{"username": un})
+	sr, err := c.Search(ldp.NewSearchRequest(
+		"",
+		ldp.ScopeWholeSubtree, ldp.NeverDerefAliases, 0, int(h.Timeout.Duration/time.Second), false,
+		filter,
+		[]string{"dn", "sAMAccountName"},
+		nil,
+	))
+	if err != nil {
+		return nil, "", fmt.Errorf("global catalog search for %q: %v", filter, err)
+	}
+
+	switch len(sr.Entries) {
+	case 0:
+		return nil, "", nil
+	case 1:
+	default:
+		return nil, "", fmt.Errorf("%q matches users in more than one domain", un)
+	}
+
+	entry := sr.Entries[0]
+
+	d := h.domainOfDN(entry.DN)
+	if d == nil {
+		return nil, "", fmt.Errorf("%q is not in any of the domains", entry.DN)
+	}
+
+	return d, entry.GetAttributeValue("sAMAccountName"), nil
+}
+
+// authenticateDomain authenticates the user against their home domain
+func (h *LDAP) authenticateDomain(un, pw string) (*backends.Identity, error) {
+	d, account, err := h.route(un)
+	if err != nil || d == nil || account == "" {
+		return nil, err
+	}
+
+	return d.driver.authenticate(account, pw)
+}
+
+// normalise identifies the user the same way whichever way they named
+// themselves, by their account name in the IdentityFormat.
+func (h *LDAP) normalise(identity *backends.Identity, account string) {
+	identity.Metadata["domain"] = h.domain.Name
+
+	switch h.IdentityFormat {
+	case IdentityUPN:
+		identity.ID = account + "@" + strings.ToLower(h.domain.DNSName)
+	case IdentityNetBIOS:
+		identity.ID = strings.ToUpper(h.domain.Name) + `\` + account
+	}
+}
@@ -0,0 +1,247 @@
+package ldap
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+const (
+	testCorpBaseDN = "dc=corp,dc=example,dc=com"
+	testDevBaseDN  = "dc=dev,dc=corp,dc=example,dc=com"
+	testCarolDN    = "cn=carol,ou=people,dc=corp,dc=example,dc=com"
+	testDaveDN     = "cn=dave,ou=people,dc=dev,dc=corp,dc=example,dc=com"
+)
+
+func testForest() (corp, dev []*testEntry) {
+	corp = []*testEntry{
+		{DN: "cn=reauth,ou=services,dc=corp,dc=example,dc=com", Password: "service"},
+		{
+			DN:       testCarolDN,
+			Password: "carol-password",
+			Attributes: map[string][]string{
+				"objectClass":       {"user"},
+				"sAMAccountName":    {"Carol"},
+				"userPrincipalName": {"carol.smith@example.com"},
+			},
+		},
+	}
+
+	dev = []*testEntry{
+		{DN: "cn=reauth,ou=services,dc=dev,dc=corp,dc=example,dc=com", Password: "dev-service"},
+		{
+			DN:       testDaveDN,
+			Password: "dave-password",
+			Attributes: map[string][]string{
+				"objectClass":       {"user"},
+				"sAMAccountName":    {"dave"},
+				"userPrincipalName": {"dave@dev.corp.example.com"},
+			},
+		},
+	}
+
+	return corp, dev
+}
+
+// testForestDriver returns a driver for the corp and dev domains, and the
+// url of a global catalog holding both
+func testForestDriver(t *testing.T) (*LDAP, *jsontypes.URL) {
+	corp, dev := testForest()
+	corpServer := newTestServer(t, corp...)
+	devServer := newTestServer(t, dev...)
+	gcServer := newTestServer(t, append(corp, dev...)...)
+
+	h := NewDriver()
+	h.BindDN = "cn=reauth,ou=services,dc=corp,dc=example,dc=com"
+	h.BindPassword = "service"
+	h.Domains = []*Domain{
+		{DNSName: "corp.example.com", BaseDN: testCorpBaseDN, URLs: []*jsontypes.URL{testURL(t, corpServer.URL())}, UPNSuffixes: []string{"example.com"}},
+		{
+			Name:         "DEVELOPMENT",
+			DNSName:      "dev.corp.example.com",
+			URLs:         []*jsontypes.URL{testURL(t, devServer.URL())},
+			BindDN:       "cn=reauth,ou=services,dc=dev,dc=corp,dc=example,dc=com",
+			BindPassword: "dev-service",
+		},
+	}
+
+	return h, testURL(t, gcServer.URL())
+}
+
+func TestDomains(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultDomain string
+		format        string
+		catalog       bool
+		user          string
+		password      string
+		id            string
+		domain        string
+	}{
+		{name: "netbios", user: `CORP\carol`, password: "carol-password", id: testCarolDN, domain: "CORP"},
+		{name: "netbios lower case", user: `development\dave`, password: "dave-password", id: testDaveDN, domain: "DEVELOPMENT"},
+		{name: "dns name", user: `dev.corp.example.com\dave`, password: "dave-password", id: testDaveDN, domain: "DEVELOPMENT"},
+		{name: "upn", user: "dave@dev.corp.example.com", password: "dave-password", id: testDaveDN, domain: "DEVELOPMENT"},
+		{name: "wrong domain", user: `CORP\dave`, password: "dave-password"},
+		{name: "unknown domain", user: `OTHER\carol`, password: "carol-password"},
+		{name: "wrong password", user: `CORP\carol`, password: "dave-password"},
+		{name: "empty account", user: `CORP\`, password: "carol-password"},
+		{name: "bare", user: "carol", password: "carol-password"},
+		{
+			name:          "default domain",
+			defaultDomain: "corp",
+			user:          "carol", password: "carol-password", id: testCarolDN, domain: "CORP",
+		},
+		{
+			name:   "upn format",
+			format: IdentityUPN,
+			user:   `CORP\CAROL`, password: "carol-password", id: "Carol@corp.example.com", domain: "CORP",
+		},
+		{
+			name:   "netbios format",
+			format: IdentityNetBIOS,
+			user:   "dave@dev.corp.example.com", password: "dave-password", id: `DEVELOPMENT\dave`, domain: "DEVELOPMENT",
+		},
+		{
+			name:    "global catalog bare",
+			catalog: true,
+			user:    "dave", password: "dave-password", id: testDaveDN, domain: "DEVELOPMENT",
+		},
+		{
+			name:    "global catalog upn",
+			catalog: true,
+			format:  IdentityNetBIOS,
+			user:    "carol.smith@example.com", password: "carol-password", id: `CORP\Carol`, domain: "CORP",
+		},
+		{
+			name:    "global catalog unknown",
+			catalog: true,
+			user:    "mallory", password: "mallory-password",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, gc := testForestDriver(t)
+			h.DefaultDomain = test.defaultDomain
+			if test.format != "" {
+				h.IdentityFormat = test.format
+			}
+			if test.catalog {
+				h.GlobalCatalog = []*jsontypes.URL{gc}
+			}
+			provision(t, h)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(test.user, test.password)
+
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.id == "" {
+				if identity != nil {
+					t.Fatalf("expected to be refused, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil || identity.ID != test.id {
+				t.Fatalf("expected to authenticate as %q, got %+v", test.id, identity)
+			}
+
+			if identity.Metadata["domain"] != test.domain {
+				t.Errorf("expected domain %q, got %q", test.domain, identity.Metadata["domain"])
+			}
+		})
+	}
+}
+
+func TestDomainsValidation(t *testing.T) {
+	corp, _ := testForest()
+	s := newTestServer(t, corp...)
+
+	tests := []struct {
+		name      string
+		configure func(h *LDAP)
+	}{
+		{name: "url", configure: func(h *LDAP) { h.URL = h.Domains[0].URLs[0] }},
+		{name: "base dn", configure: func(h *LDAP) { h.BaseDN = testCorpBaseDN }},
+		{name: "principal suffix", configure: func(h *LDAP) { h.PrincipalSuffix = "@example.com" }},
+		{name: "dns name", configure: func(h *LDAP) { h.Domains[0].DNSName = "" }},
+		{name: "duplicate", configure: func(h *LDAP) { h.Domains[1].Name = "corp" }},
+		{name: "default domain", configure: func(h *LDAP) { h.DefaultDomain = "other" }},
+		{name: "identity format", configure: func(h *LDAP) { h.IdentityFormat = "email" }},
+		{name: "service account", configure: func(h *LDAP) { h.BindDN, h.BindPassword = "", "" }},
+		{
+			name: "global catalog service account",
+			configure: func(h *LDAP) {
+				for _, d := range h.Domains {
+					d.BindDN, d.BindPassword = h.BindDN, h.BindPassword
+				}
+				h.BindDN, h.BindPassword = "", ""
+				h.GlobalCatalog = []*jsontypes.URL{testURL(t, s.URL())}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.BindDN = "cn=reauth,ou=services,dc=corp,dc=example,dc=com"
+			h.BindPassword = "service"
+			h.Domains = []*Domain{
+				{DNSName: "corp.example.com", URLs: []*jsontypes.URL{testURL(t, s.URL())}},
+				{DNSName: "dev.corp.example.com", URLs: []*jsontypes.URL{testURL(t, s.URL())}},
+			}
+			test.configure(h)
+
+			if err := h.Validate(); err == nil {
+				t.Error("expected validation to fail")
+			}
+		})
+	}
+
+	h := NewDriver()
+	h.IdentityFormat = IdentityUPN
+	h.URL, h.BaseDN, h.BindDN, h.BindPassword = testURL(t, s.URL()), testCorpBaseDN, "cn=reauth,ou=services,dc=corp,dc=example,dc=com", "service"
+	if err := h.Validate(); err == nil {
+		t.Error("expected an identity format without domains to fail validation")
+	}
+}
+
+func TestDomainOfDN(t *testing.T) {
+	h, _ := testForestDriver(t)
+	provision(t, h)
+
+	for dn, expected := range map[string]string{
+		testCarolDN: "CORP",
+		testDaveDN:  "DEVELOPMENT",
+		"CN=Dave,OU=People,DC=Dev,DC=Corp,DC=Example,DC=Com": "DEVELOPMENT",
+		"cn=eve,dc=example,dc=com":                           "",
+	} {
+		var name string
+		if d := h.domainOfDN(dn); d != nil {
+			name = d.Name
+		}
+		if name != expected {
+			t.Errorf("domainOfDN(%q) = %q, expected %q", dn, name, expected)
+		}
+	}
+}
+
+func TestDomainsChangePassword(t *testing.T) {
+	h, _ := testForestDriver(t)
+	provision(t, h)
+
+	if err := h.ChangePassword(`DEVELOPMENT\dave`, "dave-password", "new-dave-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if id := authenticate(t, h, "dave@dev.corp.example.com", "new-dave-password"); id != testDaveDN {
+		t.Errorf("expected dave to authenticate with the new password, got %q", id)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// placeholder matches the named placeholders of a filter template
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// template is a search filter or DN with named placeholders, the values of
+// which are escaped per RFC 4515 or RFC 4514 respectively when it is expanded.
+type template struct {
+	raw    string
+	names  map[string]bool
+	escape func(string) string
+}
+
+// newTemplate parses the filter template, only the given placeholders are
+// allowed. A single %s from older configuration is taken to mean legacy.
+func newTemplate(raw string, legacy string, allowed ...string) (*template, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	if strings.Contains(raw, "%s") {
+		if strings.Count(raw, "%s") != 1 || strings.Contains(strings.Replace(raw, "%s", "", 1), "%") {
+			return nil, fmt.Errorf("filter %q may contain only one %%s, use named placeholders instead", raw)
+		}
+		raw = strings.Replace(raw, "%s", "{"+legacy+"}", 1)
+	}
+
+	t, err := parseTemplate("filter", raw, ldp.EscapeFilter, allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	// The expanded filter must be valid whatever the values are, as they are
+	// escaped checking it with a dummy value is enough.
+	if _, err := ldp.CompileFilter(t.expand(t.dummy())); err != nil {
+		return nil, fmt.Errorf("filter %q is invalid: %v", raw, err)
+	}
+
+	return t, nil
+}
+
+// newBindTemplate parses the template of the name to bind as, which is
+// either a DN, the values of which are escaped, or a user principal name.
+func newBindTemplate(raw string, allowed ...string) (*template, error) {
+	escape := func(s string) string { return s }
+	if strings.Contains(raw, "=") {
+		escape = escapeDN
+	}
+
+	t, err := parseTemplate("bind template", raw, escape, allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.isDN() {
+		if _, err := ldp.ParseDN(t.expand(t.dummy())); err != nil {
+			return nil, fmt.Errorf("bind template %q is not a valid dn: %v", raw, err)
+		}
+	} else if !strings.Contains(raw, "@") {
+		return nil, fmt.Errorf("bind template %q must be a dn or a user principal name", raw)
+	}
+
+	return t, nil
+}
+
+func parseTemplate(kind, raw string, escape func(string) string, allowed []string) (*template, error) {
+	t := &template{raw: raw, names: map[string]bool{}, escape: escape}
+
+	valid := map[string]bool{}
+	for _, name := range allowed {
+		valid[name] = true
+	}
+
+	for _, match := range placeholder.FindAllStringSubmatch(raw, -1) {
+		if !valid[match[1]] {
+			return nil, fmt.Errorf("%s %q has unknown placeholder {%s}, expected one of {%s}", kind, raw, match[1], strings.Join(allowed, "}, {"))
+		}
+		t.names[match[1]] = true
+	}
+
+	if len(t.names) == 0 {
+		return nil, fmt.Errorf("%s %q has no placeholders", kind, raw)
+	}
+
+	return t, nil
+}
+
+// dummy returns a value for every placeholder in the template
+func (t *template) dummy() map[string]string {
+	values := map[string]string{}
+	for name := range t.names {
+		values[name] = "x"
+	}
+	return values
+}
+
+// isDN reports whether the template is a DN rather than a user principal name
+func (t *template) isDN() bool {
+	return strings.Contains(t.raw, "=")
+}
+
+// uses reports whether the template contains the named placeholder
+func (t *template) uses(name string) bool {
+	return t.names[name]
+}
+
+// expand replaces the placeholders with their escaped values
+func (t *template) expand(values map[string]string) string {
+	return placeholder.ReplaceAllStringFunc(t.raw, func(match string) string {
+		return t.escape(values[match[1:len(match)-1]])
+	})
+}
+
+func (t *template) String() string {
+	return t.raw
+}
+
+// escapeDN escapes an attribute value for use in a DN per RFC 4514
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
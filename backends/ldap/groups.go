@@ -0,0 +1,154 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// matchingRuleInChain is AD's LDAP_MATCHING_RULE_IN_CHAIN which walks nested
+// group membership on the server
+const matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// group is a resolved group, known by both its DN and its name
+type group struct {
+	DN   string
+	Name string
+}
+
+// groups resolves the groups of the user entry, de-duplicated by DN
+func (h *LDAP) groups(c ldp.Client, entry *ldp.Entry, values map[string]string) ([]group, error) {
+	seen := map[string]bool{}
+	var groups []group
+
+	add := func(g group) {
+		key := strings.ToLower(g.DN)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		groups = append(groups, g)
+	}
+
+	if h.GroupAttribute != "" {
+		for _, dn := range entry.GetAttributeValues(h.GroupAttribute) {
+			add(group{DN: dn, Name: h.nameFromDN(dn)})
+		}
+	}
+
+	if h.groupFilter == nil {
+		return groups, nil
+	}
+
+	values["dn"] = entry.DN
+	filter := h.groupFilter.expand(values)
+
+	searchRequest := ldp.NewSearchRequest(
+		h.GroupBaseDN,
+		ldp.ScopeWholeSubtree, ldp.NeverDerefAliases, 0, int(h.Timeout.Duration/time.Second), false,
+		filter,
+		[]string{"dn", h.GroupNameAttribute},
+		nil,
+	)
+
+	sr, err := c.Search(searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("group search under %q for %q: %v", h.GroupBaseDN, filter, err)
+	}
+
+	for _, e := range sr.Entries {
+		name := e.GetAttributeValue(h.GroupNameAttribute)
+		if name == "" {
+			name = h.nameFromDN(e.DN)
+		}
+		add(group{DN: e.DN, Name: name})
+	}
+
+	return groups, nil
+}
+
+// nameFromDN returns the value of GroupNameAttribute from the first RDN of
+// the DN, or the DN itself if that isn't how the group is named.
+func (h *LDAP) nameFromDN(dn string) string {
+	parsed, err := ldp.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return dn
+	}
+
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, h.GroupNameAttribute) {
+			return attr.Value
+		}
+	}
+
+	return dn
+}
+
+// allowedGroups reports whether any of the groups is one of the
+// RequiredGroups, those given as a DN are only matched by DN.
+func (h *LDAP) allowedGroups(groups []group) bool {
+	if len(h.RequiredGroups) == 0 {
+		return true
+	}
+
+	for _, g := range groups {
+		var dn *ldp.DN
+		for i, required := range h.RequiredGroups {
+			if h.requiredDNs[i] == nil {
+				if strings.EqualFold(required, g.Name) {
+					return true
+				}
+				continue
+			}
+
+			if dn == nil {
+				var err error
+				if dn, err = ldp.ParseDN(g.DN); err != nil {
+					break
+				}
+			}
+
+			if sameDN(h.requiredDNs[i], dn) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func groupNames(groups []group) string {
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = g.Name
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,242 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// csrfCookie holds the token the form must be submitted with
+const csrfCookie = "reauth_password_csrf"
+
+const defaultPasswordTitle = "Change password"
+
+// randReader is the source of CSRF tokens
+var randReader io.Reader = rand.Reader
+
+// PasswordHandler serves a form for users to change their password with,
+// backed by the LDAP backend's configuration. It only accepts requests
+// over TLS and protects the form with a double submit CSRF token, also
+// refusing submissions from other origins.
+//
+// Once changed the user is sent to the SuccessURL if there is one.
+type PasswordHandler struct {
+	LDAP       *LDAP
+	Title      string
+	SuccessURL string
+}
+
+type passwordPage struct {
+	Title    string
+	Username string
+	CSRF     string
+	Message  string
+	Error    string
+	Done     bool
+}
+
+var passwordTemplate = htmltemplate.Must(htmltemplate.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+{{if not .Done}}<form method="post" autocomplete="off">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p><label>Username <input type="text" name="username" value="{{.Username}}" required autofocus></label></p>
+<p><label>Current password <input type="password" name="old_password" required></label></p>
+<p><label>New password <input type="password" name="new_password" required></label></p>
+<p><label>Confirm new password <input type="password" name="confirm_password" required></label></p>
+<p><button type="submit">Change password</button></p>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// Handle serves the form and changes passwords, errors returned are those
+// the user was only told were unexpected.
+func (p *PasswordHandler) Handle(w http.ResponseWriter, r *http.Request) error {
+	page := &passwordPage{Title: p.Title}
+	if page.Title == "" {
+		page.Title = defaultPasswordTitle
+	}
+
+	if r.TLS == nil {
+		page.Error = "Passwords may only be changed over a secure connection."
+		page.Done = true
+		return p.render(w, http.StatusForbidden, page)
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		token, err := p.csrfToken(w, r)
+		if err != nil {
+			return p.unexpected(w, page, err)
+		}
+		page.CSRF = token
+		return p.render(w, http.StatusOK, page)
+	case http.MethodPost:
+		return p.change(w, r, page)
+	}
+
+	w.Header().Set("Allow", "GET, HEAD, POST")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return nil
+}
+
+func (p *PasswordHandler) change(w http.ResponseWriter, r *http.Request, page *passwordPage) error {
+	if !sameOrigin(r) || !validCSRF(r) {
+		token, err := p.csrfToken(w, r)
+		if err != nil {
+			return p.unexpected(w, page, err)
+		}
+		page.Error = "Your session has expired, please try again."
+		page.CSRF = token
+		return p.render(w, http.StatusForbidden, page)
+	}
+
+	page.CSRF = r.PostFormValue("csrf")
+	page.Username = r.PostFormValue("username")
+
+	oldPassword := r.PostFormValue("old_password")
+	newPassword := r.PostFormValue("new_password")
+
+	switch {
+	case page.Username == "" || oldPassword == "" || newPassword == "":
+		page.Error = "All fields are required."
+	case newPassword != r.PostFormValue("confirm_password"):
+		page.Error = "The new passwords do not match."
+	case newPassword == oldPassword:
+		page.Error = "The new password must be different from the current password."
+	}
+
+	if page.Error != "" {
+		return p.render(w, http.StatusBadRequest, page)
+	}
+
+	err := p.LDAP.ChangePassword(page.Username, oldPassword, newPassword)
+
+	var policy *PolicyError
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrInvalidCredentials):
+		page.Error = "The username or current password is incorrect."
+		return p.render(w, http.StatusForbidden, page)
+	case errors.As(err, &policy):
+		page.Error = "The new password was refused: " + policy.Message
+		return p.render(w, http.StatusBadRequest, page)
+	default:
+		return p.unexpected(w, page, err)
+	}
+
+	if p.SuccessURL != "" {
+		http.Redirect(w, r, p.SuccessURL, http.StatusSeeOther)
+		return nil
+	}
+
+	page.Message = "Your password has been changed."
+	page.Done = true
+	return p.render(w, http.StatusOK, page)
+}
+
+// unexpected tells the user something went wrong and returns the error
+func (p *PasswordHandler) unexpected(w http.ResponseWriter, page *passwordPage, err error) error {
+	page.Error = "Your password could not be changed, please try again later."
+	if rerr := p.render(w, http.StatusInternalServerError, page); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (p *PasswordHandler) render(w http.ResponseWriter, code int, page *passwordPage) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(code)
+	return passwordTemplate.Execute(w, page)
+}
+
+// csrfToken returns the token from the cookie, setting a new one if needed
+func (p *PasswordHandler) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == base64.RawURLEncoding.EncodedLen(32) {
+		return c.Value, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", fmt.Errorf("generate csrf token: %v", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     r.URL.Path,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return token, nil
+}
+
+func validCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostFormValue("csrf"))) == 1
+}
+
+// sameOrigin checks the Origin, or failing that Referer, header of the
+// submission matches the host it was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+
+	if origin == "" {
+		// Older clients send neither, the token has to do
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
@@ -0,0 +1,201 @@
+package ldap
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func passwordForm(t *testing.T, p *PasswordHandler) *http.Cookie {
+	r := httptest.NewRequest("GET", "https://example.com/password", nil)
+	w := httptest.NewRecorder()
+
+	if err := p.Handle(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the form, got %d", w.Code)
+	}
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookie {
+			if !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+				t.Errorf("expected a secure, http only, strict cookie, got %+v", c)
+			}
+			if !strings.Contains(w.Body.String(), c.Value) {
+				t.Error("expected the token in the form")
+			}
+			return c
+		}
+	}
+
+	t.Fatal("expected a csrf cookie")
+	return nil
+}
+
+func TestPasswordHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		form    url.Values
+		token   string
+		origin  string
+		plain   bool
+		code    int
+		message string
+	}{
+		{
+			name: "changed",
+			form: url.Values{"username": {"alice"}, "old_password": {"alice-password"}, "new_password": {"new-alice-password"}, "confirm_password": {"new-alice-password"}},
+			code: http.StatusOK, message: "has been changed",
+		},
+		{
+			name: "wrong password",
+			form: url.Values{"username": {"alice"}, "old_password": {"wrong"}, "new_password": {"new-alice-password"}, "confirm_password": {"new-alice-password"}},
+			code: http.StatusForbidden, message: "incorrect",
+		},
+		{
+			name: "policy",
+			form: url.Values{"username": {"alice"}, "old_password": {"alice-password"}, "new_password": {"short"}, "confirm_password": {"short"}},
+			code: http.StatusBadRequest, message: "quality checking policy",
+		},
+		{
+			name: "mismatch",
+			form: url.Values{"username": {"alice"}, "old_password": {"alice-password"}, "new_password": {"new-alice-password"}, "confirm_password": {"other"}},
+			code: http.StatusBadRequest, message: "do not match",
+		},
+		{
+			name:  "bad token",
+			form:  url.Values{"username": {"alice"}, "old_password": {"alice-password"}, "new_password": {"new-alice-password"}, "confirm_password": {"new-alice-password"}},
+			token: "forged",
+			code:  http.StatusForbidden, message: "expired",
+		},
+		{
+			name:   "cross origin",
+			form:   url.Values{"username": {"alice"}, "old_password": {"alice-password"}, "new_password": {"new-alice-password"}, "confirm_password": {"new-alice-password"}},
+			origin: "https://evil.example.net",
+			code:   http.StatusForbidden, message: "expired",
+		},
+		{
+			name:  "plain text",
+			form:  url.Values{"username": {"alice"}, "old_password": {"alice-password"}, "new_password": {"new-alice-password"}, "confirm_password": {"new-alice-password"}},
+			plain: true,
+			code:  http.StatusForbidden, message: "secure connection",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, testDirectory()...)
+			h := testDriver(t, s)
+			provision(t, h)
+
+			p := &PasswordHandler{LDAP: h}
+			cookie := passwordForm(t, p)
+
+			form := url.Values{"csrf": {cookie.Value}}
+			if test.token != "" {
+				form.Set("csrf", test.token)
+			}
+			for k, v := range test.form {
+				form[k] = v
+			}
+
+			r := httptest.NewRequest("POST", "https://example.com/password", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Origin", "https://example.com")
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if test.plain {
+				r.TLS = nil
+			}
+			r.AddCookie(cookie)
+
+			w := httptest.NewRecorder()
+			if err := p.Handle(w, r); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != test.code {
+				t.Errorf("expected status %d, got %d", test.code, w.Code)
+			}
+
+			if !strings.Contains(w.Body.String(), test.message) {
+				t.Errorf("expected %q in the page, got %s", test.message, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPasswordHandlerSuccessURL(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	provision(t, h)
+
+	p := &PasswordHandler{LDAP: h, SuccessURL: "https://example.com/done"}
+	cookie := passwordForm(t, p)
+
+	form := url.Values{
+		"csrf":             {cookie.Value},
+		"username":         {"bob"},
+		"old_password":     {"bob-password"},
+		"new_password":     {"new-bob-password"},
+		"confirm_password": {"new-bob-password"},
+	}
+
+	r := httptest.NewRequest("POST", "https://example.com/password", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.TLS = &tls.ConnectionState{}
+	r.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	if err := p.Handle(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != p.SuccessURL {
+		t.Errorf("expected a redirect to %s, got %d %s", p.SuccessURL, w.Code, w.Header().Get("Location"))
+	}
+}
+
+// failingReader fails every read
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestPasswordHandlerRandFailure(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	provision(t, h)
+
+	randReader = failingReader{}
+	defer func() { randReader = rand.Reader }()
+
+	p := &PasswordHandler{LDAP: h}
+
+	for _, method := range []string{"GET", "POST"} {
+		r := httptest.NewRequest(method, "https://example.com/password", nil)
+		r.Header.Set("Origin", "https://example.com")
+
+		w := httptest.NewRecorder()
+		if err := p.Handle(w, r); err == nil {
+			t.Errorf("%s: expected the error to be returned", method)
+		}
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected status 500, got %d", method, w.Code)
+		}
+
+		if cookies := w.Result().Cookies(); len(cookies) != 0 {
+			t.Errorf("%s: expected no csrf cookie, got %v", method, cookies)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// Ways of changing passwords
+const (
+	PasswordModify = "password_modify"
+	PasswordAD     = "ad"
+)
+
+// ErrInvalidCredentials is returned when changing the password of a user
+// that doesn't exist or with the wrong current password.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// PolicyError is returned when the server refuses the new password, the
+// message is the server's explanation.
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return "password refused: " + e.Message
+}
+
+// AD's error codes in the diagnostic message of a refused password change
+const (
+	adWrongPassword = "00000056"
+	adPolicy        = "0000052d"
+)
+
+// CanChangePasswords reports why ChangePassword can't work with the validated
+// configuration, a bind template must give the user's DN to modify.
+func (h *LDAP) CanChangePasswords() error {
+	if h.bindTemplate != nil && !h.bindTemplate.isDN() {
+		return errors.New("changing passwords needs a dn bind template")
+	}
+	return nil
+}
+
+// ChangePassword changes the password of the user from old to new.
+//
+// With the Password Modify extended operation (RFC 3062) this is done while
+// bound as the user. AD's unicodePwd is changed by deleting the old value and
+// adding the new, which AD permits anyone who knows the old password to do,
+// so the service account is used to allow expired passwords to be changed.
+func (h *LDAP) ChangePassword(username, oldPassword, newPassword string) error {
+	if username == "" || oldPassword == "" || newPassword == "" {
+		return ErrInvalidCredentials
+	}
+
+	if len(h.Domains) > 0 {
+		d, account, err := h.route(username)
+		if err != nil {
+			return err
+		}
+		if d == nil || account == "" {
+			return ErrInvalidCredentials
+		}
+		return d.driver.ChangePassword(account, oldPassword, newPassword)
+	}
+
+	values := h.filterValues(username)
+
+	c, err := h.getConnection()
+	if err != nil {
+		return err
+	}
+	defer h.stashConnection(c)
+
+	userDN, err := h.passwordUserDN(c, values)
+	if err != nil {
+		return err
+	}
+
+	if h.PasswordChange == PasswordAD && h.bindTemplate == nil {
+		return h.changeAD(c, userDN, oldPassword, newPassword)
+	}
+
+	uc := c
+	if h.bindTemplate == nil {
+		if uc, err = h.getUserConnection(c.server); err != nil {
+			return err
+		}
+		defer h.stashConnection(uc)
+	}
+
+	if err := uc.Bind(userDN, oldPassword); err != nil {
+		if bindRejection(err) == nil && ldp.IsErrorWithCode(err, ldp.LDAPResultInvalidCredentials) {
+			return ErrInvalidCredentials
+		}
+		return fmt.Errorf("bind with %q: %v", userDN, err)
+	}
+
+	if h.PasswordChange == PasswordAD {
+		return h.changeAD(uc, userDN, oldPassword, newPassword)
+	}
+
+	_, err = uc.PasswordModify(ldp.NewPasswordModifyRequest("", oldPassword, newPassword))
+	return passwordError(err)
+}
+
+// passwordUserDN finds the DN of the user whose password is being changed
+func (h *LDAP) passwordUserDN(c *conn, values map[string]string) (string, error) {
+	if h.bindTemplate != nil {
+		if !h.bindTemplate.isDN() {
+			return "", errors.New("changing passwords needs a dn bind template")
+		}
+		return h.bindTemplate.expand(values), nil
+	}
+
+	filter := h.filter.expand(values)
+	sr, err := c.Search(ldp.NewSearchRequest(
+		h.BaseDN,
+		ldp.ScopeWholeSubtree, ldp.NeverDerefAliases, 0, int(h.Timeout.Duration/time.Second), false,
+		filter,
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return "", fmt.Errorf("search under %q for %q: %v", h.BaseDN, filter, err)
+	}
+
+	switch len(sr.Entries) {
+	case 0:
+		return "", ErrInvalidCredentials
+	case 1:
+		return sr.Entries[0].DN, nil
+	}
+
+	return "", errors.New("too many entries returned")
+}
+
+func (h *LDAP) changeAD(c ldp.Client, userDN, oldPassword, newPassword string) error {
+	req := ldp.NewModifyRequest(userDN, nil)
+	req.Delete("unicodePwd", []string{unicodePwd(oldPassword)})
+	req.Add("unicodePwd", []string{unicodePwd(newPassword)})
+
+	return passwordError(c.Modify(req))
+}
+
+// passwordError sorts the server's refusal into wrong passwords and policy
+// violations.
+func passwordError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var lerr *ldp.Error
+	if !errors.As(err, &lerr) {
+		return err
+	}
+
+	message := ""
+	if lerr.Err != nil {
+		message = lerr.Err.Error()
+	}
+
+	switch lerr.ResultCode {
+	case ldp.LDAPResultInvalidCredentials:
+		return ErrInvalidCredentials
+	case ldp.LDAPResultConstraintViolation, ldp.LDAPResultUnwillingToPerform:
+		if strings.HasPrefix(strings.ToLower(message), adWrongPassword) {
+			return ErrInvalidCredentials
+		}
+		if strings.HasPrefix(strings.ToLower(message), adPolicy) {
+			message = "the new password does not meet the length, complexity or history requirements"
+		}
+		return &PolicyError{Message: message}
+	}
+
+	return err
+}
+
+// unicodePwd encodes the password as AD expects, quoted and UTF-16LE
+func unicodePwd(password string) string {
+	encoded := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, len(encoded)*2)
+	for i, r := range encoded {
+		b[i*2] = byte(r)
+		b[i*2+1] = byte(r >> 8)
+	}
+	return string(b)
+}
@@ -0,0 +1,129 @@
+package ldap
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		template string
+		old      string
+		new      string
+		err      error
+		policy   bool
+	}{
+		{name: "password modify", old: "alice-password", new: "new-alice-password"},
+		{name: "password modify wrong", old: "wrong", new: "new-alice-password", err: ErrInvalidCredentials},
+		{name: "password modify policy", old: "alice-password", new: "short", policy: true},
+		{
+			name: "ad",
+			mode: PasswordAD,
+			old:  "alice-password", new: "new-alice-password",
+		},
+		{
+			name: "ad wrong",
+			mode: PasswordAD,
+			old:  "wrong", new: "new-alice-password", err: ErrInvalidCredentials,
+		},
+		{
+			name: "ad policy",
+			mode: PasswordAD,
+			old:  "alice-password", new: "short", policy: true,
+		},
+		{
+			name:     "direct",
+			template: "cn={username},ou=people,dc=example,dc=com",
+			old:      "alice-password", new: "new-alice-password",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, testDirectory()...)
+			h := testDriver(t, s)
+			if test.mode != "" {
+				h.PasswordChange = test.mode
+			}
+			if test.template != "" {
+				h.BindDN, h.BindPassword = "", ""
+				h.BindTemplate = test.template
+			}
+			provision(t, h)
+
+			err := h.ChangePassword("alice", test.old, test.new)
+
+			var policy *PolicyError
+			switch {
+			case test.policy:
+				if !errors.As(err, &policy) || policy.Message == "" {
+					t.Fatalf("expected a policy error, got %v", err)
+				}
+				return
+			case test.err != nil:
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			if id := authenticate(t, h, "alice", test.new); id == "" {
+				t.Error("expected alice to authenticate with the new password")
+			}
+
+			if id := authenticate(t, h, "alice", test.old); id != "" {
+				t.Error("expected the old password to stop working")
+			}
+		})
+	}
+}
+
+func TestCanChangePasswords(t *testing.T) {
+	tests := []struct {
+		name         string
+		bindTemplate string
+		ok           bool
+	}{
+		{name: "search", ok: true},
+		{name: "dn template", bindTemplate: "cn={username},ou=people,dc=example,dc=com", ok: true},
+		{name: "principal template", bindTemplate: "{username}@example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.URL = testURL(t, "ldap://127.0.0.1")
+			h.BaseDN = "dc=example,dc=com"
+			h.BindDN, h.BindPassword = "cn=reauth,dc=example,dc=com", "service"
+			h.BindTemplate = test.bindTemplate
+
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.CanChangePasswords(); test.ok != (err == nil) {
+				t.Errorf("expected ok to be %v, got %v", test.ok, err)
+			}
+		})
+	}
+}
+
+func TestChangePasswordUnknownUser(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	provision(t, h)
+
+	if err := h.ChangePassword("mallory", "password", "new-password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected %v, got %v", ErrInvalidCredentials, err)
+	}
+}
+
+func TestUnicodePwd(t *testing.T) {
+	if got, expected := unicodePwd("ab"), "\"\x00a\x00b\x00\"\x00"; got != expected {
+		t.Errorf("unicodePwd(ab) = %q, expected %q", got, expected)
+	}
+}
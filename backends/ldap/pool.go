@@ -0,0 +1,163 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"sync"
+	"time"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// conn is a connection to a server along with when it was made and last used
+type conn struct {
+	ldp.Client
+	server   *server
+	pool     *pool
+	created  time.Time
+	lastUsed time.Time
+}
+
+// closing reports whether the connection was closed, by a network error
+// for example.
+func (c *conn) closing() bool {
+	lc, ok := c.Client.(*ldp.Conn)
+	return ok && lc.IsClosing()
+}
+
+// pool holds the idle connections of a server, the most recently used are
+// handed out first so the rest can expire.
+type pool struct {
+	maxIdle     int
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+	timer  *time.Timer
+}
+
+func newPool(maxIdle int, idleTimeout, maxLifetime time.Duration) *pool {
+	return &pool{maxIdle: maxIdle, idleTimeout: idleTimeout, maxLifetime: maxLifetime}
+}
+
+// get returns an idle connection that hasn't expired, if there is one
+func (p *pool) get() *conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for n := len(p.idle); n > 0; n = len(p.idle) {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+
+		if p.expired(c, now) {
+			c.Close()
+			continue
+		}
+
+		return c
+	}
+
+	return nil
+}
+
+// put returns the connection to the pool, closing it if the pool is full,
+// closed or the connection has expired.
+func (p *pool) put(c *conn) {
+	c.lastUsed = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle) >= p.maxIdle || p.expired(c, c.lastUsed) || c.closing() {
+		c.Close()
+		return
+	}
+
+	p.idle = append(p.idle, c)
+
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.idleTimeout, p.prune)
+	}
+}
+
+func (p *pool) expired(c *conn, now time.Time) bool {
+	return now.Sub(c.lastUsed) >= p.idleTimeout || now.Sub(c.created) >= p.maxLifetime
+}
+
+// prune closes the connections that have expired while idle, it runs for as
+// long as there are idle connections.
+func (p *pool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if p.expired(c, now) {
+			c.Close()
+			continue
+		}
+		idle = append(idle, c)
+	}
+	p.idle = idle
+
+	if len(p.idle) == 0 || p.closed {
+		p.timer = nil
+		return
+	}
+
+	p.timer.Reset(p.idleTimeout)
+}
+
+// drain closes the idle connections, with close the connections still in
+// use are closed as they are returned.
+func (p *pool) drain(close bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+
+	if close {
+		p.closed = true
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// size returns the number of idle connections
+func (p *pool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
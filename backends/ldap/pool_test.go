@@ -0,0 +1,270 @@
+package ldap
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/jsontypes"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+type fakeClient struct {
+	ldp.Client
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (f *fakeClient) Close() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+}
+
+func (f *fakeClient) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func newFakeConn(p *pool, age time.Duration) (*conn, *fakeClient) {
+	f := &fakeClient{}
+	return &conn{Client: f, pool: p, created: time.Now().Add(-age)}, f
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	p := newPool(1, time.Minute, time.Hour)
+
+	a, fa := newFakeConn(p, 0)
+	b, fb := newFakeConn(p, 0)
+	p.put(a)
+	p.put(b)
+
+	if p.size() != 1 || fa.isClosed() || !fb.isClosed() {
+		t.Errorf("expected the overflowing connection to be closed")
+	}
+
+	if c := p.get(); c != a {
+		t.Errorf("expected the idle connection back, got %v", c)
+	}
+
+	p.drain(true)
+}
+
+func TestPoolMaxLifetime(t *testing.T) {
+	p := newPool(2, time.Minute, time.Hour)
+
+	old, fold := newFakeConn(p, 2*time.Hour)
+	p.put(old)
+
+	if !fold.isClosed() || p.size() != 0 {
+		t.Error("expected a connection past its lifetime to be closed rather than pooled")
+	}
+
+	young, _ := newFakeConn(p, 0)
+	p.put(young)
+	p.maxLifetime = time.Nanosecond
+
+	if c := p.get(); c != nil {
+		t.Errorf("expected an expired connection not to be handed out, got %v", c)
+	}
+
+	p.drain(true)
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	p := newPool(2, 20*time.Millisecond, time.Hour)
+
+	c, f := newFakeConn(p, 0)
+	p.put(c)
+
+	deadline := time.Now().Add(time.Second)
+	for p.size() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if p.size() != 0 || !f.isClosed() {
+		t.Error("expected the idle connection to be closed")
+	}
+}
+
+func TestPoolDrain(t *testing.T) {
+	p := newPool(2, time.Minute, time.Hour)
+
+	idle, fidle := newFakeConn(p, 0)
+	inUse, finUse := newFakeConn(p, 0)
+	p.put(idle)
+
+	p.drain(true)
+
+	if !fidle.isClosed() {
+		t.Error("expected idle connections to be closed")
+	}
+
+	p.put(inUse)
+	if !finUse.isClosed() || p.size() != 0 {
+		t.Error("expected connections returned after draining to be closed")
+	}
+}
+
+func TestCleanupDuringRequests(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	provision(t, h)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth("alice", "alice-password")
+			if _, err := h.AuthenticateIdentity(r); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	h.Cleanup()
+	wg.Wait()
+	close(errs)
+
+	// Requests in flight when the configuration is replaced still finish
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestServiceBindOnce(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	provision(t, h)
+
+	for i := 0; i < 3; i++ {
+		if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+			t.Fatalf("expected alice to authenticate, got %q", id)
+		}
+		if id := authenticate(t, h, "alice", "wrong"); id != "" {
+			t.Fatalf("expected a wrong password to fail, got %q", id)
+		}
+	}
+
+	if n := countBinds(s, testServiceDN); n != 1 {
+		t.Errorf("expected the service account to be bound once, got %d", n)
+	}
+
+	server := h.servers.static[0]
+	if server.search.size() != 1 || server.binds.size() != 1 {
+		t.Errorf("expected a connection in each pool, got %d and %d", server.search.size(), server.binds.size())
+	}
+
+	if err := h.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.search.size() != 0 || server.binds.size() != 0 {
+		t.Error("expected cleanup to drain the pools")
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	h := testDriver(t, s)
+	h.PingInterval = jsontypes.Duration{Duration: time.Nanosecond}
+	provision(t, h)
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Fatalf("expected alice to authenticate, got %q", id)
+	}
+
+	pinged := false
+	for _, f := range s.Filters() {
+		if f == "(objectClass=*)" {
+			pinged = true
+		}
+	}
+
+	if !pinged {
+		t.Error("expected the idle connection to be pinged before reuse")
+	}
+}
+
+func TestValidateHasNoSideEffects(t *testing.T) {
+	corp, dev := testForest()
+	tests := []struct {
+		name      string
+		servers   []*testServer
+		configure func(h *LDAP, servers []*testServer)
+	}{
+		{
+			name:    "single",
+			servers: []*testServer{newTestServer(t, testDirectory()...)},
+			configure: func(h *LDAP, servers []*testServer) {
+				h.URL = testURL(t, servers[0].URL())
+				h.BaseDN, h.BindDN, h.BindPassword = testBaseDN, testServiceDN, "service"
+			},
+		},
+		{
+			name:    "domains",
+			servers: []*testServer{newTestServer(t, corp...), newTestServer(t, dev...), newTestServer(t, append(corp, dev...)...)},
+			configure: func(h *LDAP, servers []*testServer) {
+				h.BindDN, h.BindPassword = "cn=reauth,ou=services,dc=corp,dc=example,dc=com", "service"
+				h.Domains = []*Domain{
+					{DNSName: "corp.example.com", URLs: []*jsontypes.URL{testURL(t, servers[0].URL())}},
+					{
+						DNSName:      "dev.corp.example.com",
+						URLs:         []*jsontypes.URL{testURL(t, servers[1].URL())},
+						BindDN:       "cn=reauth,ou=services,dc=dev,dc=corp,dc=example,dc=com",
+						BindPassword: "dev-service",
+					},
+				}
+				h.GlobalCatalog = []*jsontypes.URL{testURL(t, servers[2].URL())}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			test.configure(h, test.servers)
+
+			// As when the configuration is unmarshalled and then validated
+			for i := 0; i < 2; i++ {
+				if err := h.Validate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i, s := range test.servers {
+				if n := s.Open(); n != 0 || len(s.Binds()) != 0 {
+					t.Errorf("server %d: expected validation not to connect, got %d open and %d binds", i, n, len(s.Binds()))
+				}
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := h.Provision(caddy.Context{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := h.Cleanup(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, s := range test.servers {
+				if n := s.Open(); n != 0 {
+					t.Errorf("server %d: expected every connection to be closed, %d still open", i, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// Ways of binding as the service account
+const (
+	BindSimple    = "simple"
+	BindExternal  = "external"
+	BindDigestMD5 = "digest_md5"
+)
+
+// digestMD5Binder is implemented by connections that can bind with SASL
+// DIGEST-MD5, which isn't part of ldap.Client.
+type digestMD5Binder interface {
+	MD5Bind(host, username, password string) error
+}
+
+// tlsStater is implemented by connections that know whether they use TLS
+type tlsStater interface {
+	TLSConnectionState() (tls.ConnectionState, bool)
+}
+
+func tlsActive(c tlsStater) bool {
+	_, ok := c.TLSConnectionState()
+	return ok
+}
+
+// validateBindMethod checks the service account can bind with the BindMethod
+func (h *LDAP) validateBindMethod() error {
+	switch h.BindMethod {
+	case BindSimple, BindDigestMD5:
+	case BindExternal:
+		if h.TLSClient == nil || h.TLSClient.ClientCertFile == "" {
+			return errors.New("external binds need a tls client certificate")
+		}
+
+		if h.BindDN != "" || h.BindPassword != "" {
+			return errors.New("bind dn and bind password aren't used with external binds, the client certificate identifies the service account")
+		}
+	default:
+		return fmt.Errorf("unknown bind method %q, expected %s, %s or %s", h.BindMethod, BindSimple, BindExternal, BindDigestMD5)
+	}
+
+	if h.BindMethod != BindSimple && h.BindTemplate != "" {
+		return fmt.Errorf("%s binds are for the service account, which direct bind mode doesn't use", h.BindMethod)
+	}
+
+	return nil
+}
+
+// saslBind binds the connection as the service account with SASL EXTERNAL,
+// identified by the client certificate, or DIGEST-MD5.
+func (h *LDAP) saslBind(c *conn) error {
+	if h.BindMethod == BindDigestMD5 {
+		md5, ok := c.Client.(digestMD5Binder)
+		if !ok {
+			return errors.New("connection does not support digest-md5 binds")
+		}
+		return md5.MD5Bind(c.server.host, h.BindDN, h.BindPassword)
+	}
+
+	// Without TLS there's no certificate for the server to identify us by
+	if tc, ok := c.Client.(tlsStater); !ok || !tlsActive(tc) {
+		return errors.New("external binds need ldaps or tls")
+	}
+
+	return c.ExternalBind()
+}
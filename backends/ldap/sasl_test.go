@@ -0,0 +1,264 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// testPKI is a certificate authority with a server certificate for
+// 127.0.0.1 and a client certificate for the service account, written out
+// as files.
+type testPKI struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	pool       *x509.CertPool
+	serverCert tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "reauth-ldap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(caDER); err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage, ips ...net.IP) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return der, key
+	}
+
+	write := func(name, kind string, der []byte) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	serverDER, serverKey := issue(2, "127.0.0.1", x509.ExtKeyUsageServerAuth, net.ParseIP("127.0.0.1"))
+	clientDER, clientKey := issue(3, "reauth", x509.ExtKeyUsageClientAuth)
+
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPKI{
+		CAFile:     write("ca.pem", "CERTIFICATE", caDER),
+		CertFile:   write("client.pem", "CERTIFICATE", clientDER),
+		KeyFile:    write("client-key.pem", "EC PRIVATE KEY", clientKeyDER),
+		pool:       x509.NewCertPool(),
+		serverCert: tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey},
+	}
+	p.pool.AddCert(ca)
+
+	return p
+}
+
+// ServerConfig asks for, but doesn't require, a client certificate
+func (p *testPKI) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    p.pool,
+	}
+}
+
+// saslDirectory is the test directory with the service account named for
+// the client certificate and DIGEST-MD5
+func saslDirectory() []*testEntry {
+	entries := testDirectory()
+	entries[0].Attributes = map[string][]string{"cn": {"reauth"}}
+	return entries
+}
+
+func TestExternalBind(t *testing.T) {
+	pki := newTestPKI(t)
+	s := newTLSTestServer(t, pki.ServerConfig(), saslDirectory()...)
+
+	h := testDriver(t, s)
+	h.BindMethod = BindExternal
+	h.BindDN, h.BindPassword = "", ""
+	h.TLSClient = &jsontypes.TLSClient{
+		RootCAFiles:    []string{pki.CAFile},
+		ClientCertFile: pki.CertFile,
+		ClientKeyFile:  pki.KeyFile,
+	}
+	provision(t, h)
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Errorf("expected alice to authenticate, got %q", id)
+	}
+
+	if countBinds(s, "EXTERNAL") == 0 {
+		t.Error("expected the service account to bind with sasl external")
+	}
+
+	if countBinds(s, testServiceDN) != 0 {
+		t.Error("expected the service account not to bind with a password")
+	}
+}
+
+func TestExternalBindFailures(t *testing.T) {
+	pki := newTestPKI(t)
+	ldaps := newTLSTestServer(t, pki.ServerConfig(), saslDirectory()...)
+	plain := newTestServer(t, saslDirectory()...)
+
+	tests := []struct {
+		name   string
+		server *testServer
+		tls    *jsontypes.TLSClient
+	}{
+		{
+			name:   "without tls",
+			server: plain,
+			tls:    &jsontypes.TLSClient{ClientCertFile: pki.CertFile, ClientKeyFile: pki.KeyFile},
+		},
+		{
+			name:   "without certificate",
+			server: ldaps,
+			tls:    &jsontypes.TLSClient{RootCAFiles: []string{pki.CAFile}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.URL = testURL(t, test.server.URL())
+			h.BaseDN = testBaseDN
+			h.BindMethod = BindExternal
+			h.TLSClient = test.tls
+
+			defer h.Cleanup()
+
+			if err := h.Provision(caddy.Context{}); err == nil {
+				t.Error("expected provisioning to fail")
+			}
+		})
+	}
+}
+
+func TestDigestMD5Bind(t *testing.T) {
+	s := newTestServer(t, saslDirectory()...)
+
+	h := testDriver(t, s)
+	h.BindMethod = BindDigestMD5
+	h.BindDN = "reauth"
+	provision(t, h)
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Errorf("expected alice to authenticate, got %q", id)
+	}
+
+	if countBinds(s, "DIGEST-MD5") == 0 {
+		t.Error("expected the service account to bind with sasl digest-md5")
+	}
+
+	h = NewDriver()
+	h.URL = testURL(t, s.URL())
+	h.BaseDN = testBaseDN
+	h.BindMethod = BindDigestMD5
+	h.BindDN, h.BindPassword = "reauth", "wrong"
+
+	defer h.Cleanup()
+
+	if err := h.Provision(caddy.Context{}); err == nil {
+		t.Error("expected a wrong password to fail provisioning")
+	}
+}
+
+func TestBindMethodValidation(t *testing.T) {
+	s := newTestServer(t, saslDirectory()...)
+
+	tests := []struct {
+		name      string
+		configure func(h *LDAP)
+	}{
+		{name: "unknown", configure: func(h *LDAP) { h.BindMethod = "kerberos" }},
+		{name: "external without certificate", configure: func(h *LDAP) {
+			h.BindMethod = BindExternal
+			h.BindDN, h.BindPassword = "", ""
+		}},
+		{name: "external with password", configure: func(h *LDAP) {
+			h.BindMethod = BindExternal
+			h.TLSClient = &jsontypes.TLSClient{ClientCertFile: "client.pem", ClientKeyFile: "client-key.pem"}
+		}},
+		{name: "digest without password", configure: func(h *LDAP) {
+			h.BindMethod = BindDigestMD5
+			h.BindPassword = ""
+		}},
+		{name: "direct", configure: func(h *LDAP) {
+			h.BindMethod = BindDigestMD5
+			h.BindTemplate = "cn={username},ou=people,dc=example,dc=com"
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.URL = testURL(t, s.URL())
+			h.BaseDN, h.BindDN, h.BindPassword = testBaseDN, "reauth", "service"
+			test.configure(h)
+
+			if err := h.Validate(); err == nil {
+				t.Error("expected validation to fail")
+			}
+		})
+	}
+}
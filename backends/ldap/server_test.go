@@ -0,0 +1,609 @@
+package ldap
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// testEntry is an entry in the directory of the test server
+type testEntry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+
+	// BindError is the diagnostic message of binds that fail with invalid
+	// credentials even with the right password, as AD does.
+	BindError string
+
+	// mu guards the password once it can be changed
+	mu sync.Mutex
+}
+
+// testServer is an in-process stand-in for an LDAP server supporting just
+// enough of the protocol for the backend: simple and SASL binds, searches
+// and password changes.
+type testServer struct {
+	t     *testing.T
+	ln    net.Listener
+	ldaps bool
+
+	mu      sync.Mutex
+	entries []*testEntry
+	filters []string
+	binds   []string
+	conns   map[net.Conn]bool
+	wg      sync.WaitGroup
+}
+
+func newTestServer(t *testing.T, entries ...*testEntry) *testServer {
+	return newTLSTestServer(t, nil, entries...)
+}
+
+// newTLSTestServer starts a test server speaking ldaps with the config, or
+// plain ldap without one.
+func newTLSTestServer(t *testing.T, config *tls.Config, entries ...*testEntry) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+
+	s := &testServer{t: t, ln: ln, ldaps: config != nil, entries: entries, conns: map[net.Conn]bool{}}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testServer) URL() string {
+	if s.ldaps {
+		return "ldaps://" + s.ln.Addr().String()
+	}
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *testServer) Close() {
+	s.ln.Close()
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Filters returns the search filters received so far
+func (s *testServer) Filters() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.filters...)
+}
+
+// Binds returns the DNs bound as so far
+func (s *testServer) Binds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.binds...)
+}
+
+// Open returns the number of connections the server has open, waiting a
+// little for clients that are closing theirs.
+func (s *testServer) Open() int {
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+
+		if n == 0 || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *testServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *testServer) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	var bound *testEntry
+
+	for {
+		packet, err := ber.ReadPacket(c)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldp.ApplicationBindRequest:
+			var response *ber.Packet
+			response, bound = s.bind(c, op)
+			responses = append(responses, response)
+		case ldp.ApplicationUnbindRequest:
+			return
+		case ldp.ApplicationSearchRequest:
+			responses = s.search(op)
+		case ldp.ApplicationExtendedRequest:
+			responses = append(responses, s.passwordModify(op, bound))
+		case ldp.ApplicationModifyRequest:
+			responses = append(responses, s.modify(op, bound))
+		default:
+			responses = append(responses, testResult(op.Tag+1, ldp.LDAPResultUnwillingToPerform, "unsupported operation"))
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			envelope.AppendChild(response)
+			if _, err := c.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *testServer) bind(c net.Conn, op *ber.Packet) (*ber.Packet, *testEntry) {
+	if op.Children[2].Tag == 3 {
+		return s.saslBind(c, op.Children[2])
+	}
+
+	dn := op.Children[1].Data.String()
+	password := op.Children[2].Data.String()
+
+	s.mu.Lock()
+	s.binds = append(s.binds, dn)
+	s.mu.Unlock()
+
+	e := s.entry(dn)
+	if e == nil {
+		e = s.principal(dn)
+	}
+
+	if e != nil && password != "" && e.password() == password {
+		if e.BindError != "" {
+			return testResult(ldp.ApplicationBindResponse, ldp.LDAPResultInvalidCredentials, e.BindError), nil
+		}
+		return testResult(ldp.ApplicationBindResponse, ldp.LDAPResultSuccess, ""), e
+	}
+
+	return testResult(ldp.ApplicationBindResponse, ldp.LDAPResultInvalidCredentials, "invalid credentials"), nil
+}
+
+// testNonce is the nonce of every DIGEST-MD5 challenge
+const testNonce = "test-nonce"
+
+// saslBind handles SASL EXTERNAL, binding as the entry with the cn of the
+// client certificate, and DIGEST-MD5 for the entry with the cn of the user
+// name.
+func (s *testServer) saslBind(c net.Conn, sasl *ber.Packet) (*ber.Packet, *testEntry) {
+	mechanism := sasl.Children[0].Data.String()
+
+	s.mu.Lock()
+	s.binds = append(s.binds, mechanism)
+	s.mu.Unlock()
+
+	failed := testResult(ldp.ApplicationBindResponse, ldp.LDAPResultInvalidCredentials, "invalid credentials")
+
+	switch mechanism {
+	case "EXTERNAL":
+		tc, ok := c.(*tls.Conn)
+		if !ok || len(tc.ConnectionState().PeerCertificates) == 0 {
+			return testResult(ldp.ApplicationBindResponse, ldp.LDAPResultInappropriateAuthentication, "no client certificate"), nil
+		}
+
+		if e := s.named(tc.ConnectionState().PeerCertificates[0].Subject.CommonName); e != nil {
+			return testResult(ldp.ApplicationBindResponse, ldp.LDAPResultSuccess, ""), e
+		}
+		return failed, nil
+	case "DIGEST-MD5":
+		if len(sasl.Children) < 2 {
+			challenge := testResult(ldp.ApplicationBindResponse, ldp.LDAPResultSaslBindInProgress, "")
+			challenge.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, `realm="example.com",nonce="`+testNonce+`",qop="auth",charset=utf-8,algorithm=md5-sess`, ""))
+			return challenge, nil
+		}
+
+		params := map[string]string{}
+		for _, param := range strings.Split(sasl.Children[1].Data.String(), ",") {
+			if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+				params[kv[0]] = strings.Trim(kv[1], `"`)
+			}
+		}
+
+		e := s.named(params["username"])
+		if e == nil || params["nonce"] != testNonce {
+			return failed, nil
+		}
+
+		sum := func(v string) string {
+			h := md5.Sum([]byte(v))
+			return hex.EncodeToString(h[:])
+		}
+
+		secret := md5.Sum([]byte(params["username"] + ":" + params["realm"] + ":" + e.password()))
+		ha1 := sum(string(secret[:]) + ":" + testNonce + ":" + params["cnonce"])
+		ha2 := sum("AUTHENTICATE:" + params["digest-uri"])
+
+		if params["response"] != sum(ha1+":"+testNonce+":"+params["nc"]+":"+params["cnonce"]+":"+params["qop"]+":"+ha2) {
+			return failed, nil
+		}
+
+		return testResult(ldp.ApplicationBindResponse, ldp.LDAPResultSuccess, ""), e
+	}
+
+	return testResult(ldp.ApplicationBindResponse, ldp.LDAPResultAuthMethodNotSupported, "unsupported mechanism"), nil
+}
+
+// named returns the entry with the cn
+func (s *testServer) named(cn string) *testEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if cn != "" && hasValue(e, "cn", cn) {
+			return e
+		}
+	}
+	return nil
+}
+
+// testMinPassword is the shortest password the test server accepts
+const testMinPassword = 8
+
+// passwordModify handles the Password Modify extended operation for the
+// bound user.
+func (s *testServer) passwordModify(op *ber.Packet, bound *testEntry) *ber.Packet {
+	if len(op.Children) < 2 || op.Children[0].Data.String() != "1.3.6.1.4.1.4203.1.11.1" {
+		return testResult(ldp.ApplicationExtendedResponse, ldp.LDAPResultProtocolError, "unsupported extended operation")
+	}
+
+	if bound == nil {
+		return testResult(ldp.ApplicationExtendedResponse, ldp.LDAPResultInsufficientAccessRights, "not bound")
+	}
+
+	var oldPassword, newPassword string
+	for _, field := range ber.DecodePacket(op.Children[1].Data.Bytes()).Children {
+		switch field.Tag {
+		case 0:
+			return testResult(ldp.ApplicationExtendedResponse, ldp.LDAPResultUnwillingToPerform, "only the bound user may be changed")
+		case 1:
+			oldPassword = field.Data.String()
+		case 2:
+			newPassword = field.Data.String()
+		}
+	}
+
+	bound.mu.Lock()
+	defer bound.mu.Unlock()
+
+	switch {
+	case oldPassword != bound.Password:
+		return testResult(ldp.ApplicationExtendedResponse, ldp.LDAPResultInvalidCredentials, "")
+	case len(newPassword) < testMinPassword:
+		return testResult(ldp.ApplicationExtendedResponse, ldp.LDAPResultConstraintViolation, "Password fails quality checking policy")
+	}
+
+	bound.Password = newPassword
+	return testResult(ldp.ApplicationExtendedResponse, ldp.LDAPResultSuccess, "")
+}
+
+// modify handles just AD style password changes, deleting the old
+// unicodePwd and adding the new.
+func (s *testServer) modify(op *ber.Packet, bound *testEntry) *ber.Packet {
+	if bound == nil {
+		return testResult(ldp.ApplicationModifyResponse, ldp.LDAPResultInsufficientAccessRights, "not bound")
+	}
+
+	e := s.entry(op.Children[0].Data.String())
+	if e == nil {
+		return testResult(ldp.ApplicationModifyResponse, ldp.LDAPResultNoSuchObject, "")
+	}
+
+	var oldPassword, newPassword string
+	for _, change := range op.Children[1].Children {
+		attr := change.Children[1]
+		if !strings.EqualFold(attr.Children[0].Data.String(), "unicodePwd") || len(attr.Children[1].Children) != 1 {
+			return testResult(ldp.ApplicationModifyResponse, ldp.LDAPResultUnwillingToPerform, "unsupported modification")
+		}
+
+		value := decodeUnicodePwd(attr.Children[1].Children[0].Data.Bytes())
+		switch change.Children[0].Value.(int64) {
+		case ldp.DeleteAttribute:
+			oldPassword = value
+		case ldp.AddAttribute:
+			newPassword = value
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case oldPassword != e.Password:
+		return testResult(ldp.ApplicationModifyResponse, ldp.LDAPResultConstraintViolation, "00000056: AtrErr: DSID-03190F80, #1")
+	case len(newPassword) < testMinPassword:
+		return testResult(ldp.ApplicationModifyResponse, ldp.LDAPResultConstraintViolation, "0000052D: Constraint violation - check_password_restrictions")
+	}
+
+	e.Password = newPassword
+	return testResult(ldp.ApplicationModifyResponse, ldp.LDAPResultSuccess, "")
+}
+
+func decodeUnicodePwd(b []byte) string {
+	encoded := make([]uint16, len(b)/2)
+	for i := range encoded {
+		encoded[i] = uint16(b[i*2]) | uint16(b[i*2+1])<<8
+	}
+	return strings.Trim(string(utf16.Decode(encoded)), `"`)
+}
+
+func (s *testServer) search(op *ber.Packet) []*ber.Packet {
+	base := strings.ToLower(op.Children[0].Data.String())
+	scope := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, a.Data.String())
+	}
+
+	decompiled, err := ldp.DecompileFilter(filter)
+	if err != nil {
+		return []*ber.Packet{testResult(ldp.ApplicationSearchResultDone, ldp.LDAPResultProtocolError, err.Error())}
+	}
+
+	s.mu.Lock()
+	s.filters = append(s.filters, decompiled)
+	entries := s.entries
+	s.mu.Unlock()
+
+	var responses []*ber.Packet
+	for _, e := range entries {
+		if !strings.HasSuffix(strings.ToLower(e.DN), base) || !s.match(e, filter) {
+			continue
+		}
+
+		if scope == ldp.ScopeBaseObject && strings.ToLower(e.DN) != base {
+			continue
+		}
+
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldp.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, ""))
+
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		for name, values := range e.Attributes {
+			if !requested(attributes, name) {
+				continue
+			}
+			// Like AD, constructed attributes are only returned on base reads
+			if name == attrUserAccountControlComputed && scope != ldp.ScopeBaseObject {
+				continue
+			}
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range values {
+				vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+			}
+			attr.AppendChild(vals)
+			attrs.AppendChild(attr)
+		}
+		entry.AppendChild(attrs)
+
+		responses = append(responses, entry)
+	}
+
+	return append(responses, testResult(ldp.ApplicationSearchResultDone, ldp.LDAPResultSuccess, ""))
+}
+
+func (e *testEntry) password() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.Password
+}
+
+func (s *testServer) entry(dn string) *testEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) {
+			return e
+		}
+	}
+	return nil
+}
+
+// principal finds the entry with the user principal name, as AD allows
+// binding with it in place of the DN.
+func (s *testServer) principal(upn string) *testEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if hasValue(e, "userPrincipalName", upn) {
+			return e
+		}
+	}
+	return nil
+}
+
+// match evaluates the filter against the entry
+func (s *testServer) match(e *testEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldp.FilterAnd:
+		for _, child := range filter.Children {
+			if !s.match(e, child) {
+				return false
+			}
+		}
+		return true
+	case ldp.FilterOr:
+		for _, child := range filter.Children {
+			if s.match(e, child) {
+				return true
+			}
+		}
+		return false
+	case ldp.FilterNot:
+		return !s.match(e, filter.Children[0])
+	case ldp.FilterEqualityMatch:
+		return hasValue(e, filter.Children[0].Data.String(), filter.Children[1].Data.String())
+	case ldp.FilterPresent:
+		return len(attribute(e, filter.Data.String())) > 0
+	case ldp.FilterSubstrings:
+		return matchSubstrings(attribute(e, filter.Children[0].Data.String()), filter.Children[1].Children)
+	case ldp.FilterExtensibleMatch:
+		var rule, attr, value string
+		for _, child := range filter.Children {
+			switch child.Tag {
+			case ldp.MatchingRuleAssertionMatchingRule:
+				rule = child.Data.String()
+			case ldp.MatchingRuleAssertionType:
+				attr = child.Data.String()
+			case ldp.MatchingRuleAssertionMatchValue:
+				value = child.Data.String()
+			}
+		}
+		if rule == matchingRuleInChain && strings.EqualFold(attr, "member") {
+			return s.memberInChain(e, value, map[string]bool{})
+		}
+		return false
+	}
+
+	return false
+}
+
+// memberInChain walks nested group membership like AD does
+func (s *testServer) memberInChain(group *testEntry, dn string, seen map[string]bool) bool {
+	if seen[strings.ToLower(group.DN)] {
+		return false
+	}
+	seen[strings.ToLower(group.DN)] = true
+
+	for _, member := range attribute(group, "member") {
+		if strings.EqualFold(member, dn) {
+			return true
+		}
+		if nested := s.entry(member); nested != nil && s.memberInChain(nested, dn, seen) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func attribute(e *testEntry, name string) []string {
+	if strings.EqualFold(name, "objectClass") && e.Attributes["objectClass"] == nil {
+		return []string{"top"}
+	}
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func hasValue(e *testEntry, name, value string) bool {
+	for _, v := range attribute(e, name) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSubstrings(values []string, parts []*ber.Packet) bool {
+	for _, v := range values {
+		v = strings.ToLower(v)
+		ok := true
+		for _, part := range parts {
+			s := strings.ToLower(part.Data.String())
+			switch part.Tag {
+			case ldp.FilterSubstringsInitial:
+				ok = strings.HasPrefix(v, s)
+				v = strings.TrimPrefix(v, s)
+			case ldp.FilterSubstringsAny:
+				i := strings.Index(v, s)
+				ok = i >= 0
+				if ok {
+					v = v[i+len(s):]
+				}
+			case ldp.FilterSubstringsFinal:
+				ok = strings.HasSuffix(v, s)
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func requested(attributes []string, name string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+	for _, a := range attributes {
+		if a == "*" || strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func testResult(tag ber.Tag, code uint16, diagnostic string) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diagnostic, ""))
+	return result
+}
@@ -0,0 +1,477 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+
+	ldp "github.com/go-ldap/ldap/v3"
+)
+
+// Server selection modes
+const (
+	SelectionFailover   = "failover"
+	SelectionRoundRobin = "round_robin"
+)
+
+// maxBackoff caps how long a failing server is avoided for
+const maxBackoff = 5 * time.Minute
+
+// srvResolver looks up SRV records, it is satisfied by *net.Resolver
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// server is a single LDAP server along with its pools of connections and
+// its health. Connections in the search pool stay bound as the service
+// account while those in the binds pool are bound as each user in turn.
+type server struct {
+	addr   string
+	host   string
+	ldaps  bool
+	search *pool
+	binds  *pool
+
+	mu       sync.Mutex
+	failures int
+	retryAt  time.Time
+}
+
+// servers are all the servers known to the backend
+type servers struct {
+	mu       sync.Mutex
+	static   []*server
+	srv      []*server
+	resolved time.Time
+	next     uint32
+}
+
+func (h *LDAP) newServer(u *url.URL) *server {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+
+	ldaps := port == "636" || port == "3269" || u.Scheme == "ldaps"
+	if u.Scheme == "ldap" {
+		ldaps = false
+	}
+	if port == "" || port == "0" {
+		switch {
+		case h.catalog && ldaps:
+			port = "3269"
+		case h.catalog:
+			port = "3268"
+		case ldaps:
+			port = "636"
+		default:
+			port = "389"
+		}
+	}
+
+	return &server{
+		addr:   net.JoinHostPort(host, port),
+		host:   host,
+		ldaps:  ldaps,
+		search: newPool(h.ConnectionPoolSize, h.IdleTimeout.Duration, h.MaxLifetime.Duration),
+		binds:  newPool(h.ConnectionPoolSize, h.IdleTimeout.Duration, h.MaxLifetime.Duration),
+	}
+}
+
+func (s *server) String() string {
+	return s.addr
+}
+
+// healthy reports whether the server isn't being avoided
+func (s *server) healthy(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.retryAt)
+}
+
+func (s *server) succeeded() {
+	s.mu.Lock()
+	s.failures = 0
+	s.retryAt = time.Time{}
+	s.mu.Unlock()
+}
+
+func (s *server) failed(backoff time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures++
+	for i := 1; i < s.failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	s.retryAt = time.Now().Add(backoff)
+}
+
+// drain closes the idle connections of the server, and with close those in
+// use as they are returned.
+func (s *server) drain(close bool) {
+	s.search.drain(close)
+	s.binds.drain(close)
+}
+
+// validateServers checks the server configuration without connecting
+func (h *LDAP) validateServers() error {
+	switch h.Selection {
+	case SelectionFailover, SelectionRoundRobin:
+	default:
+		return fmt.Errorf("unknown server selection %q, expected %s or %s", h.Selection, SelectionFailover, SelectionRoundRobin)
+	}
+
+	if h.HealthBackoff.Duration <= 0 {
+		return errors.New("health backoff must be greater than 0")
+	}
+
+	if h.DialTimeout.Duration <= 0 {
+		return errors.New("dial timeout must be greater than 0")
+	}
+
+	if h.IdleTimeout.Duration <= 0 {
+		return errors.New("idle timeout must be greater than 0")
+	}
+
+	if h.MaxLifetime.Duration <= 0 {
+		return errors.New("max lifetime must be greater than 0")
+	}
+
+	if h.PingInterval.Duration < 0 {
+		return errors.New("ping interval must not be negative")
+	}
+
+	for _, u := range h.URLs {
+		if u == nil || u.URL == nil {
+			return errors.New("urls must not be empty")
+		}
+	}
+
+	if h.SRVDomain == "" {
+		return nil
+	}
+
+	if h.SRVService == "" {
+		return errors.New("srv service must not be empty")
+	}
+
+	if h.SRVRefresh.Duration <= 0 {
+		return errors.New("srv refresh must be greater than 0")
+	}
+
+	return nil
+}
+
+// newServers builds the servers, looking up those of the SRVDomain
+func (h *LDAP) newServers() error {
+	h.servers = &servers{}
+
+	urls := h.URLs
+	if h.URL != nil {
+		urls = append([]*jsontypes.URL{h.URL}, urls...)
+	}
+
+	for _, u := range urls {
+		h.servers.static = append(h.servers.static, h.newServer(u.URL))
+	}
+
+	if h.SRVDomain == "" {
+		return nil
+	}
+
+	if h.resolver == nil {
+		h.resolver = net.DefaultResolver
+	}
+
+	if err := h.resolveSRV(); err != nil && len(h.servers.static) == 0 {
+		return err
+	}
+
+	return nil
+}
+
+// resolveSRV looks up the servers of the SRVDomain, keeping the pools of
+// servers that are still listed. The caller must hold servers.mu or have
+// sole access to the servers.
+func (h *LDAP) resolveSRV() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.DialTimeout.Duration)
+	defer cancel()
+
+	h.servers.resolved = time.Now()
+
+	_, records, err := h.resolver.LookupSRV(ctx, h.SRVService, "tcp", h.SRVDomain)
+	if err != nil {
+		return fmt.Errorf("lookup _%s._tcp.%s: %v", h.SRVService, h.SRVDomain, err)
+	}
+
+	if len(records) == 0 {
+		return fmt.Errorf("lookup _%s._tcp.%s: no records", h.SRVService, h.SRVDomain)
+	}
+
+	// The resolver orders records by priority, randomised by weight
+	existing := map[string]*server{}
+	for _, s := range h.servers.srv {
+		existing[s.addr] = s
+	}
+
+	scheme := "ldap"
+	if h.SRVService == "ldaps" {
+		scheme = "ldaps"
+	}
+
+	var found []*server
+	for _, r := range records {
+		u := &url.URL{Scheme: scheme, Host: net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))}
+		s := h.newServer(u)
+		if e, ok := existing[s.addr]; ok {
+			s = e
+			delete(existing, s.addr)
+		}
+		found = append(found, s)
+	}
+
+	for _, s := range existing {
+		s.drain(true)
+	}
+
+	h.servers.srv = found
+
+	return nil
+}
+
+// candidates returns the servers in the order they should be tried, healthy
+// servers first.
+func (h *LDAP) candidates() []*server {
+	h.servers.mu.Lock()
+	if h.SRVDomain != "" && time.Since(h.servers.resolved) >= h.SRVRefresh.Duration {
+		// Keep using the servers we know about if the lookup fails
+		h.resolveSRV()
+	}
+	all := append(append([]*server(nil), h.servers.static...), h.servers.srv...)
+	h.servers.mu.Unlock()
+
+	now := time.Now()
+	var healthy, unhealthy []*server
+	for _, s := range all {
+		if s.healthy(now) {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
+		}
+	}
+
+	if h.Selection == SelectionRoundRobin && len(healthy) > 1 {
+		n := int(atomic.AddUint32(&h.servers.next, 1)-1) % len(healthy)
+		healthy = append(healthy[n:], healthy[:n]...)
+	}
+
+	// Servers that are failing are a last resort, soonest to be retried first
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		unhealthy[i].mu.Lock()
+		defer unhealthy[i].mu.Unlock()
+		unhealthy[j].mu.Lock()
+		defer unhealthy[j].mu.Unlock()
+		return unhealthy[i].retryAt.Before(unhealthy[j].retryAt)
+	})
+
+	return append(healthy, unhealthy...)
+}
+
+// getConnection returns a connection bound as the service account from the
+// first server that can provide one. In direct bind mode the connection is
+// from the binds pool, ready to be bound as the user.
+func (h *LDAP) getConnection() (*conn, error) {
+	if h.servers == nil {
+		return nil, errors.New("ldap backend has not been provisioned")
+	}
+
+	var errs []string
+	for _, s := range h.candidates() {
+		p := s.search
+		if h.bindTemplate != nil {
+			p = s.binds
+		}
+
+		c, err := h.serverConnection(s, p)
+		if err == nil {
+			s.succeeded()
+			return c, nil
+		}
+
+		s.failed(h.HealthBackoff.Duration)
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no ldap servers available")
+	}
+
+	return nil, errors.New("no ldap servers available: " + strings.Join(errs, "; "))
+}
+
+// getUserConnection returns a connection to the server for binding as a
+// user, so the service account's connections needn't be bound again.
+func (h *LDAP) getUserConnection(s *server) (*conn, error) {
+	c, err := h.serverConnection(s, s.binds)
+	if err != nil {
+		s.failed(h.HealthBackoff.Duration)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (h *LDAP) serverConnection(s *server, p *pool) (*conn, error) {
+	for c := p.get(); c != nil; c = p.get() {
+		if h.alive(c) {
+			return c, nil
+		}
+		c.Close()
+	}
+
+	lc, err := h.dial(s)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c := &conn{Client: lc, server: s, pool: p, created: now, lastUsed: now}
+
+	if p == s.search {
+		if err := h.bind(c); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("bind to %s with %q: %v", s, h.BindDN, err)
+		}
+	}
+
+	return c, nil
+}
+
+// alive pings connections that have been idle for a while by reading the
+// root DSE, which is readable whoever the connection is bound as.
+func (h *LDAP) alive(c *conn) bool {
+	if c.closing() {
+		return false
+	}
+
+	if h.PingInterval.Duration == 0 || time.Since(c.lastUsed) < h.PingInterval.Duration {
+		return true
+	}
+
+	_, err := c.Search(ldp.NewSearchRequest(
+		"",
+		ldp.ScopeBaseObject, ldp.NeverDerefAliases, 0, int(h.DialTimeout.Duration/time.Second), false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	))
+
+	return err == nil
+}
+
+func (h *LDAP) dial(s *server) (ldp.Client, error) {
+	nc, err := net.DialTimeout("tcp", s.addr, h.DialTimeout.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %v", s, err)
+	}
+
+	if s.ldaps {
+		tc := tls.Client(nc, h.tlsConfigFor(s.host))
+		tc.SetDeadline(time.Now().Add(h.DialTimeout.Duration))
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("connect to %s: %v", s, err)
+		}
+		tc.SetDeadline(time.Time{})
+		nc = tc
+	}
+
+	c := ldp.NewConn(nc, s.ldaps)
+	c.Start()
+	c.SetTimeout(h.Timeout.Duration)
+
+	// Technically it's not impossible to run tls over ssl... just excessive
+	if h.TLS {
+		if err = c.StartTLS(h.tlsConfigFor(s.host)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("StartTLS with %s: %v", s, err)
+		}
+	}
+
+	return c, nil
+}
+
+// stashConnection returns the connection to its pool, connections that
+// have been closed by a network error count against the server.
+func (h *LDAP) stashConnection(c *conn) {
+	if c.closing() {
+		c.server.failed(h.HealthBackoff.Duration)
+	}
+
+	c.pool.put(c)
+}
+
+// Cleanup closes the idle connections of every server and those in use as
+// they are returned, the configuration is being replaced or shut down. The
+// servers and drivers are left in place for requests still in flight.
+func (h *LDAP) Cleanup() error {
+	for _, d := range h.Domains {
+		if d != nil && d.driver != nil {
+			d.driver.Cleanup()
+		}
+	}
+
+	if h.globalCatalog != nil {
+		h.globalCatalog.Cleanup()
+	}
+
+	if h.servers == nil {
+		return nil
+	}
+
+	h.servers.mu.Lock()
+	for _, s := range append(h.servers.static, h.servers.srv...) {
+		s.drain(true)
+	}
+	h.servers.mu.Unlock()
+
+	return nil
+}
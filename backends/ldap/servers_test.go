@@ -0,0 +1,223 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// deadURL returns the URL of a port nothing is listening on
+func deadURL(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return "ldap://" + ln.Addr().String()
+}
+
+func testURL(t *testing.T, s string) *jsontypes.URL {
+	u := &jsontypes.URL{}
+	if err := u.Unmarshal(s); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func countBinds(s *testServer, dn string) int {
+	n := 0
+	for _, b := range s.Binds() {
+		if b == dn {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFailover(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+	dead := deadURL(t)
+
+	h := testDriver(t, s)
+	h.URL = testURL(t, dead)
+	h.URLs = []*jsontypes.URL{testURL(t, s.URL())}
+	provision(t, h)
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Fatalf("expected alice to authenticate, got %q", id)
+	}
+
+	candidates := h.candidates()
+	if candidates[0].addr != s.ln.Addr().String() {
+		t.Errorf("expected the failing server to be tried last, got %v", candidates)
+	}
+
+	if candidates[1].healthy(time.Now()) {
+		t.Error("expected the dead server to be unhealthy")
+	}
+}
+
+func TestAllServersDown(t *testing.T) {
+	s := newTestServer(t, testDirectory()...)
+
+	h := testDriver(t, s)
+	provision(t, h)
+	s.Close()
+	h.servers.static[0].drain(false)
+
+	if _, err := h.getConnection(); err == nil {
+		t.Fatal("expected no connection to be available")
+	}
+
+	if h.servers.static[0].healthy(time.Now()) {
+		t.Error("expected the server to be unhealthy")
+	}
+
+	// Failing servers are still tried when there's nothing else
+	if candidates := h.candidates(); len(candidates) != 1 {
+		t.Errorf("expected the failing server to remain a candidate, got %v", candidates)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	a := newTestServer(t, testDirectory()...)
+	b := newTestServer(t, testDirectory()...)
+
+	h := testDriver(t, a)
+	h.URLs = []*jsontypes.URL{testURL(t, b.URL())}
+	h.Selection = SelectionRoundRobin
+	provision(t, h)
+
+	for i := 0; i < 4; i++ {
+		if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+			t.Fatalf("expected alice to authenticate, got %q", id)
+		}
+	}
+
+	if na, nb := countBinds(a, testAliceDN), countBinds(b, testAliceDN); na != 2 || nb != 2 {
+		t.Errorf("expected logins to be shared between the servers, got %d and %d", na, nb)
+	}
+}
+
+type testResolver struct {
+	records []*net.SRV
+	err     error
+	lookups int
+}
+
+func (r *testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.lookups++
+	if service != "ldap" || proto != "tcp" || name != "example.com" {
+		return "", nil, errors.New("unexpected lookup of _" + service + "._" + proto + "." + name)
+	}
+	return "", r.records, r.err
+}
+
+func srvRecord(t *testing.T, s *testServer) *net.SRV {
+	_, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.SRV{Target: "127.0.0.1.", Port: uint16(p)}
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	a := newTestServer(t, testDirectory()...)
+	b := newTestServer(t, testDirectory()...)
+
+	resolver := &testResolver{records: []*net.SRV{srvRecord(t, a)}}
+
+	h := testDriver(t, a)
+	h.URL = nil
+	h.SRVDomain = "example.com"
+	h.SRVRefresh = jsontypes.Duration{Duration: time.Hour}
+	h.resolver = resolver
+	provision(t, h)
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Fatalf("expected alice to authenticate, got %q", id)
+	}
+
+	if countBinds(a, testAliceDN) != 1 {
+		t.Error("expected alice to bind against the discovered server")
+	}
+
+	// A failed lookup keeps the known servers
+	resolver.records, resolver.err = nil, errors.New("no such host")
+	h.servers.resolved = time.Time{}
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Fatalf("expected alice to authenticate after a failed lookup, got %q", id)
+	}
+
+	resolver.records, resolver.err = []*net.SRV{srvRecord(t, b)}, nil
+	h.servers.resolved = time.Time{}
+
+	if id := authenticate(t, h, "alice", "alice-password"); id != testAliceDN {
+		t.Fatalf("expected alice to authenticate, got %q", id)
+	}
+
+	if countBinds(b, testAliceDN) != 1 {
+		t.Error("expected alice to bind against the newly discovered server")
+	}
+
+	if resolver.lookups != 3 {
+		t.Errorf("expected 3 lookups, got %d", resolver.lookups)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &server{}
+
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		s.failed(time.Second)
+		if wait := time.Until(s.retryAt); wait > expected || wait < expected-time.Second/2 {
+			t.Errorf("failure %d: expected to back off %v, got %v", i+1, expected, wait)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		s.failed(time.Second)
+	}
+
+	if wait := time.Until(s.retryAt); wait > maxBackoff {
+		t.Errorf("expected back off to be capped at %v, got %v", maxBackoff, wait)
+	}
+
+	s.succeeded()
+	if !s.healthy(time.Now()) {
+		t.Error("expected success to reset the server's health")
+	}
+}
+
+func TestDefaultPorts(t *testing.T) {
+	tests := []struct {
+		url     string
+		catalog bool
+		addr    string
+		ldaps   bool
+	}{
+		{url: "ldap://dc.example.com", addr: "dc.example.com:389"},
+		{url: "ldaps://dc.example.com", addr: "dc.example.com:636", ldaps: true},
+		{url: "ldap://dc.example.com:10389", addr: "dc.example.com:10389"},
+		{url: "ldap://gc.example.com", catalog: true, addr: "gc.example.com:3268"},
+		{url: "ldaps://gc.example.com", catalog: true, addr: "gc.example.com:3269", ldaps: true},
+		{url: "ldap://gc.example.com:389", catalog: true, addr: "gc.example.com:389"},
+	}
+
+	for _, test := range tests {
+		h := NewDriver()
+		h.catalog = test.catalog
+
+		s := h.newServer(testURL(t, test.url).URL)
+		if s.addr != test.addr || s.ldaps != test.ldaps {
+			t.Errorf("%s (catalog %v): expected %s ldaps %v, got %s ldaps %v", test.url, test.catalog, test.addr, test.ldaps, s.addr, s.ldaps)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package radius
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Interface guard
+var _ backends.IdentityDriver = (*Radius)(nil)
+
+// BackendName name
+const BackendName = "radius"
+
+const defaultPort = "1812"
+const defaultTimeout = 5 * time.Second
+const defaultRetries = 2
+const defaultChallengeTimeout = 2 * time.Minute
+const defaultChallengeMessage = "Enter response"
+
+// ChallengeCookie carries the nonce of a pending challenge, binding the
+// response to the client that passed the first step.
+const ChallengeCookie = "reauth_radius_challenge"
+
+var defaultGroupAttributes = []string{"Class", "Filter-Id"}
+
+// Radius backend provides authentication against one or more RADIUS servers
+// using PAP. Servers are tried in order, failing over to the next when one
+// stops answering and sticking with whichever answered last.
+//
+// When a server responds with an Access-Challenge (for example to prompt for
+// an OTP) the challenge is passed to the failure mode along with a
+// ChallengeCookie holding a random nonce. The next request for the same user
+// that returns the cookie is sent as the response to it, anyone else asking
+// as that user starts afresh.
+type Radius struct {
+	Servers          []string           `json:"servers,omitempty"`
+	Secret           string             `json:"secret,omitempty"`
+	NASIdentifier    string             `json:"nas_identifier,omitempty"`
+	Timeout          jsontypes.Duration `json:"timeout,omitempty"`
+	Retries          int                `json:"retries,omitempty"`
+	GroupAttributes  []string           `json:"group_attributes,omitempty"`
+	ChallengeTimeout jsontypes.Duration `json:"challenge_timeout,omitempty"`
+
+	groupTypes []byte
+	preferred  uint32
+
+	mu         sync.Mutex
+	challenges map[string]challenge
+}
+
+// challenge is pending for the user, keyed by the nonce given to the client
+type challenge struct {
+	user    string
+	state   []byte
+	expires time.Time
+}
+
+// NewDriver returns a new instance of Radius with some defaults
+func NewDriver() *Radius {
+	return &Radius{
+		Timeout:          jsontypes.Duration{Duration: defaultTimeout},
+		Retries:          defaultRetries,
+		ChallengeTimeout: jsontypes.Duration{Duration: defaultChallengeTimeout},
+		GroupAttributes:  defaultGroupAttributes,
+	}
+}
+
+// Validate verifies that this module is functional with the given configuration
+func (h *Radius) Validate() error {
+	if len(h.Servers) == 0 {
+		return errors.New("at least one server is required")
+	}
+
+	if h.Secret == "" {
+		return errors.New("secret is a required parameter")
+	}
+
+	if h.Timeout.Duration <= 0 {
+		return errors.New("timeout must be greater than 0")
+	}
+
+	if h.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+
+	if h.ChallengeTimeout.Duration <= 0 {
+		return errors.New("challenge timeout must be greater than 0")
+	}
+
+	for i, server := range h.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			h.Servers[i] = net.JoinHostPort(server, defaultPort)
+		}
+	}
+
+	h.groupTypes = h.groupTypes[:0]
+	for _, name := range h.GroupAttributes {
+		t, err := AttributeType(name)
+		if err != nil {
+			return fmt.Errorf("group attributes: %v", err)
+		}
+		h.groupTypes = append(h.groupTypes, t)
+	}
+
+	h.mu.Lock()
+	h.challenges = map[string]challenge{}
+	h.mu.Unlock()
+
+	return nil
+}
+
+// Authenticate fulfils the backend interface
+func (h *Radius) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *Radius) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	un, pw, k := r.BasicAuth()
+	if !k {
+		return nil, nil
+	}
+
+	// It can't be sent so it can't be right
+	if len(pw) > MaxPasswordLength {
+		return nil, nil
+	}
+
+	// A challenge answered by this client is used up whatever the answer
+	nonce, state := h.takeChallenge(r, un)
+
+	req, err := h.accessRequest(r, un, pw, state)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Code {
+	case CodeAccessAccept:
+		identity := h.identity(un, resp)
+		if nonce != "" {
+			identity.ResponseHeader = h.challengeCookie(r, "", -1)
+		}
+		return identity, nil
+	case CodeAccessChallenge:
+		nonce, err := h.storeChallenge(un, resp.Get(AttrState))
+		if err != nil {
+			return nil, err
+		}
+		return nil, &backends.Rejection{
+			Reason:         backends.ReasonChallenge,
+			Message:        replyMessage(resp, defaultChallengeMessage),
+			ResponseHeader: h.challengeCookie(r, nonce, int(h.ChallengeTimeout.Duration/time.Second)),
+		}
+	case CodeAccessReject:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unexpected radius response code %d", resp.Code)
+}
+
+func (h *Radius) accessRequest(r *http.Request, un, pw string, state []byte) (*Packet, error) {
+	req, err := NewAccessRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := EncryptPassword([]byte(pw), []byte(h.Secret), req.Authenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Add(AttrUserName, []byte(un))
+	req.Add(AttrUserPassword, password)
+
+	if h.NASIdentifier != "" {
+		req.Add(AttrNASIdentifier, []byte(h.NASIdentifier))
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Add(AttrCallingStationID, []byte(host))
+	}
+
+	if state != nil {
+		req.Add(AttrState, state)
+	}
+
+	req.Add(AttrMessageAuthenticator, nil)
+
+	return req, nil
+}
+
+// exchange sends the request to each server in turn, starting with the one
+// that last answered, until one of them responds.
+func (h *Radius) exchange(req *Packet) (*Packet, error) {
+	raw, err := req.Encode([]byte(h.Secret))
+	if err != nil {
+		return nil, err
+	}
+
+	start := int(atomic.LoadUint32(&h.preferred))
+	var errs []string
+	for i := range h.Servers {
+		idx := (start + i) % len(h.Servers)
+		resp, err := h.send(h.Servers[idx], req, raw)
+		if err == nil {
+			atomic.StoreUint32(&h.preferred, uint32(idx))
+			return resp, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", h.Servers[idx], err))
+	}
+
+	return nil, fmt.Errorf("no radius server responded: %s", strings.Join(errs, "; "))
+}
+
+func (h *Radius) send(server string, req *Packet, raw []byte) (*Packet, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, maxPacketSize)
+	for attempt := 0; attempt <= h.Retries; attempt++ {
+		if _, err = conn.Write(raw); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(h.Timeout.Duration)
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		for {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+
+			// Silently discard anything that isn't a valid answer to our
+			// request, as per RFC 2865 section 3.
+			if VerifyResponse(buf[:n], req, []byte(h.Secret)) != nil {
+				continue
+			}
+
+			return Decode(buf[:n])
+		}
+
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+func (h *Radius) identity(un string, resp *Packet) *backends.Identity {
+	var groups []string
+	for _, t := range h.groupTypes {
+		for _, v := range resp.GetAll(t) {
+			if len(v) > 0 {
+				groups = append(groups, string(v))
+			}
+		}
+	}
+
+	identity := &backends.Identity{ID: un}
+	if len(groups) > 0 {
+		identity.Metadata = map[string]string{
+			"groups": strings.Join(groups, ","),
+		}
+	}
+
+	return identity
+}
+
+func replyMessage(resp *Packet, def string) string {
+	var lines []string
+	for _, v := range resp.GetAll(AttrReplyMessage) {
+		lines = append(lines, string(v))
+	}
+
+	if len(lines) == 0 {
+		return def
+	}
+
+	return strings.Join(lines, " ")
+}
+
+// takeChallenge returns and forgets the challenge pending for the user under
+// the nonce in the client's cookie. Challenges for other users are left be.
+func (h *Radius) takeChallenge(r *http.Request, un string) (string, []byte) {
+	cookie, err := r.Cookie(ChallengeCookie)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, found := h.challenges[cookie.Value]
+	if !found || c.user != un {
+		return "", nil
+	}
+
+	delete(h.challenges, cookie.Value)
+
+	if time.Now().After(c.expires) {
+		return "", nil
+	}
+
+	return cookie.Value, c.state
+}
+
+// storeChallenge remembers the state of the challenge under a new nonce
+func (h *Radius) storeChallenge(un string, state []byte) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range h.challenges {
+		if now.After(c.expires) {
+			delete(h.challenges, k)
+		}
+	}
+
+	h.challenges[nonce] = challenge{user: un, state: state, expires: now.Add(h.ChallengeTimeout.Duration)}
+
+	return nonce, nil
+}
+
+// challengeCookie sets, or with a negative maxAge clears, the nonce cookie
+func (h *Radius) challengeCookie(r *http.Request, nonce string, maxAge int) http.Header {
+	header := http.Header{}
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     ChallengeCookie,
+		Value:    nonce,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}).String())
+	return header
+}
@@ -0,0 +1,322 @@
+package radius
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+const testSecret = "s3cr3t"
+
+// testServer is a minimal RADIUS server that accepts alice, rejects anyone
+// else and challenges bob for an OTP before accepting him.
+type testServer struct {
+	conn net.PacketConn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{conn: conn}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testServer) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		req, err := Decode(buf[:n])
+		if err != nil || req.Code != CodeAccessRequest {
+			continue
+		}
+
+		resp := s.handle(req)
+		resp.Identifier = req.Identifier
+
+		raw, err := resp.Encode(nil)
+		if err != nil {
+			continue
+		}
+
+		auth := ResponseAuthenticator(raw, req.Authenticator, []byte(testSecret))
+		copy(raw[4:20], auth[:])
+		s.conn.WriteTo(raw, addr)
+	}
+}
+
+func (s *testServer) handle(req *Packet) *Packet {
+	pw, _ := DecryptPassword(req.Get(AttrUserPassword), []byte(testSecret), req.Authenticator)
+
+	switch string(req.Get(AttrUserName)) {
+	case "alice":
+		if string(pw) == "password" {
+			resp := &Packet{Code: CodeAccessAccept}
+			resp.Add(AttrClass, []byte("admins"))
+			resp.Add(AttrFilterID, []byte("vpn"))
+			return resp
+		}
+	case "bob":
+		if string(req.Get(AttrState)) == "otp-pending" && string(pw) == "123456" {
+			return &Packet{Code: CodeAccessAccept}
+		}
+		if string(pw) == "password" {
+			resp := &Packet{Code: CodeAccessChallenge}
+			resp.Add(AttrState, []byte("otp-pending"))
+			resp.Add(AttrReplyMessage, []byte("Enter your OTP"))
+			return resp
+		}
+	}
+
+	return &Packet{Code: CodeAccessReject}
+}
+
+func newTestDriver(t *testing.T, servers ...string) *Radius {
+	h := NewDriver()
+	h.Servers = servers
+	h.Secret = testSecret
+	h.Timeout = jsontypes.Duration{Duration: 100 * time.Millisecond}
+	h.Retries = 1
+
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func authenticate(h *Radius, un, pw string, cookies ...*http.Cookie) (*backends.Identity, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth(un, pw)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return h.AuthenticateIdentity(r)
+}
+
+// challenged starts a challenge for bob, returning the nonce cookie
+func challenged(t *testing.T, h *Radius) *http.Cookie {
+	_, err := authenticate(h, "bob", "password")
+
+	var rejection *backends.Rejection
+	if !errors.As(err, &rejection) {
+		t.Fatalf("expected challenge, got %v", err)
+	}
+
+	if rejection.Reason != backends.ReasonChallenge || rejection.Message != "Enter your OTP" {
+		t.Errorf("unexpected rejection %+v", rejection)
+	}
+
+	resp := http.Response{Header: rejection.ResponseHeader}
+	for _, c := range resp.Cookies() {
+		if c.Name == ChallengeCookie && c.Value != "" {
+			if !c.HttpOnly {
+				t.Error("expected the challenge cookie to be http only")
+			}
+			return c
+		}
+	}
+
+	t.Fatal("expected a challenge cookie")
+	return nil
+}
+
+func TestPasswordRoundTrip(t *testing.T) {
+	var auth [16]byte
+	copy(auth[:], "0123456789abcdef")
+
+	for _, pw := range []string{"", "short", "exactly16bytes!!", "a password longer than sixteen bytes"} {
+		hidden, err := EncryptPassword([]byte(pw), []byte(testSecret), auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(hidden)%16 != 0 {
+			t.Errorf("hidden password length %d is not a multiple of 16", len(hidden))
+		}
+
+		plain, err := DecryptPassword(hidden, []byte(testSecret), auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(plain) != pw {
+			t.Errorf("expected %q got %q", pw, plain)
+		}
+	}
+}
+
+func TestMessageAuthenticator(t *testing.T) {
+	req, err := NewAccessRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &Packet{Code: CodeAccessAccept, Identifier: req.Identifier}
+	resp.Add(AttrMessageAuthenticator, nil)
+
+	// Servers calculate the message authenticator over the request authenticator
+	resp.Authenticator = req.Authenticator
+	raw, err := resp.Encode([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := ResponseAuthenticator(raw, req.Authenticator, []byte(testSecret))
+	copy(raw[4:20], auth[:])
+
+	if err := VerifyResponse(raw, req, []byte(testSecret)); err != nil {
+		t.Fatalf("expected valid response, got %v", err)
+	}
+
+	raw[len(raw)-1] ^= 0xff
+	if err := VerifyResponse(raw, req, []byte(testSecret)); err == nil {
+		t.Fatal("expected tampered message authenticator to fail")
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	raw := make([]byte, headerLength+2)
+	binary.BigEndian.PutUint16(raw[2:4], uint16(len(raw)))
+	raw[headerLength] = AttrUserName
+	raw[headerLength+1] = 10
+
+	if _, err := Decode(raw); err == nil {
+		t.Fatal("expected error for attribute overrunning packet")
+	}
+}
+
+func TestAcceptAndReject(t *testing.T) {
+	s := newTestServer(t)
+	h := newTestDriver(t, s.addr())
+
+	tests := []struct {
+		name     string
+		password string
+		groups   string
+		ok       bool
+	}{
+		{name: "accept", password: "password", groups: "admins,vpn", ok: true},
+		{name: "reject", password: "wrong"},
+		{name: "too long", password: strings.Repeat("p", MaxPasswordLength+1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := authenticate(h, "alice", test.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.ok != (identity != nil) {
+				t.Fatalf("expected authenticated to be %v, got %+v", test.ok, identity)
+			}
+
+			if test.ok && (identity.ID != "alice" || identity.Metadata["groups"] != test.groups) {
+				t.Errorf("expected alice with groups %s, got %+v", test.groups, identity)
+			}
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	s := newTestServer(t)
+	h := newTestDriver(t, s.addr())
+
+	cookie := challenged(t, h)
+
+	identity, err := authenticate(h, "bob", "123456", cookie)
+	if err != nil || identity == nil || identity.ID != "bob" {
+		t.Fatalf("expected bob to be authenticated, got %+v, %v", identity, err)
+	}
+
+	if identity.ResponseHeader.Get("Set-Cookie") == "" {
+		t.Error("expected the challenge cookie to be cleared")
+	}
+
+	// The challenge state is single use
+	identity, err = authenticate(h, "bob", "123456", cookie)
+	if err != nil || identity != nil {
+		t.Fatalf("expected reject, got %+v, %v", identity, err)
+	}
+}
+
+func TestChallengeOtherClient(t *testing.T) {
+	s := newTestServer(t)
+	h := newTestDriver(t, s.addr())
+
+	cookie := challenged(t, h)
+
+	// Without the nonce the answer isn't sent as a response to bob's
+	// challenge, nor does it spoil it
+	for _, cookies := range [][]*http.Cookie{
+		nil,
+		{{Name: ChallengeCookie, Value: "guessed"}},
+	} {
+		identity, err := authenticate(h, "bob", "123456", cookies...)
+		if err != nil || identity != nil {
+			t.Fatalf("expected another client to be rejected, got %+v, %v", identity, err)
+		}
+
+		identity, err = authenticate(h, "bob", "654321", cookies...)
+		if err != nil || identity != nil {
+			t.Fatalf("expected another client to be rejected, got %+v, %v", identity, err)
+		}
+	}
+
+	// Nor does the nonce answer for anyone else
+	if identity, err := authenticate(h, "alice", "123456", cookie); err != nil || identity != nil {
+		t.Fatalf("expected the nonce not to apply to alice, got %+v, %v", identity, err)
+	}
+
+	identity, err := authenticate(h, "bob", "123456", cookie)
+	if err != nil || identity == nil || identity.ID != "bob" {
+		t.Fatalf("expected bob to still be able to answer, got %+v, %v", identity, err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	s := newTestServer(t)
+	h := newTestDriver(t, dead.LocalAddr().String(), s.addr())
+
+	identity, err := authenticate(h, "alice", "password")
+	if err != nil || identity == nil {
+		t.Fatalf("expected failover to second server, got %+v, %v", identity, err)
+	}
+
+	if h.preferred != 1 {
+		t.Errorf("expected second server to be preferred, got %d", h.preferred)
+	}
+
+	h = newTestDriver(t, dead.LocalAddr().String())
+	if _, err := authenticate(h, "alice", "password"); err == nil {
+		t.Fatal("expected error when no servers respond")
+	}
+}
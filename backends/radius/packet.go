@@ -0,0 +1,337 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Packet codes, RFC 2865 section 3
+const (
+	CodeAccessRequest   = 1
+	CodeAccessAccept    = 2
+	CodeAccessReject    = 3
+	CodeAccessChallenge = 11
+)
+
+// Attribute types, RFC 2865 section 5 and RFC 3579 section 3.2
+const (
+	AttrUserName             = 1
+	AttrUserPassword         = 2
+	AttrNASIPAddress         = 4
+	AttrFilterID             = 11
+	AttrReplyMessage         = 18
+	AttrState                = 24
+	AttrClass                = 25
+	AttrCallingStationID     = 31
+	AttrNASIdentifier        = 32
+	AttrMessageAuthenticator = 80
+)
+
+const (
+	headerLength  = 20
+	maxPacketSize = 4096
+	maxAttrLength = 253
+)
+
+var attributeNames = map[string]byte{
+	"user-name":             AttrUserName,
+	"filter-id":             AttrFilterID,
+	"reply-message":         AttrReplyMessage,
+	"state":                 AttrState,
+	"class":                 AttrClass,
+	"calling-station-id":    AttrCallingStationID,
+	"nas-identifier":        AttrNASIdentifier,
+	"message-authenticator": AttrMessageAuthenticator,
+}
+
+// AttributeType resolves an attribute name such as Filter-Id, or its number,
+// to the attribute type.
+func AttributeType(name string) (byte, error) {
+	if t, found := attributeNames[strings.ToLower(name)]; found {
+		return t, nil
+	}
+
+	n, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("unknown attribute %q", name)
+	}
+
+	return byte(n), nil
+}
+
+// Attribute is a single RADIUS attribute
+type Attribute struct {
+	Type  byte
+	Value []byte
+}
+
+// Packet is a RADIUS packet
+type Packet struct {
+	Code          byte
+	Identifier    byte
+	Authenticator [16]byte
+	Attributes    []Attribute
+}
+
+// NewAccessRequest returns an Access-Request with a random authenticator
+func NewAccessRequest() (*Packet, error) {
+	p := &Packet{Code: CodeAccessRequest}
+
+	if _, err := rand.Read(p.Authenticator[:]); err != nil {
+		return nil, err
+	}
+
+	var id [1]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	p.Identifier = id[0]
+
+	return p, nil
+}
+
+// Add appends an attribute to the packet
+func (p *Packet) Add(t byte, value []byte) {
+	p.Attributes = append(p.Attributes, Attribute{Type: t, Value: value})
+}
+
+// Get returns the first value for the given attribute type
+func (p *Packet) Get(t byte) []byte {
+	for _, a := range p.Attributes {
+		if a.Type == t {
+			return a.Value
+		}
+	}
+
+	return nil
+}
+
+// GetAll returns all values for the given attribute type
+func (p *Packet) GetAll(t byte) [][]byte {
+	var values [][]byte
+	for _, a := range p.Attributes {
+		if a.Type == t {
+			values = append(values, a.Value)
+		}
+	}
+
+	return values
+}
+
+// Encode packs the packet into its wire format. If the packet carries a
+// Message-Authenticator attribute it is calculated using the given secret.
+func (p *Packet) Encode(secret []byte) ([]byte, error) {
+	buf := make([]byte, headerLength, maxPacketSize)
+	buf[0] = p.Code
+	buf[1] = p.Identifier
+	copy(buf[4:20], p.Authenticator[:])
+
+	maOffset := -1
+	for _, a := range p.Attributes {
+		if len(a.Value) > maxAttrLength {
+			return nil, fmt.Errorf("attribute %d is too long", a.Type)
+		}
+
+		if a.Type == AttrMessageAuthenticator {
+			maOffset = len(buf) + 2
+			a.Value = make([]byte, md5.Size)
+		}
+
+		buf = append(buf, a.Type, byte(len(a.Value)+2))
+		buf = append(buf, a.Value...)
+	}
+
+	if len(buf) > maxPacketSize {
+		return nil, errors.New("packet is too large")
+	}
+
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+
+	if maOffset >= 0 {
+		mac := hmac.New(md5.New, secret)
+		mac.Write(buf)
+		copy(buf[maOffset:], mac.Sum(nil))
+	}
+
+	return buf, nil
+}
+
+// Decode unpacks a packet from its wire format
+func Decode(buf []byte) (*Packet, error) {
+	if len(buf) < headerLength {
+		return nil, errors.New("packet is too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	if length < headerLength || length > len(buf) || length > maxPacketSize {
+		return nil, errors.New("invalid packet length")
+	}
+
+	p := &Packet{
+		Code:       buf[0],
+		Identifier: buf[1],
+	}
+	copy(p.Authenticator[:], buf[4:20])
+
+	for attrs := buf[headerLength:length]; len(attrs) > 0; {
+		if len(attrs) < 2 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return nil, errors.New("invalid attribute length")
+		}
+
+		p.Add(attrs[0], append([]byte(nil), attrs[2:attrs[1]]...))
+		attrs = attrs[attrs[1]:]
+	}
+
+	return p, nil
+}
+
+// VerifyResponse checks the response authenticator, and message authenticator
+// if present, of a raw response against the request that solicited it.
+func VerifyResponse(raw []byte, request *Packet, secret []byte) error {
+	resp, err := Decode(raw)
+	if err != nil {
+		return err
+	}
+
+	if resp.Identifier != request.Identifier {
+		return errors.New("identifier mismatch")
+	}
+
+	length := binary.BigEndian.Uint16(raw[2:4])
+	raw = raw[:length]
+
+	hash := md5.New()
+	hash.Write(raw[:4])
+	hash.Write(request.Authenticator[:])
+	hash.Write(raw[headerLength:])
+	hash.Write(secret)
+
+	if !hmac.Equal(hash.Sum(nil), raw[4:20]) {
+		return errors.New("invalid response authenticator")
+	}
+
+	if ma := resp.Get(AttrMessageAuthenticator); ma != nil {
+		check := append([]byte(nil), raw...)
+		copy(check[4:20], request.Authenticator[:])
+		zeroMessageAuthenticator(check)
+
+		mac := hmac.New(md5.New, secret)
+		mac.Write(check)
+		if !hmac.Equal(mac.Sum(nil), ma) {
+			return errors.New("invalid message authenticator")
+		}
+	}
+
+	return nil
+}
+
+func zeroMessageAuthenticator(raw []byte) {
+	for attrs := raw[headerLength:]; len(attrs) >= 2 && int(attrs[1]) <= len(attrs) && attrs[1] >= 2; attrs = attrs[attrs[1]:] {
+		if attrs[0] == AttrMessageAuthenticator {
+			for i := 2; i < int(attrs[1]); i++ {
+				attrs[i] = 0
+			}
+		}
+	}
+}
+
+// ResponseAuthenticator calculates the authenticator for a response to the
+// given request authenticator, it's used by servers and exposed for testing.
+func ResponseAuthenticator(raw []byte, requestAuthenticator [16]byte, secret []byte) [16]byte {
+	hash := md5.New()
+	hash.Write(raw[:4])
+	hash.Write(requestAuthenticator[:])
+	hash.Write(raw[headerLength:])
+	hash.Write(secret)
+
+	var out [16]byte
+	copy(out[:], hash.Sum(nil))
+	return out
+}
+
+// MaxPasswordLength is the longest password a User-Password attribute holds
+const MaxPasswordLength = 128
+
+// EncryptPassword hides a password as described in RFC 2865 section 5.2
+func EncryptPassword(password, secret []byte, authenticator [16]byte) ([]byte, error) {
+	if len(password) > MaxPasswordLength {
+		return nil, errors.New("password is too long")
+	}
+
+	n := (len(password) + 15) / 16 * 16
+	if n == 0 {
+		n = 16
+	}
+
+	out := make([]byte, n)
+	copy(out, password)
+
+	prev := authenticator[:]
+	for i := 0; i < n; i += 16 {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(prev)
+		b := hash.Sum(nil)
+
+		for j := 0; j < 16; j++ {
+			out[i+j] ^= b[j]
+		}
+		prev = out[i : i+16]
+	}
+
+	return out, nil
+}
+
+// DecryptPassword reverses EncryptPassword
+func DecryptPassword(hidden, secret []byte, authenticator [16]byte) ([]byte, error) {
+	if len(hidden) == 0 || len(hidden)%16 != 0 {
+		return nil, errors.New("invalid password length")
+	}
+
+	out := make([]byte, len(hidden))
+	prev := authenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(prev)
+		b := hash.Sum(nil)
+
+		for j := 0; j < 16; j++ {
+			out[i+j] = hidden[i+j] ^ b[j]
+		}
+		prev = hidden[i : i+16]
+	}
+
+	return bytes.TrimRight(out, "\x00"), nil
+}
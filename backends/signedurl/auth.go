@@ -0,0 +1,226 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freman/caddy2-reauth/backends"
+)
+
+// Interface guard
+var _ backends.IdentityDriver = (*SignedURL)(nil)
+
+// BackendName name
+const BackendName = "signedurl"
+
+const defaultUser = "signedurl"
+
+// Query parameters carried by signed links, the signed query keys are in
+// addition to these.
+const (
+	ParamExpires   = "expires"
+	ParamKeyID     = "kid"
+	ParamUser      = "user"
+	ParamSignature = "signature"
+)
+
+// SignedURL backend provides authentication for links carrying an HMAC-SHA256
+// signature and expiry in their query parameters, so they can be shared
+// without creating accounts.
+//
+// The signature covers the method, path, expiry, key id, user and any of
+// the query keys listed in SignedQuery. With BindIP the client IP is also
+// covered so the link only works from the address it was minted for.
+//
+// Keys are base64 encoded and looked up by the key id in the link, allowing
+// new keys to be introduced while links signed with older ones still work.
+type SignedURL struct {
+	Keys        map[string]string `json:"keys,omitempty"`
+	SignedQuery []string          `json:"signed_query,omitempty"`
+	BindIP      bool              `json:"bind_ip,omitempty"`
+	DefaultUser string            `json:"default_user,omitempty"`
+
+	keys map[string][]byte
+}
+
+// NewDriver returns a new instance of SignedURL with some defaults
+func NewDriver() *SignedURL {
+	return &SignedURL{
+		DefaultUser: defaultUser,
+	}
+}
+
+// Validate verifies that this module is functional with the given configuration
+func (h *SignedURL) Validate() error {
+	if len(h.Keys) == 0 {
+		return errors.New("at least one key is required")
+	}
+
+	h.keys = make(map[string][]byte, len(h.Keys))
+	for id, key := range h.Keys {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("key %q is not valid base64: %v", id, err)
+		}
+
+		if len(raw) < sha256.Size {
+			return fmt.Errorf("key %q must be at least %d bytes", id, sha256.Size)
+		}
+
+		h.keys[id] = raw
+	}
+
+	for _, k := range h.SignedQuery {
+		switch k {
+		case ParamExpires, ParamKeyID, ParamUser, ParamSignature:
+			return fmt.Errorf("%q is always signed and can't be listed in signed_query", k)
+		}
+	}
+
+	return nil
+}
+
+// Authenticate fulfils the backend interface
+func (h *SignedURL) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *SignedURL) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	q := r.URL.Query()
+
+	sig := q.Get(ParamSignature)
+	if sig == "" {
+		return nil, nil
+	}
+
+	given, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, nil
+	}
+
+	kid := q.Get(ParamKeyID)
+	key, found := h.keys[kid]
+	if !found {
+		return nil, nil
+	}
+
+	expires, err := strconv.ParseInt(q.Get(ParamExpires), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, nil
+	}
+
+	var ip string
+	if h.BindIP {
+		if ip, _, err = net.SplitHostPort(r.RemoteAddr); err != nil {
+			return nil, nil
+		}
+	}
+
+	if !hmac.Equal(given, h.signature(key, r.Method, r.URL.Path, q, ip)) {
+		return nil, nil
+	}
+
+	user := q.Get(ParamUser)
+	if user == "" {
+		user = h.DefaultUser
+	}
+
+	return &backends.Identity{
+		ID: user,
+		Metadata: map[string]string{
+			"signedurl_key_id":  kid,
+			"signedurl_expires": time.Unix(expires, 0).UTC().Format(time.RFC3339),
+		},
+	}, nil
+}
+
+// Sign returns a copy of u signed with the given key that is valid until
+// expires. User and ip are optional, ip is only used when BindIP is set.
+func (h *SignedURL) Sign(method string, u *url.URL, kid string, expires time.Time, user, ip string) (*url.URL, error) {
+	key, found := h.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	if h.BindIP && ip == "" {
+		return nil, errors.New("an ip is required when bind_ip is set")
+	}
+
+	if !h.BindIP {
+		ip = ""
+	}
+
+	signed := *u
+	q := signed.Query()
+	q.Del(ParamSignature)
+	q.Set(ParamKeyID, kid)
+	q.Set(ParamExpires, strconv.FormatInt(expires.Unix(), 10))
+	q.Del(ParamUser)
+	if user != "" {
+		q.Set(ParamUser, user)
+	}
+
+	path := signed.Path
+	if path == "" {
+		path = "/"
+	}
+
+	q.Set(ParamSignature, base64.RawURLEncoding.EncodeToString(h.signature(key, strings.ToUpper(method), path, q, ip)))
+	signed.RawQuery = q.Encode()
+
+	return &signed, nil
+}
+
+// signature calculates the signature over the canonical form of the request
+func (h *SignedURL) signature(key []byte, method, path string, q url.Values, ip string) []byte {
+	signed := url.Values{}
+	for _, k := range append([]string{ParamExpires, ParamKeyID, ParamUser}, h.SignedQuery...) {
+		if v, found := q[k]; found {
+			signed[k] = v
+		}
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + path + "\n" + signed.Encode() + "\n" + ip))
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,97 @@
+package signedurl
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDriver(t *testing.T, bindIP bool) *SignedURL {
+	h := NewDriver()
+	h.Keys = map[string]string{
+		"old": base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", 32))),
+		"new": base64.StdEncoding.EncodeToString([]byte(strings.Repeat("n", 32))),
+	}
+	h.SignedQuery = []string{"file"}
+	h.BindIP = bindIP
+
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func TestSignedURL(t *testing.T) {
+	h := newTestDriver(t, false)
+	u, _ := url.Parse("https://example.com/download?file=report.pdf&utm=x")
+
+	for _, kid := range []string{"old", "new"} {
+		signed, err := h.Sign("GET", u, kid, time.Now().Add(time.Hour), "alice", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identity, err := h.AuthenticateIdentity(httptest.NewRequest("GET", signed.String(), nil))
+		if err != nil || identity == nil || identity.ID != "alice" {
+			t.Fatalf("%s: expected signed url to authenticate, got %+v, %v", kid, identity, err)
+		}
+
+		// Unsigned query keys may change, signed ones may not
+		q := signed.Query()
+		q.Set("utm", "y")
+		signed.RawQuery = q.Encode()
+		if identity, _ := h.AuthenticateIdentity(httptest.NewRequest("GET", signed.String(), nil)); identity == nil {
+			t.Errorf("%s: expected changing unsigned query to be allowed", kid)
+		}
+
+		q.Set("file", "secrets.pdf")
+		signed.RawQuery = q.Encode()
+		if identity, _ := h.AuthenticateIdentity(httptest.NewRequest("GET", signed.String(), nil)); identity != nil {
+			t.Errorf("%s: expected changing signed query to be rejected", kid)
+		}
+	}
+
+	signed, _ := h.Sign("GET", u, "new", time.Now().Add(time.Hour), "", "")
+	if identity, _ := h.AuthenticateIdentity(httptest.NewRequest("POST", signed.String(), nil)); identity != nil {
+		t.Error("expected different method to be rejected")
+	}
+
+	signed, _ = h.Sign("GET", u, "new", time.Now().Add(-time.Second), "", "")
+	if identity, _ := h.AuthenticateIdentity(httptest.NewRequest("GET", signed.String(), nil)); identity != nil {
+		t.Error("expected expired link to be rejected")
+	}
+
+	delete(h.keys, "old")
+	signed, _ = newTestDriver(t, false).Sign("GET", u, "old", time.Now().Add(time.Hour), "", "")
+	if identity, _ := h.AuthenticateIdentity(httptest.NewRequest("GET", signed.String(), nil)); identity != nil {
+		t.Error("expected link signed with a retired key to be rejected")
+	}
+}
+
+func TestSignedURLBindIP(t *testing.T) {
+	h := newTestDriver(t, true)
+	u, _ := url.Parse("https://example.com/download")
+
+	if _, err := h.Sign("GET", u, "new", time.Now().Add(time.Hour), "", ""); err == nil {
+		t.Fatal("expected an error signing without an ip")
+	}
+
+	signed, err := h.Sign("GET", u, "new", time.Now().Add(time.Hour), "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", signed.String(), nil)
+	if identity, _ := h.AuthenticateIdentity(r); identity == nil || identity.ID != defaultUser {
+		t.Errorf("expected link to work from the bound ip, got %+v", identity)
+	}
+
+	r.RemoteAddr = "192.0.2.2:1234"
+	if identity, _ := h.AuthenticateIdentity(r); identity != nil {
+		t.Error("expected link to be rejected from another ip")
+	}
+}
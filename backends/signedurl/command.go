@@ -0,0 +1,102 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package signedurl
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "reauth-sign-url",
+		Func:  cmdSignURL,
+		Usage: "--url <url> --key-id <id> [--key <base64>] [--method <method>] [--expires <duration>] [--user <name>] [--ip <address>] [--signed-query <keys>]",
+		Short: "Mints a signed link for the signedurl backend",
+		Long: `
+Signs the URL so the signedurl backend will accept it until it expires and
+writes the signed URL to stdout.
+
+The key must match the one configured for the key id, it can be given with
+--key or via the REAUTH_SIGNEDURL_KEY environment variable to keep it out of
+the process list. --signed-query must list the same query keys as the
+configuration. Giving --ip binds the link to that client address, which
+requires bind_ip in the configuration.
+`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("reauth-sign-url", flag.ExitOnError)
+			fs.String("url", "", "The URL to sign")
+			fs.String("key-id", "", "The id of the key to sign with")
+			fs.String("key", "", "The base64 encoded key")
+			fs.String("method", "GET", "The HTTP method the link is for")
+			fs.Duration("expires", 24*time.Hour, "How long the link is valid for")
+			fs.String("user", "", "The user the link is for")
+			fs.String("ip", "", "The client IP to bind the link to")
+			fs.String("signed-query", "", "Comma separated query keys to include in the signature")
+			return fs
+		}(),
+	})
+}
+
+func cmdSignURL(fs caddycmd.Flags) (int, error) {
+	u, err := url.Parse(fs.String("url"))
+	if err != nil || fs.String("url") == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("a valid url is required")
+	}
+
+	kid := fs.String("key-id")
+	key := fs.String("key")
+	if key == "" {
+		key = os.Getenv("REAUTH_SIGNEDURL_KEY")
+	}
+
+	h := NewDriver()
+	h.Keys = map[string]string{kid: key}
+	h.BindIP = fs.String("ip") != ""
+
+	if sq := fs.String("signed-query"); sq != "" {
+		h.SignedQuery = strings.Split(sq, ",")
+	}
+
+	if err := h.Validate(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	signed, err := h.Sign(fs.String("method"), u, kid, time.Now().Add(fs.Duration("expires")), fs.String("user"), fs.String("ip"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Println(signed.String())
+
+	return caddy.ExitCodeSuccess, nil
+}
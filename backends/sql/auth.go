@@ -0,0 +1,265 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Interface guards
+var (
+	_ backends.IdentityDriver = (*SQL)(nil)
+	_ caddy.Provisioner       = (*SQL)(nil)
+	_ caddy.CleanerUpper      = (*SQL)(nil)
+)
+
+// BackendName name
+const BackendName = "sql"
+
+const defaultTimeout = 5 * time.Second
+const defaultGroupsColumn = "groups"
+
+// SQL backend provides authentication against users kept in a database.
+//
+// Query is run with the username as its only parameter (use the placeholder
+// syntax of the driver, eg ? or $1) and must return the password hash as the
+// first column. Any further columns are added to the user's metadata by
+// column name, the column named by GroupsColumn is treated as a comma
+// separated list of groups.
+//
+// Example: SELECT password, groups, email FROM users WHERE username = ?
+type SQL struct {
+	Driver          string             `json:"driver,omitempty"`
+	DSN             string             `json:"dsn,omitempty"`
+	Query           string             `json:"query,omitempty"`
+	GroupsColumn    string             `json:"groups_column,omitempty"`
+	Timeout         jsontypes.Duration `json:"timeout,omitempty"`
+	MaxOpenConns    int                `json:"max_open_conns,omitempty"`
+	MaxIdleConns    int                `json:"max_idle_conns,omitempty"`
+	ConnMaxLifetime jsontypes.Duration `json:"conn_max_lifetime,omitempty"`
+
+	db   *sql.DB
+	stmt *sql.Stmt
+}
+
+// NewDriver returns a new instance of SQL with some defaults
+func NewDriver() *SQL {
+	return &SQL{
+		Timeout:      jsontypes.Duration{Duration: defaultTimeout},
+		GroupsColumn: defaultGroupsColumn,
+	}
+}
+
+// Validate verifies that this module is functional with the given configuration
+func (h *SQL) Validate() error {
+	var missing []string
+	if h.Driver == "" {
+		missing = append(missing, "driver")
+	}
+
+	if h.DSN == "" {
+		missing = append(missing, "dsn")
+	}
+
+	if h.Query == "" {
+		missing = append(missing, "query")
+	}
+
+	if n := len(missing); n > 0 {
+		var s string
+		if n > 1 {
+			s = "s"
+		}
+		return errors.New("missing the following required parameter" + s + ": " + strings.Join(missing, ", "))
+	}
+
+	if !isRegistered(h.Driver) {
+		return fmt.Errorf("unknown driver %q, available drivers: %s", h.Driver, strings.Join(sql.Drivers(), ", "))
+	}
+
+	if h.Timeout.Duration <= 0 {
+		return errors.New("timeout must be greater than 0")
+	}
+
+	if h.MaxOpenConns < 0 || h.MaxIdleConns < 0 || h.ConnMaxLifetime.Duration < 0 {
+		return errors.New("connection pool settings must not be negative")
+	}
+
+	return nil
+}
+
+// Provision opens the database and prepares the query
+func (h *SQL) Provision(ctx caddy.Context) error {
+	db, err := sql.Open(h.Driver, h.DSN)
+	if err != nil {
+		return fmt.Errorf("unable to open database: %v", err)
+	}
+
+	if h.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(h.MaxOpenConns)
+	}
+
+	if h.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(h.MaxIdleConns)
+	}
+
+	db.SetConnMaxLifetime(h.ConnMaxLifetime.Duration)
+
+	pctx, cancel := context.WithTimeout(ctx, h.Timeout.Duration)
+	defer cancel()
+
+	stmt, err := db.PrepareContext(pctx, h.Query)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("unable to prepare query: %v", err)
+	}
+
+	h.db, h.stmt = db, stmt
+
+	return nil
+}
+
+// Cleanup closes the database
+func (h *SQL) Cleanup() error {
+	if h.db == nil {
+		return nil
+	}
+
+	h.stmt.Close()
+	return h.db.Close()
+}
+
+// Authenticate fulfils the backend interface
+func (h *SQL) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *SQL) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	un, pw, k := r.BasicAuth()
+	if !k {
+		return nil, nil
+	}
+
+	if h.stmt == nil {
+		return nil, errors.New("sql has not been provisioned")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout.Duration)
+	defer cancel()
+
+	rows, err := h.stmt.QueryContext(ctx, un)
+	if err != nil {
+		return nil, fmt.Errorf("query for %q: %v", un, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	if err := rows.Scan(dest...); err != nil {
+		return nil, fmt.Errorf("scan for %q: %v", un, err)
+	}
+
+	if rows.Next() {
+		return nil, errors.New("too many rows returned")
+	}
+
+	if !values[0].Valid || values[0].String == "" {
+		return nil, nil
+	}
+
+	ok, err := comparePassword(values[0].String, pw)
+	if !ok {
+		return nil, err
+	}
+
+	return h.identity(un, columns[1:], values[1:]), nil
+}
+
+func (h *SQL) identity(un string, columns []string, values []sql.NullString) *backends.Identity {
+	identity := &backends.Identity{ID: un}
+	if len(columns) == 0 {
+		return identity
+	}
+
+	identity.Metadata = map[string]string{}
+	for i, column := range columns {
+		if !values[i].Valid {
+			continue
+		}
+
+		if strings.EqualFold(column, h.GroupsColumn) {
+			var groups []string
+			for _, g := range strings.Split(values[i].String, ",") {
+				if g = strings.TrimSpace(g); g != "" {
+					groups = append(groups, g)
+				}
+			}
+			identity.Metadata["groups"] = strings.Join(groups, ",")
+			continue
+		}
+
+		identity.Metadata[strings.ToLower(column)] = values[i].String
+	}
+
+	return identity
+}
+
+func isRegistered(driver string) bool {
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+//go:build cgo
+// +build cgo
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+func testHashes(t *testing.T, password string) map[string]string {
+	bc, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt := []byte("saltsaltsaltsalt")
+	b64 := base64.RawStdEncoding.EncodeToString
+
+	sc, err := scrypt.Key([]byte(password), salt, 1<<10, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]string{
+		"bcrypt": string(bc),
+		"argon2": "$argon2id$v=19$m=1024,t=1,p=1$" + b64(salt) + "$" + b64(argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)),
+		"scrypt": "$scrypt$ln=10,r=8,p=1$" + b64(salt) + "$" + b64(sc),
+	}
+}
+
+func newTestDriver(t *testing.T) *SQL {
+	dir, err := ioutil.TempDir("", "reauth-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dsn := filepath.Join(dir, "users.db")
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE users (username TEXT PRIMARY KEY, password TEXT, groups TEXT, email TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, hash := range testHashes(t, "password") {
+		if _, err := db.Exec(`INSERT INTO users VALUES (?, ?, ?, ?)`, name, hash, "admins, users", name+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewDriver()
+	h.Driver = "sqlite3"
+	h.DSN = dsn
+	h.Query = "SELECT password, groups, email AS Email FROM users WHERE username = ?"
+	h.MaxOpenConns = 2
+
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Cleanup() })
+
+	return h
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := newTestDriver(t)
+
+	for _, user := range []string{"bcrypt", "argon2", "scrypt"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(user, "password")
+
+		identity, err := h.AuthenticateIdentity(r)
+		if err != nil || identity == nil {
+			t.Fatalf("%s: expected to be authenticated, got %+v, %v", user, identity, err)
+		}
+
+		if identity.Metadata["groups"] != "admins,users" {
+			t.Errorf("%s: expected groups admins,users got %q", user, identity.Metadata["groups"])
+		}
+
+		if identity.Metadata["email"] != user+"@example.com" {
+			t.Errorf("%s: expected email metadata, got %q", user, identity.Metadata["email"])
+		}
+
+		r.SetBasicAuth(user, "wrong")
+		if identity, err := h.AuthenticateIdentity(r); err != nil || identity != nil {
+			t.Errorf("%s: expected wrong password to be rejected, got %+v, %v", user, identity, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("nobody", "password")
+	if identity, err := h.AuthenticateIdentity(r); err != nil || identity != nil {
+		t.Errorf("expected unknown user to be rejected, got %+v, %v", identity, err)
+	}
+}
+
+func TestIdentityColumns(t *testing.T) {
+	tests := []struct {
+		name         string
+		groupsColumn string
+		columns      []string
+		expected     map[string]string
+	}{
+		{name: "default", groupsColumn: "groups", columns: []string{"groups", "email"}, expected: map[string]string{"groups": "admins,users", "email": "alice@example.com"}},
+		{name: "upper case column", groupsColumn: "groups", columns: []string{"GROUPS", "Email"}, expected: map[string]string{"groups": "admins,users", "email": "alice@example.com"}},
+		{name: "upper case option", groupsColumn: "Roles", columns: []string{"roles", "email"}, expected: map[string]string{"groups": "admins,users", "email": "alice@example.com"}},
+		{name: "other column", groupsColumn: "roles", columns: []string{"groups", "email"}, expected: map[string]string{"groups": " admins, users", "email": "alice@example.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.GroupsColumn = test.groupsColumn
+
+			identity := h.identity("alice", test.columns, []sql.NullString{{String: " admins, users", Valid: true}, {String: "alice@example.com", Valid: true}})
+			if !reflect.DeepEqual(identity.Metadata, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, identity.Metadata)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	h := NewDriver()
+	h.Driver = "nope"
+	h.DSN = "x"
+	h.Query = "SELECT 1"
+
+	if err := h.Validate(); err == nil {
+		t.Error("expected unknown driver to fail validation")
+	}
+}
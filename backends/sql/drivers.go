@@ -0,0 +1,6 @@
+package sql
+
+import (
+	// Drivers available to the sql backend
+	_ "github.com/go-sql-driver/mysql"
+)
@@ -0,0 +1,9 @@
+//go:build cgo
+// +build cgo
+
+package sql
+
+import (
+	// SQLite requires cgo
+	_ "github.com/mattn/go-sqlite3"
+)
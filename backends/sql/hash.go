@@ -0,0 +1,154 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package sql
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var errUnknownHash = errors.New("unrecognised password hash format")
+
+// minKeySize guards against truncated hashes, an empty one matches anything
+const minKeySize = 16
+
+// comparePassword checks the password against the hash, which is expected to
+// be in one of the following formats
+//
+//	bcrypt: $2a$10$... (also $2b$ and $2y$)
+//	argon2: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash> (also $argon2i$)
+//	scrypt: $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//
+// Salts and hashes in the argon2 and scrypt formats are base64 encoded
+// without padding as per the PHC string format.
+func comparePassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2"):
+		return compareArgon2(hash, password)
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return compareScrypt(hash, password)
+	}
+
+	return false, errUnknownHash
+}
+
+// phc splits a PHC formatted string into its id, parameters, salt and hash
+func phc(hash string, n int) ([]string, map[string]int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != n+1 || parts[0] != "" {
+		return nil, nil, nil, nil, errUnknownHash
+	}
+
+	params := map[string]int{}
+	for _, kv := range strings.Split(parts[n-2], ",") {
+		eq := strings.IndexByte(kv, '=')
+		if eq < 0 {
+			return nil, nil, nil, nil, fmt.Errorf("invalid hash parameter %q", kv)
+		}
+
+		v, err := strconv.Atoi(kv[eq+1:])
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("invalid hash parameter %q", kv)
+		}
+		params[kv[:eq]] = v
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[n-1])
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("invalid salt: %v", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[n])
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("invalid hash: %v", err)
+	}
+
+	if len(key) < minKeySize {
+		return nil, nil, nil, nil, fmt.Errorf("hash must be at least %d bytes", minKeySize)
+	}
+
+	return parts[1 : n-2], params, salt, key, nil
+}
+
+func compareArgon2(hash, password string) (bool, error) {
+	head, params, salt, key, err := phc(hash, 5)
+	if err != nil {
+		return false, err
+	}
+
+	if head[1] != "v="+strconv.Itoa(argon2.Version) {
+		return false, fmt.Errorf("unsupported argon2 version %q", head[1])
+	}
+
+	m, t, p := params["m"], params["t"], params["p"]
+	if m <= 0 || t <= 0 || p <= 0 || p > 255 {
+		return false, errors.New("invalid argon2 parameters")
+	}
+
+	var derived []byte
+	switch head[0] {
+	case "argon2id":
+		derived = argon2.IDKey([]byte(password), salt, uint32(t), uint32(m), uint8(p), uint32(len(key)))
+	case "argon2i":
+		derived = argon2.Key([]byte(password), salt, uint32(t), uint32(m), uint8(p), uint32(len(key)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant %q", head[0])
+	}
+
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+func compareScrypt(hash, password string) (bool, error) {
+	_, params, salt, key, err := phc(hash, 4)
+	if err != nil {
+		return false, err
+	}
+
+	ln, r, p := params["ln"], params["r"], params["p"]
+	if ln <= 0 || ln > 30 || r <= 0 || p <= 0 {
+		return false, errors.New("invalid scrypt parameters")
+	}
+
+	derived, err := scrypt.Key([]byte(password), salt, 1<<uint(ln), r, p, len(key))
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
@@ -0,0 +1,51 @@
+package sql
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestComparePassword(t *testing.T) {
+	salt := []byte("saltsaltsaltsalt")
+	b64 := base64.RawStdEncoding.EncodeToString
+
+	sc, err := scrypt.Key([]byte("password"), salt, 1<<10, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		ok   bool
+		err  bool
+	}{
+		{name: "argon2id", hash: "$argon2id$v=19$m=1024,t=1,p=1$" + b64(salt) + "$" + b64(argon2.IDKey([]byte("password"), salt, 1, 1024, 1, 32)), ok: true},
+		{name: "argon2i", hash: "$argon2i$v=19$m=1024,t=1,p=1$" + b64(salt) + "$" + b64(argon2.Key([]byte("password"), salt, 1, 1024, 1, 32)), ok: true},
+		{name: "argon2 mismatch", hash: "$argon2id$v=19$m=1024,t=1,p=1$" + b64(salt) + "$" + b64(argon2.IDKey([]byte("other"), salt, 1, 1024, 1, 32))},
+		{name: "argon2 empty key", hash: "$argon2id$v=19$m=1024,t=1,p=1$" + b64(salt) + "$", err: true},
+		{name: "argon2 short key", hash: "$argon2id$v=19$m=1024,t=1,p=1$" + b64(salt) + "$" + b64(argon2.IDKey([]byte("password"), salt, 1, 1024, 1, 8)), err: true},
+		{name: "argon2 version", hash: "$argon2id$v=16$m=1024,t=1,p=1$" + b64(salt) + "$" + b64(argon2.IDKey([]byte("password"), salt, 1, 1024, 1, 32)), err: true},
+		{name: "scrypt", hash: "$scrypt$ln=10,r=8,p=1$" + b64(salt) + "$" + b64(sc), ok: true},
+		{name: "scrypt empty key", hash: "$scrypt$ln=10,r=8,p=1$" + b64(salt) + "$", err: true},
+		{name: "scrypt short key", hash: "$scrypt$ln=10,r=8,p=1$" + b64(salt) + "$" + b64(sc[:8]), err: true},
+		{name: "scrypt parameters", hash: "$scrypt$ln=31,r=8,p=1$" + b64(salt) + "$" + b64(sc), err: true},
+		{name: "unknown", hash: "password", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := comparePassword(test.hash, "password")
+			if test.err != (err != nil) {
+				t.Fatalf("expected error to be %v, got %v", test.err, err)
+			}
+
+			if ok != test.ok {
+				t.Errorf("expected match to be %v, got %v", test.ok, ok)
+			}
+		})
+	}
+}
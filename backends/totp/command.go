@@ -0,0 +1,104 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package totp
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "reauth-totp-enroll",
+		Func:  cmdEnroll,
+		Usage: "--user <username> [--issuer <name>] [--secrets-file <path>] [--algorithm <name>] [--digits <n>] [--period <duration>]",
+		Short: "Generates a TOTP secret and otpauth URI for a user",
+		Long: `
+Generates a new random TOTP secret for the user and writes the otpauth URI,
+suitable for turning into a QR code for an authenticator app, to stdout.
+
+If --secrets-file is given the secret is added to that file, replacing any
+existing secret for the user. Otherwise the secret should be stored in Caddy's
+storage under the configured storage prefix followed by the username.
+
+The algorithm, digits and period must match the reauth configuration.
+`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("reauth-totp-enroll", flag.ExitOnError)
+			fs.String("user", "", "The username to enroll")
+			fs.String("issuer", "", "The issuer shown in authenticator apps")
+			fs.String("secrets-file", "", "The secrets file to add the user to")
+			fs.String("algorithm", defaultAlgorithm, "The HMAC algorithm (SHA1, SHA256 or SHA512)")
+			fs.Int("digits", defaultDigits, "The number of digits in a code")
+			fs.Duration("period", defaultPeriod, "How long each code is valid")
+			return fs
+		}(),
+	})
+}
+
+func cmdEnroll(fs caddycmd.Flags) (int, error) {
+	user := fs.String("user")
+	if user == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("user is required")
+	}
+
+	h := New()
+	h.SecretsFile = fs.String("secrets-file")
+	h.Algorithm = fs.String("algorithm")
+	h.Digits = fs.Int("digits")
+	h.Period = jsontypes.Duration{Duration: fs.Duration("period")}
+
+	if err := h.Validate(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if h.SecretsFile != "" {
+		secrets := map[string]string{}
+		if _, err := os.Stat(h.SecretsFile); err == nil {
+			if secrets, err = ReadSecretsFile(h.SecretsFile); err != nil {
+				return caddy.ExitCodeFailedStartup, err
+			}
+		}
+
+		secrets[user] = secret
+		if err := WriteSecretsFile(h.SecretsFile, secrets); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	fmt.Println(h.KeyURI(fs.String("issuer"), user, secret))
+
+	return caddy.ExitCodeSuccess, nil
+}
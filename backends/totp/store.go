@@ -0,0 +1,238 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package totp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+type secretStore interface {
+	// Secret returns the decoded secret for the user, or nil if the
+	// user hasn't enrolled.
+	Secret(user string) ([]byte, error)
+
+	// LastUsed returns the last time step a code was accepted for the
+	// user, found is false if none has been.
+	LastUsed(user string) (step uint64, found bool, err error)
+
+	// SetLastUsed records the time step a code was accepted for the user.
+	SetLastUsed(user string, step uint64) error
+}
+
+// fileStore reads secrets from a JSON file, reloading it when it changes.
+// The last used time steps are kept in a second file next to it.
+type fileStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	secrets map[string]string
+	used    map[string]uint64
+}
+
+func (s *fileStore) Secret(user string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read totp secrets: %v", err)
+	}
+
+	if s.secrets == nil || !fi.ModTime().Equal(s.modTime) {
+		secrets, err := ReadSecretsFile(s.path)
+		if err != nil {
+			return nil, err
+		}
+		s.secrets, s.modTime = secrets, fi.ModTime()
+	}
+
+	secret, found := s.secrets[user]
+	if !found {
+		return nil, nil
+	}
+
+	return DecodeSecret(secret)
+}
+
+func (s *fileStore) LastUsed(user string) (uint64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.loadUsed(); err != nil {
+		return 0, false, err
+	}
+
+	step, found := s.used[user]
+	return step, found, nil
+}
+
+func (s *fileStore) SetLastUsed(user string, step uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.loadUsed(); err != nil {
+		return err
+	}
+
+	s.used[user] = step
+
+	data, err := json.Marshal(s.used)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(s.path+".used", data); err != nil {
+		return fmt.Errorf("unable to write totp last used steps: %v", err)
+	}
+
+	return nil
+}
+
+// loadUsed reads the last used time steps the first time they're needed,
+// after that they're only ever changed by us.
+func (s *fileStore) loadUsed() error {
+	if s.used != nil {
+		return nil
+	}
+
+	used := map[string]uint64{}
+
+	data, err := ioutil.ReadFile(s.path + ".used")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read totp last used steps: %v", err)
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &used); err != nil {
+			return fmt.Errorf("unable to parse totp last used steps: %v", err)
+		}
+	}
+
+	s.used = used
+	return nil
+}
+
+// storageStore reads secrets from Caddy's storage, one key per user.
+type storageStore struct {
+	storage certmagic.Storage
+	prefix  string
+}
+
+func (s *storageStore) Secret(user string) ([]byte, error) {
+	data, err := s.storage.Load(StorageKey(s.prefix, user))
+	if err != nil {
+		if _, ok := err.(certmagic.ErrNotExist); ok {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to load totp secret: %v", err)
+	}
+
+	return DecodeSecret(string(data))
+}
+
+func (s *storageStore) LastUsed(user string) (uint64, bool, error) {
+	data, err := s.storage.Load(usedKey(s.prefix, user))
+	if err != nil {
+		if _, ok := err.(certmagic.ErrNotExist); ok {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("unable to load totp last used step: %v", err)
+	}
+
+	step, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to parse totp last used step: %v", err)
+	}
+
+	return step, true, nil
+}
+
+func (s *storageStore) SetLastUsed(user string, step uint64) error {
+	if err := s.storage.Store(usedKey(s.prefix, user), []byte(strconv.FormatUint(step, 10))); err != nil {
+		return fmt.Errorf("unable to store totp last used step: %v", err)
+	}
+	return nil
+}
+
+// usedKey is kept out of the prefix so it can't collide with a username
+func usedKey(prefix, user string) string {
+	return StorageKey(prefix+".used", user)
+}
+
+// StorageKey returns the key the secret for the user is kept under in storage
+func StorageKey(prefix, user string) string {
+	return path.Join(prefix, url.PathEscape(user))
+}
+
+// ReadSecretsFile reads a JSON object of usernames to base32 secrets
+func ReadSecretsFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read totp secrets: %v", err)
+	}
+
+	secrets := map[string]string{}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return secrets, nil
+	}
+
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("unable to parse totp secrets: %v", err)
+	}
+
+	return secrets, nil
+}
+
+// WriteSecretsFile replaces the secrets file with the given secrets
+func WriteSecretsFile(file string, secrets map[string]string) error {
+	data, err := json.MarshalIndent(secrets, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(file, data)
+}
+
+// writeFile replaces the file in one step so it's never seen half written
+func writeFile(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
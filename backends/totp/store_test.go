@@ -0,0 +1,114 @@
+package totp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reauth-totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "secrets.json")
+	if err := WriteSecretsFile(file, map[string]string{"alice": "GEZDGNBVGY3TQOJQ"}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &certmagic.FileStorage{Path: filepath.Join(dir, "storage")}
+	if err := storage.Store(StorageKey(defaultStoragePrefix, "alice"), []byte("GEZDGNBVGY3TQOJQ")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		store func() secretStore
+	}{
+		{name: "file", store: func() secretStore { return &fileStore{path: file} }},
+		{name: "storage", store: func() secretStore { return &storageStore{storage: storage, prefix: defaultStoragePrefix} }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := test.store()
+
+			if secret, err := s.Secret("alice"); err != nil || string(secret) != "1234567890" {
+				t.Errorf("expected alice's secret, got %q, %v", secret, err)
+			}
+
+			if secret, err := s.Secret("bob"); err != nil || secret != nil {
+				t.Errorf("expected no secret for bob, got %q, %v", secret, err)
+			}
+
+			if _, found, err := s.LastUsed("alice"); err != nil || found {
+				t.Errorf("expected no last used step, got %v, %v", found, err)
+			}
+
+			if err := s.SetLastUsed("alice", 42); err != nil {
+				t.Fatal(err)
+			}
+
+			// A new store sees the step, as it would after a reload
+			if step, found, err := test.store().LastUsed("alice"); err != nil || !found || step != 42 {
+				t.Errorf("expected the last used step to be kept, got %d, %v, %v", step, found, err)
+			}
+
+			if _, found, err := s.LastUsed("bob"); err != nil || found {
+				t.Errorf("expected no last used step for bob, got %v, %v", found, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reauth-totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "secrets.json")
+	if err := WriteSecretsFile(file, map[string]string{"alice": "GEZDGNBVGY3TQOJQ"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fileStore{path: file}
+	if secret, err := s.Secret("bob"); err != nil || secret != nil {
+		t.Fatalf("expected no secret for bob, got %q, %v", secret, err)
+	}
+
+	if err := WriteSecretsFile(file, map[string]string{"bob": "GEZDGNBVGY3TQOJQ"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the change is seen on file systems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if secret, err := s.Secret("bob"); err != nil || string(secret) != "1234567890" {
+		t.Errorf("expected the file to be reloaded, got %q, %v", secret, err)
+	}
+
+	secrets, err := ReadSecretsFile(file)
+	if err != nil || !reflect.DeepEqual(secrets, map[string]string{"bob": "GEZDGNBVGY3TQOJQ"}) {
+		t.Errorf("expected the written secrets back, got %v, %v", secrets, err)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Secret("bob"); err == nil {
+		t.Error("expected an error once the file is gone")
+	}
+}
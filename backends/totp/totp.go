@@ -0,0 +1,349 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package totp provides a time based one time password (RFC 6238) layer that
+// can be wrapped around any password backend.
+package totp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+const defaultSeparator = "+"
+const defaultDigits = 6
+const defaultPeriod = 30 * time.Second
+const defaultSkew = 1
+const defaultAlgorithm = "SHA1"
+const defaultStoragePrefix = "reauth/totp"
+const defaultChallengeMessage = "Enter your one time password"
+
+const maxFormSize = 1 << 20
+
+// TOTP layers a second factor over a backend. The one time password is taken
+// from the configured header or form field, falling back to the end of the
+// password separated by Separator (eg password+123456). The remainder of the
+// password is passed on to the backend and, if it accepts it, the one time
+// password is checked against the secret enrolled for the user.
+//
+// Secrets are read from SecretsFile, a JSON object of username to base32
+// secret, or from Caddy's storage under StoragePrefix when no file is given.
+// The time step of the last code accepted for each user is kept alongside
+// them, in SecretsFile.used or under StoragePrefix.used, so a code can't be
+// replayed after a reload or restart.
+//
+// The layer only works with backends that take a username and password, a
+// request without basic auth credentials is refused rather than passed on as
+// the backend would otherwise authenticate it without a second factor.
+//
+// A missing one time password is refused like a wrong one unless Challenge is
+// set, in which case the client is asked for it. Asking tells whoever is
+// trying that the password was right, so only enable it where that's worth
+// the convenience.
+type TOTP struct {
+	SecretsFile     string             `json:"secrets_file,omitempty"`
+	StoragePrefix   string             `json:"storage_prefix,omitempty"`
+	Header          string             `json:"header,omitempty"`
+	FormField       string             `json:"form_field,omitempty"`
+	Separator       string             `json:"separator"`
+	Digits          int                `json:"digits,omitempty"`
+	Period          jsontypes.Duration `json:"period,omitempty"`
+	Skew            int                `json:"skew"`
+	Algorithm       string             `json:"algorithm,omitempty"`
+	AllowUnenrolled bool               `json:"allow_unenrolled,omitempty"`
+	Challenge       bool               `json:"challenge,omitempty"`
+
+	secrets secretStore
+	mu      *sync.Mutex
+}
+
+// New returns a TOTP instance with some defaults
+func New() *TOTP {
+	return &TOTP{
+		StoragePrefix: defaultStoragePrefix,
+		Separator:     defaultSeparator,
+		Digits:        defaultDigits,
+		Period:        jsontypes.Duration{Duration: defaultPeriod},
+		Skew:          defaultSkew,
+		Algorithm:     defaultAlgorithm,
+	}
+}
+
+// UnmarshalJSON unpacks configuration over the defaults
+func (h *TOTP) UnmarshalJSON(data []byte) error {
+	type undecorated TOTP
+	config := (*undecorated)(New())
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return err
+	}
+
+	*h = TOTP(*config)
+	return nil
+}
+
+// Validate verifies that this layer is functional with the given configuration
+func (h *TOTP) Validate() error {
+	if h.Digits < 6 || h.Digits > 10 {
+		return errors.New("digits must be between 6 and 10")
+	}
+
+	if h.Period.Duration < time.Second {
+		return errors.New("period must be at least 1s")
+	}
+
+	if h.Skew < 0 {
+		return errors.New("skew must not be negative")
+	}
+
+	if _, err := hashFor(h.Algorithm); err != nil {
+		return err
+	}
+
+	if h.SecretsFile == "" && h.StoragePrefix == "" {
+		return errors.New("either secrets_file or storage_prefix is required")
+	}
+
+	return nil
+}
+
+// Provision sets up the secret store
+func (h *TOTP) Provision(ctx caddy.Context) error {
+	if h.SecretsFile != "" {
+		h.secrets = &fileStore{path: h.SecretsFile}
+	} else {
+		h.secrets = &storageStore{storage: ctx.Storage(), prefix: h.StoragePrefix}
+	}
+
+	h.mu = &sync.Mutex{}
+
+	return nil
+}
+
+// Authenticate splits the one time password from the request, passes the
+// remainder to next and, if next authenticates the user, verifies the one
+// time password.
+func (h *TOTP) Authenticate(r *http.Request, next func(r *http.Request) (*backends.Identity, error)) (*backends.Identity, error) {
+	un, pw, k := r.BasicAuth()
+	if !k {
+		return nil, nil
+	}
+
+	if h.secrets == nil {
+		return nil, errors.New("totp has not been provisioned")
+	}
+
+	pw, code, err := h.split(r, pw)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := r.Clone(r.Context())
+	inner.SetBasicAuth(un, pw)
+
+	identity, err := next(inner)
+	if identity == nil || err != nil {
+		return identity, err
+	}
+
+	secret, err := h.secrets.Secret(un)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		if h.AllowUnenrolled {
+			return identity, nil
+		}
+		return nil, nil
+	}
+
+	if code == "" {
+		if !h.Challenge {
+			return nil, nil
+		}
+		return nil, &backends.Rejection{Reason: backends.ReasonChallenge, Message: defaultChallengeMessage}
+	}
+
+	ok, err := h.verify(un, secret, code, time.Now())
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// split separates the one time password from the password, preferring the
+// header and form field if configured.
+func (h *TOTP) split(r *http.Request, pw string) (string, string, error) {
+	if h.Header != "" {
+		if code := r.Header.Get(h.Header); code != "" {
+			return pw, code, nil
+		}
+	}
+
+	if h.FormField != "" {
+		code, err := formValue(r, h.FormField)
+		if err != nil {
+			return "", "", err
+		}
+		if code != "" {
+			return pw, code, nil
+		}
+	}
+
+	n := len(pw) - h.Digits - len(h.Separator)
+	if n < 0 || !strings.HasSuffix(pw[:n+len(h.Separator)], h.Separator) || !isDigits(pw[n+len(h.Separator):]) {
+		return pw, "", nil
+	}
+
+	return pw[:n], pw[n+len(h.Separator):], nil
+}
+
+// formValue reads a value from the query or urlencoded body, restoring the
+// body afterwards so it can still be passed on.
+func formValue(r *http.Request, field string) (string, error) {
+	if v := r.URL.Query().Get(field); v != "" {
+		return v, nil
+	}
+
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return "", nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormSize))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return "", fmt.Errorf("unable to read form: %v", err)
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", nil
+	}
+
+	return form.Get(field), nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// verify checks the code against the secret within the allowed skew and
+// records the time step it was accepted for so it can't be replayed.
+func (h *TOTP) verify(un string, secret []byte, code string, now time.Time) (bool, error) {
+	if len(code) != h.Digits {
+		return false, nil
+	}
+
+	counter := uint64(now.Unix()) / uint64(h.Period.Duration/time.Second)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	last, seen, err := h.secrets.LastUsed(un)
+	if err != nil {
+		return false, err
+	}
+
+	for i := -h.Skew; i <= h.Skew; i++ {
+		c := counter + uint64(i)
+		if seen && c <= last {
+			continue
+		}
+
+		if hmac.Equal([]byte(h.code(secret, c)), []byte(code)) {
+			return true, h.secrets.SetLastUsed(un, c)
+		}
+	}
+
+	return false, nil
+}
+
+// code calculates the HOTP value (RFC 4226) for the counter
+func (h *TOTP) code(secret []byte, counter uint64) string {
+	fn, _ := hashFor(h.Algorithm)
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(fn, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	mod := uint64(1)
+	for i := 0; i < h.Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", h.Digits, value%mod)
+}
+
+func hashFor(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToUpper(algorithm) {
+	case "SHA1":
+		return sha1.New, nil
+	case "SHA256":
+		return sha256.New, nil
+	case "SHA512":
+		return sha512.New, nil
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+}
+
+// DecodeSecret decodes a base32 secret as found in otpauth URIs, padding is
+// optional and spaces are ignored.
+func DecodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Replace(strings.TrimSpace(s), " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,314 @@
+package totp
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/backends"
+)
+
+type memoryStore struct {
+	secrets map[string][]byte
+	used    map[string]uint64
+}
+
+func (s *memoryStore) Secret(user string) ([]byte, error) {
+	return s.secrets[user], nil
+}
+
+func (s *memoryStore) LastUsed(user string) (uint64, bool, error) {
+	step, found := s.used[user]
+	return step, found, nil
+}
+
+func (s *memoryStore) SetLastUsed(user string, step uint64) error {
+	s.used[user] = step
+	return nil
+}
+
+// RFC 6238 appendix B test vectors
+func TestCode(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		secret    string
+		time      int64
+		code      string
+	}{
+		{"SHA1", "12345678901234567890", 59, "94287082"},
+		{"SHA1", "12345678901234567890", 1111111109, "07081804"},
+		{"SHA256", "12345678901234567890123456789012", 1234567890, "91819424"},
+		{"SHA512", "1234567890123456789012345678901234567890123456789012345678901234", 2000000000, "38618901"},
+	}
+
+	for _, test := range tests {
+		h := New()
+		h.Algorithm = test.algorithm
+		h.Digits = 8
+
+		if code := h.code([]byte(test.secret), uint64(test.time)/30); code != test.code {
+			t.Errorf("%s at %d: expected %s got %s", test.algorithm, test.time, test.code, code)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	h := New()
+	h.secrets = &memoryStore{secrets: map[string][]byte{"alice": secret}, used: map[string]uint64{}}
+	h.mu = &sync.Mutex{}
+
+	next := func(r *http.Request) (*backends.Identity, error) {
+		un, pw, _ := r.BasicAuth()
+		if pw != "pass+word" {
+			return nil, nil
+		}
+		return &backends.Identity{ID: un}, nil
+	}
+
+	request := func(un, pw string) (*backends.Identity, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(un, pw)
+		return h.Authenticate(r, next)
+	}
+
+	code := h.code(secret, uint64(time.Now().Unix())/30)
+
+	anyone := func(r *http.Request) (*backends.Identity, error) {
+		return &backends.Identity{ID: "alice"}, nil
+	}
+
+	if identity, err := h.Authenticate(httptest.NewRequest("GET", "/", nil), anyone); err != nil || identity != nil {
+		t.Fatalf("expected a request without credentials to be rejected, got %+v, %v", identity, err)
+	}
+
+	if identity, err := request("alice", "pass+word+"+code); err != nil || identity == nil {
+		t.Fatalf("expected alice to be authenticated, got %+v, %v", identity, err)
+	}
+
+	if identity, err := request("alice", "pass+word+"+code); err != nil || identity != nil {
+		t.Fatalf("expected replayed code to be rejected, got %+v, %v", identity, err)
+	}
+
+	if identity, err := request("alice", "wrong+"+code); err != nil || identity != nil {
+		t.Fatalf("expected wrong password to be rejected, got %+v, %v", identity, err)
+	}
+
+	// A missing code is refused the same as a wrong password
+	if identity, err := request("alice", "pass+word"); err != nil || identity != nil {
+		t.Fatalf("expected a missing code to be rejected, got %+v, %v", identity, err)
+	}
+
+	h.Challenge = true
+
+	var rejection *backends.Rejection
+	if _, err := request("alice", "pass+word"); !errors.As(err, &rejection) || rejection.Reason != backends.ReasonChallenge {
+		t.Fatalf("expected a challenge for a missing code, got %v", err)
+	}
+
+	if identity, err := request("alice", "wrong"); err != nil || identity != nil {
+		t.Fatalf("expected no challenge for a wrong password, got %+v, %v", identity, err)
+	}
+
+	if identity, err := request("bob", "pass+word+123456"); err != nil || identity != nil {
+		t.Fatalf("expected unenrolled user to be rejected, got %+v, %v", identity, err)
+	}
+
+	h.AllowUnenrolled = true
+	if identity, err := request("bob", "pass+word"); err != nil || identity == nil {
+		t.Fatalf("expected unenrolled user to be allowed, got %+v, %v", identity, err)
+	}
+}
+
+func TestCodeSources(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		formField string
+		request   func() *http.Request
+		password  string
+		remainder string
+		code      string
+		body      string
+	}{
+		{
+			name:      "separator",
+			request:   func() *http.Request { return httptest.NewRequest("GET", "/", nil) },
+			password:  "pass+word+123456",
+			remainder: "pass+word",
+			code:      "123456",
+		},
+		{
+			name:   "header",
+			header: "X-OTP",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("X-OTP", "654321")
+				return r
+			},
+			password:  "pass+word+123456",
+			remainder: "pass+word+123456",
+			code:      "654321",
+		},
+		{
+			name:      "missing header",
+			header:    "X-OTP",
+			request:   func() *http.Request { return httptest.NewRequest("GET", "/", nil) },
+			password:  "pass+word+123456",
+			remainder: "pass+word",
+			code:      "123456",
+		},
+		{
+			name:      "query",
+			formField: "otp",
+			request:   func() *http.Request { return httptest.NewRequest("GET", "/?otp=654321", nil) },
+			password:  "pass+word",
+			remainder: "pass+word",
+			code:      "654321",
+		},
+		{
+			name:      "form body",
+			formField: "otp",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "/", strings.NewReader("user=alice&otp=654321"))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return r
+			},
+			password:  "pass+word",
+			remainder: "pass+word",
+			code:      "654321",
+			body:      "user=alice&otp=654321",
+		},
+		{
+			name:      "other content type",
+			formField: "otp",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "/", strings.NewReader("otp=654321"))
+				r.Header.Set("Content-Type", "text/plain")
+				return r
+			},
+			password:  "pass+word+123456",
+			remainder: "pass+word",
+			code:      "123456",
+			body:      "otp=654321",
+		},
+		{
+			name:      "header before form",
+			header:    "X-OTP",
+			formField: "otp",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/?otp=111111", nil)
+				r.Header.Set("X-OTP", "654321")
+				return r
+			},
+			password:  "pass+word",
+			remainder: "pass+word",
+			code:      "654321",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := New()
+			h.Header = test.header
+			h.FormField = test.formField
+
+			r := test.request()
+
+			pw, code, err := h.split(r, test.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pw != test.remainder || code != test.code {
+				t.Errorf("expected %q and %q, got %q and %q", test.remainder, test.code, pw, code)
+			}
+
+			if test.body == "" {
+				return
+			}
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil || string(body) != test.body {
+				t.Errorf("expected the body to be restored, got %q, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestReplayAfterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reauth-totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "secrets.json")
+	if err := WriteSecretsFile(file, map[string]string{"alice": "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"}); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(r *http.Request) (*backends.Identity, error) {
+		return &backends.Identity{ID: "alice"}, nil
+	}
+
+	code := New().code([]byte("12345678901234567890"), uint64(time.Now().Unix())/30)
+
+	for i, expected := range []bool{true, false} {
+		h := New()
+		h.SecretsFile = file
+
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+
+		if err := h.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("alice", "password+"+code)
+
+		identity, err := h.Authenticate(r, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected != (identity != nil) {
+			t.Errorf("provision %d: expected authenticated to be %v, got %+v", i, expected, identity)
+		}
+	}
+}
+
+func TestKeyURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := DecodeSecret(secret)
+	if err != nil || len(raw) != secretSize {
+		t.Fatalf("expected %d byte secret, got %d, %v", secretSize, len(raw), err)
+	}
+
+	h := New()
+	uri := h.KeyURI("Example", "alice", "JBSWY3DPEHPK3PXP")
+	expected := "otpauth://totp/Example:alice?algorithm=SHA1&digits=6&issuer=Example&period=30&secret=JBSWY3DPEHPK3PXP"
+	if uri != expected {
+		t.Errorf("expected %s got %s", expected, uri)
+	}
+
+	if _, err := DecodeSecret(base32.StdEncoding.EncodeToString([]byte("padded"))); err != nil {
+		t.Errorf("expected padded secret to decode, got %v", err)
+	}
+}
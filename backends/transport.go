@@ -0,0 +1,68 @@
+package backends
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+const defaultMaxIdleConns = 100
+const defaultMaxIdleConnsPerHost = 16
+const defaultIdleConnTimeout = 90 * time.Second
+
+// Transport tunes the connection pool of backends that make HTTP requests.
+// The transport is built once when the backend is provisioned and shared
+// by every request so connections are kept alive between them.
+type Transport struct {
+	MaxIdleConns        int                `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int                `json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout     jsontypes.Duration `json:"idle_conn_timeout,omitempty"`
+	DisableHTTP2        bool               `json:"disable_http2,omitempty"`
+}
+
+// NewTransport returns Transport settings with some defaults
+func NewTransport() Transport {
+	return Transport{
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     jsontypes.Duration{Duration: defaultIdleConnTimeout},
+	}
+}
+
+// Validate verifies the settings are usable
+func (t Transport) Validate() error {
+	if t.MaxIdleConns < 0 || t.MaxIdleConnsPerHost < 0 || t.IdleConnTimeout.Duration < 0 {
+		return errors.New("transport settings must not be negative")
+	}
+	return nil
+}
+
+// New builds an http.Transport with these settings and the given TLS
+// configuration, which may be nil.
+func (t Transport) New(tlsConfig *tls.Config) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     !t.DisableHTTP2,
+		MaxIdleConns:          t.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		IdleConnTimeout:       t.IdleConnTimeout.Duration,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if t.DisableHTTP2 {
+		// A non-nil empty map is how HTTP/2 is turned off
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport
+}
@@ -0,0 +1,53 @@
+package backends
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func get(b *testing.B, client *http.Client, url string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		b.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// BenchmarkSharedTransport is how the http backends make requests, with one
+// transport built when they're provisioned.
+func BenchmarkSharedTransport(b *testing.B) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	transport := NewTransport().New(&tls.Config{InsecureSkipVerify: true})
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		get(b, client, srv.URL)
+	}
+}
+
+// BenchmarkClientPerRequest is how the upstream and gitlabci backends used to
+// make requests, with a new client and transport every time.
+func BenchmarkClientPerRequest(b *testing.B) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		get(b, &http.Client{Transport: transport}, srv.URL)
+
+		// The old transports were left to be collected, closing them keeps
+		// the benchmark from running out of file descriptors
+		transport.CloseIdleConnections()
+	}
+}
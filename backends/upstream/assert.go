@@ -0,0 +1,177 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package upstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Assertion is a check made against the body of the upstream response.
+//
+// JSONPath selects a value from a JSON body using a simple subset of JSONPath
+// ($, .key, ['key'] and [index]). If Equals is given the value must be equal
+// to it, otherwise it must be present and not null, false, 0 or "".
+//
+// Regexp must match the body.
+type Assertion struct {
+	JSONPath string            `json:"json_path,omitempty"`
+	Equals   json.RawMessage   `json:"equals,omitempty"`
+	Regexp   *jsontypes.Regexp `json:"regexp,omitempty"`
+
+	path   []interface{}
+	equals interface{}
+}
+
+func (a *Assertion) validate() error {
+	if a.JSONPath == "" && a.Regexp == nil {
+		return errors.New("either json_path or regexp is required")
+	}
+
+	if a.JSONPath != "" {
+		path, err := parseJSONPath(a.JSONPath)
+		if err != nil {
+			return err
+		}
+		a.path = path
+	}
+
+	if len(a.Equals) > 0 {
+		if a.JSONPath == "" {
+			return errors.New("equals requires json_path")
+		}
+		if err := json.Unmarshal(a.Equals, &a.equals); err != nil {
+			return fmt.Errorf("equals: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Assertion) check(body []byte, doc interface{}) bool {
+	if a.Regexp != nil && !a.Regexp.Match(body) {
+		return false
+	}
+
+	if a.path == nil {
+		return true
+	}
+
+	v, found := lookup(doc, a.path)
+	if !found {
+		return false
+	}
+
+	if len(a.Equals) > 0 {
+		return reflect.DeepEqual(v, a.equals)
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	}
+
+	return true
+}
+
+// parseJSONPath turns a path into a list of keys (strings) and indexes (ints)
+func parseJSONPath(p string) ([]interface{}, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("json path %q must start with $", p)
+	}
+
+	path := []interface{}{}
+	for rest := p[1:]; rest != ""; {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("json path %q has an empty key", p)
+			}
+			path = append(path, rest[1:end+1])
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q has an unterminated key", p)
+			}
+			path = append(path, rest[2:end])
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q has an unterminated index", p)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("json path %q has an invalid index", p)
+			}
+			path = append(path, n)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("json path %q is invalid at %q", p, rest)
+		}
+	}
+
+	return path, nil
+}
+
+func lookup(doc interface{}, path []interface{}) (interface{}, bool) {
+	for _, step := range path {
+		switch s := step.(type) {
+		case string:
+			m, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = m[s]; !ok {
+				return nil, false
+			}
+		case int:
+			l, ok := doc.([]interface{})
+			if !ok || s >= len(l) {
+				return nil, false
+			}
+			doc = l[s]
+		}
+	}
+
+	return doc, true
+}
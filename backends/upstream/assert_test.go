@@ -0,0 +1,326 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []interface{}
+		ok       bool
+	}{
+		{path: "$", expected: []interface{}{}, ok: true},
+		{path: "$.ok", expected: []interface{}{"ok"}, ok: true},
+		{path: "$.user.name", expected: []interface{}{"user", "name"}, ok: true},
+		{path: "$.groups[1]", expected: []interface{}{"groups", 1}, ok: true},
+		{path: "$.users[0].roles[2]", expected: []interface{}{"users", 0, "roles", 2}, ok: true},
+		{path: "$['odd.key'].value", expected: []interface{}{"odd.key", "value"}, ok: true},
+		{path: "$[0]['a']", expected: []interface{}{0, "a"}, ok: true},
+		{path: "ok"},
+		{path: ".ok"},
+		{path: "$ok"},
+		{path: "$..ok"},
+		{path: "$.ok."},
+		{path: "$['ok"},
+		{path: "$[1"},
+		{path: "$[x]"},
+		{path: "$[-1]"},
+		{path: "$[]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			path, err := parseJSONPath(test.path)
+			if !test.ok {
+				if err == nil {
+					t.Errorf("expected an error, got %v", path)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(path, test.expected) {
+				t.Errorf("expected %#v, got %#v", test.expected, path)
+			}
+		})
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	const body = `{
+		"ok": true,
+		"disabled": false,
+		"count": 3,
+		"zero": 0,
+		"name": "alice",
+		"empty": "",
+		"nothing": null,
+		"odd.key": {"value": 1},
+		"groups": ["users", "admins"],
+		"users": [{"name": "alice", "roles": ["read"]}, {"name": "bob"}]
+	}`
+
+	tests := []struct {
+		name      string
+		assertion Assertion
+		body      string
+		ok        bool
+	}{
+		{name: "true", assertion: Assertion{JSONPath: "$.ok"}, ok: true},
+		{name: "false", assertion: Assertion{JSONPath: "$.disabled"}},
+		{name: "number", assertion: Assertion{JSONPath: "$.count"}, ok: true},
+		{name: "zero", assertion: Assertion{JSONPath: "$.zero"}},
+		{name: "string", assertion: Assertion{JSONPath: "$.name"}, ok: true},
+		{name: "empty string", assertion: Assertion{JSONPath: "$.empty"}},
+		{name: "null", assertion: Assertion{JSONPath: "$.nothing"}},
+		{name: "object", assertion: Assertion{JSONPath: "$['odd.key']"}, ok: true},
+		{name: "missing key", assertion: Assertion{JSONPath: "$.missing"}},
+		{name: "missing nested key", assertion: Assertion{JSONPath: "$.name.first"}},
+		{name: "array", assertion: Assertion{JSONPath: "$.groups[1]", Equals: json.RawMessage(`"admins"`)}, ok: true},
+		{name: "array of objects", assertion: Assertion{JSONPath: "$.users[0].roles[0]", Equals: json.RawMessage(`"read"`)}, ok: true},
+		{name: "index out of range", assertion: Assertion{JSONPath: "$.groups[2]"}},
+		{name: "index into object", assertion: Assertion{JSONPath: "$.ok[0]"}},
+		{name: "key of array", assertion: Assertion{JSONPath: "$.groups.users"}},
+		{name: "missing key in array", assertion: Assertion{JSONPath: "$.users[1].roles"}},
+		{name: "equals string", assertion: Assertion{JSONPath: "$.name", Equals: json.RawMessage(`"alice"`)}, ok: true},
+		{name: "not equals string", assertion: Assertion{JSONPath: "$.name", Equals: json.RawMessage(`"bob"`)}},
+		{name: "equals number", assertion: Assertion{JSONPath: "$.count", Equals: json.RawMessage(`3`)}, ok: true},
+		{name: "equals false", assertion: Assertion{JSONPath: "$.disabled", Equals: json.RawMessage(`false`)}, ok: true},
+		{name: "equals null", assertion: Assertion{JSONPath: "$.nothing", Equals: json.RawMessage(`null`)}, ok: true},
+		{name: "not equals null", assertion: Assertion{JSONPath: "$.name", Equals: json.RawMessage(`null`)}},
+		{name: "equals missing", assertion: Assertion{JSONPath: "$.missing", Equals: json.RawMessage(`null`)}},
+		{name: "equals array", assertion: Assertion{JSONPath: "$.groups", Equals: json.RawMessage(`["users","admins"]`)}, ok: true},
+		{name: "equals object", assertion: Assertion{JSONPath: "$['odd.key']", Equals: json.RawMessage(`{"value":1}`)}, ok: true},
+		{name: "regexp", assertion: Assertion{Regexp: testRegexp(t, `"name":\s*"alice"`)}, ok: true},
+		{name: "regexp mismatch", assertion: Assertion{Regexp: testRegexp(t, `"name":\s*"carol"`)}},
+		{name: "regexp and path", assertion: Assertion{JSONPath: "$.ok", Regexp: testRegexp(t, `alice`)}, ok: true},
+		{name: "regexp but not path", assertion: Assertion{JSONPath: "$.disabled", Regexp: testRegexp(t, `alice`)}},
+		{name: "regexp on text", assertion: Assertion{Regexp: testRegexp(t, `^OK$`)}, body: "OK", ok: true},
+		{name: "path on text", assertion: Assertion{JSONPath: "$"}, body: "OK"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.assertion.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			b := body
+			if test.body != "" {
+				b = test.body
+			}
+
+			var doc interface{}
+			if json.Unmarshal([]byte(b), &doc) != nil {
+				doc = nil
+			}
+
+			if ok := test.assertion.check([]byte(b), doc); ok != test.ok {
+				t.Errorf("expected %v, got %v", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestValidateAssertions(t *testing.T) {
+	tests := []struct {
+		name      string
+		assertion *Assertion
+	}{
+		{name: "empty", assertion: &Assertion{}},
+		{name: "malformed path", assertion: &Assertion{JSONPath: "ok"}},
+		{name: "unterminated key", assertion: &Assertion{JSONPath: "$['ok"}},
+		{name: "invalid index", assertion: &Assertion{JSONPath: "$.groups[first]"}},
+		{name: "equals without path", assertion: &Assertion{Regexp: testRegexp(t, "ok"), Equals: json.RawMessage(`true`)}},
+		{name: "invalid equals", assertion: &Assertion{JSONPath: "$.ok", Equals: json.RawMessage(`{`)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.URL = &jsontypes.URL{}
+			if err := h.URL.Unmarshal("http://auth.example.com/"); err != nil {
+				t.Fatal(err)
+			}
+			h.Assertions = []*Assertion{test.assertion}
+
+			if err := h.Validate(); err == nil {
+				t.Error("expected validation to fail")
+			}
+		})
+	}
+}
+
+func TestRequestShape(t *testing.T) {
+	type received struct {
+		method      string
+		uri         string
+		contentType string
+		body        string
+	}
+
+	var got received
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = received{method: r.Method, uri: r.RequestURI, contentType: r.Header.Get("Content-Type"), body: string(body)}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		url         string
+		method      string
+		body        string
+		contentType string
+		accept      []int
+		status      int
+		expected    received
+		ok          bool
+	}{
+		{
+			name:     "default",
+			url:      "/auth",
+			status:   http.StatusOK,
+			expected: received{method: "GET", uri: "/auth"},
+			ok:       true,
+		},
+		{
+			name:     "default refuses no content",
+			url:      "/auth",
+			status:   http.StatusNoContent,
+			expected: received{method: "GET", uri: "/auth"},
+		},
+		{
+			name:        "json body",
+			url:         "/login",
+			method:      "POST",
+			body:        `{"username":"{reauth.username}","password":"{reauth.password}","path":"{test.path}","missing":"{test.missing}"}`,
+			contentType: "application/json",
+			accept:      []int{http.StatusOK, http.StatusNoContent},
+			status:      http.StatusNoContent,
+			expected: received{
+				method:      "POST",
+				uri:         "/login",
+				contentType: "application/json",
+				body:        `{"username":"al\"ice\\","password":"p\u0026ss\nword","path":"/a b","missing":"{test.missing}"}`,
+			},
+			ok: true,
+		},
+		{
+			name:        "form body",
+			url:         "/login",
+			method:      "PUT",
+			body:        "user={reauth.username}&pass={reauth.password}",
+			contentType: "application/x-www-form-urlencoded",
+			status:      http.StatusOK,
+			expected: received{
+				method:      "PUT",
+				uri:         "/login",
+				contentType: "application/x-www-form-urlencoded",
+				body:        "user=al%22ice%5C&pass=p%26ss%0Aword",
+			},
+			ok: true,
+		},
+		{
+			name:     "templated url",
+			url:      "/check?user={reauth.username}&path={test.path}",
+			status:   http.StatusOK,
+			expected: received{method: "GET", uri: "/check?user=al%22ice%5C&path=%2Fa+b"},
+			ok:       true,
+		},
+		{
+			name:     "status range",
+			url:      "/auth",
+			method:   "HEAD",
+			accept:   []int{http.StatusOK, http.StatusAccepted, http.StatusNoContent},
+			status:   http.StatusAccepted,
+			expected: received{method: "HEAD", uri: "/auth"},
+			ok:       true,
+		},
+		{
+			name:     "status outside range",
+			url:      "/auth",
+			accept:   []int{http.StatusNoContent},
+			status:   http.StatusOK,
+			expected: received{method: "GET", uri: "/auth"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.URL = &jsontypes.URL{}
+			if err := h.URL.Unmarshal(srv.URL + test.url); err != nil {
+				t.Fatal(err)
+			}
+			if test.method != "" {
+				h.Method = test.method
+			}
+			if test.accept != nil {
+				h.AcceptStatus = test.accept
+			}
+			h.Body = test.body
+			h.ContentType = test.contentType
+
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer h.Cleanup()
+
+			repl := caddy.NewReplacer()
+			repl.Set("test.path", "/a b")
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			r.SetBasicAuth(`al"ice\`, "p&ss\nword")
+
+			status = test.status
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.ok != (identity != nil) {
+				t.Errorf("expected authenticated to be %v, got %+v", test.ok, identity)
+			}
+
+			if got != test.expected {
+				t.Errorf("expected the upstream to receive %+v, got %+v", test.expected, got)
+			}
+
+			if _, found := repl.Get("reauth.password"); found {
+				t.Error("expected the credentials to be kept out of the replacer")
+			}
+		})
+	}
+}
+
+func testRegexp(t *testing.T, expr string) *jsontypes.Regexp {
+	r := &jsontypes.Regexp{}
+	if err := r.Unmarshal(expr); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
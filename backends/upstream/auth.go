@@ -25,40 +25,76 @@
 package upstream
 
 import (
-	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/freman/caddy2-reauth/backends"
 	"github.com/freman/caddy2-reauth/jsontypes"
 )
 
-// Interface guard
-var _ backends.Driver = (*Upstream)(nil)
+// Interface guards
+var (
+	_ backends.IdentityDriver = (*Upstream)(nil)
+	_ caddy.Provisioner       = (*Upstream)(nil)
+	_ caddy.CleanerUpper      = (*Upstream)(nil)
+	_ backends.Sanitizer      = (*Upstream)(nil)
+)
 
 // BackendName name
 const BackendName = "upstream"
 
 const defaultTimeout = time.Minute
+const defaultMethod = http.MethodGet
+const maxBodySize = 1 << 20
+
+var defaultAcceptStatus = []int{http.StatusOK}
 
 // Upstream backend provides authentication against an upstream http server.
-// If the upstream request returns a http 200 status code then the user
-// is considered logged in.
+// If the upstream request returns one of the AcceptStatus codes (by default
+// only 200) and satisfies all the Assertions then the user is considered
+// logged in.
+//
+// The URL and Body may contain Caddy placeholders such as
+// {http.request.uri}, and {reauth.username} and {reauth.password} for the
+// credentials given. Values are escaped for the query string and for the
+// Body according to its ContentType (JSON or form encoded).
+//
+// Forward auth services such as Authelia answer with the user and their
+// groups in response headers, UserHeader and GroupsHeader pick those up while
+// CopyHeaders are added to the user's metadata and set on the request passed
+// on. With RelayCookies any cookies set by the upstream are passed on to the
+// client.
 type Upstream struct {
-	URL                *jsontypes.URL     `json:"url,omitempty"`
-	Timeout            jsontypes.Duration `json:"timeout,omitempty"`
-	InsecureSkipVerify bool               `json:"insecure_skip_verify,omitempty"`
-	FollowRedirects    bool               `json:"follow_redirects,omitempty"`
-	PassCookies        bool               `json:"pass_cookies,omitempty"`
-	Match              *jsontypes.Regexp  `json:"match,omitempty"`
+	URL                *jsontypes.URL       `json:"url,omitempty"`
+	Timeout            jsontypes.Duration   `json:"timeout,omitempty"`
+	InsecureSkipVerify bool                 `json:"insecure_skip_verify,omitempty"`
+	TLSClient          *jsontypes.TLSClient `json:"tls_client,omitempty"`
+	FollowRedirects    bool                 `json:"follow_redirects,omitempty"`
+	PassCookies        bool                 `json:"pass_cookies,omitempty"`
+	Match              *jsontypes.Regexp    `json:"match,omitempty"`
+	UserHeader         string               `json:"user_header,omitempty"`
+	GroupsHeader       string               `json:"groups_header,omitempty"`
+	CopyHeaders        []string             `json:"copy_headers,omitempty"`
+	RelayCookies       bool                 `json:"relay_cookies,omitempty"`
+	Method             string               `json:"method,omitempty"`
+	Body               string               `json:"body,omitempty"`
+	ContentType        string               `json:"content_type,omitempty"`
+	AcceptStatus       []int                `json:"accept_status,omitempty"`
+	Assertions         []*Assertion         `json:"assertions,omitempty"`
+	Transport          backends.Transport   `json:"transport,omitempty"`
 
-	Forward struct {
-		URL     bool     `json:"url,omitempty"`
-		Method  bool     `json:"method,omitempty"`
-		IP      bool     `json:"ip,omitempty"`
-		Headers []string `json:"headers,omitempty"`
-	} `json:"forward"`
+	Forward Forward `json:"forward"`
+
+	client *http.Client
 }
 
 func noRedirectsPolicy(req *http.Request, via []*http.Request) error {
@@ -68,12 +104,16 @@ func noRedirectsPolicy(req *http.Request, via []*http.Request) error {
 // NewDriver returns a new instance of Upstream with some defaults
 func NewDriver() *Upstream {
 	return &Upstream{
-		Timeout: jsontypes.Duration{Duration: defaultTimeout},
+		Timeout:      jsontypes.Duration{Duration: defaultTimeout},
+		Method:       defaultMethod,
+		AcceptStatus: defaultAcceptStatus,
+		Transport:    backends.NewTransport(),
+		Forward:      NewForward(),
 	}
 }
 
 // Validate verifies that this module is functional with the given configuration
-func (h Upstream) Validate() error {
+func (h *Upstream) Validate() error {
 	if h.URL == nil {
 		return errors.New("url to auth against is a required parameter")
 	}
@@ -82,81 +122,282 @@ func (h Upstream) Validate() error {
 		return errors.New("timeout must be greater than 0")
 	}
 
-	return nil
+	if h.Method == "" {
+		return errors.New("method must not be empty")
+	}
+
+	if len(h.AcceptStatus) == 0 {
+		return errors.New("at least one accepted status is required")
+	}
+
+	for i, a := range h.Assertions {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("assertions[%d]: %v", i, err)
+		}
+	}
+
+	if err := h.Forward.validate(); err != nil {
+		return err
+	}
+
+	return h.Transport.Validate()
 }
 
-// Authenticate fulfils the backend interface
-func (h Upstream) Authenticate(r *http.Request) (string, error) {
-	un, pw, k := r.BasicAuth()
-	if !(k || h.PassCookies) {
-		return "", nil
+// Provision builds the client shared by all requests
+func (h *Upstream) Provision(ctx caddy.Context) error {
+	tlsConfig, err := h.TLSClient.ConfigSkipVerify(h.InsecureSkipVerify)
+	if err != nil {
+		return fmt.Errorf("tls client: %v", err)
 	}
 
-	c := &http.Client{
-		Timeout: h.Timeout.Duration,
+	h.client = &http.Client{
+		Timeout:   h.Timeout.Duration,
+		Transport: h.Transport.New(tlsConfig),
 	}
 
 	if !h.FollowRedirects {
-		c.CheckRedirect = noRedirectsPolicy
+		h.client.CheckRedirect = noRedirectsPolicy
 	}
 
-	if h.URL.Scheme == "https" && h.InsecureSkipVerify {
-		c.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	return nil
+}
+
+// Cleanup closes idle connections
+func (h *Upstream) Cleanup() error {
+	if h.client != nil {
+		h.client.CloseIdleConnections()
 	}
+	return nil
+}
 
-	req, err := http.NewRequest("GET", h.URL.String(), nil)
-	if err != nil {
+// Authenticate fulfils the backend interface
+func (h *Upstream) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
 		return "", err
 	}
 
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *Upstream) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	un, pw, k := r.BasicAuth()
+	if !(k || h.PassCookies) {
+		return nil, nil
+	}
+
+	if h.client == nil {
+		return nil, errors.New("upstream has not been provisioned")
+	}
+
+	req, err := h.newRequest(r, un, pw)
+	if err != nil {
+		return nil, err
+	}
+
 	if k {
 		req.SetBasicAuth(un, pw)
 	}
 
 	h.copyRequest(r, req)
 
-	resp, err := c.Do(req)
+	resp, err := h.client.Do(req.WithContext(r.Context()))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	resp.Body.Close()
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodySize))
+		resp.Body.Close()
+	}()
 
-	if resp.StatusCode != 200 {
-		return "", nil
+	if !h.accepted(resp.StatusCode) {
+		return nil, nil
 	}
 
 	if h.Match != nil && h.Match.MatchString(resp.Request.URL.String()) {
-		return "", nil
+		return nil, nil
+	}
+
+	if len(h.Assertions) > 0 {
+		ok, err := h.assert(resp)
+		if !ok {
+			return nil, err
+		}
 	}
 
-	return un, nil
+	return h.identity(un, resp), nil
 }
 
-func (h Upstream) copyRequest(org *http.Request, req *http.Request) {
-	if h.PassCookies {
-		for _, c := range org.Cookies() {
-			req.AddCookie(c)
+func (h *Upstream) newRequest(r *http.Request, un, pw string) (*http.Request, error) {
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if repl == nil {
+		repl = caddy.NewReplacer()
+	}
+
+	// The credentials are kept out of the request's replacer so they can't
+	// turn up in logs
+	vars := map[string]string{
+		"reauth.username": un,
+		"reauth.password": pw,
+	}
+
+	uri := replace(repl, vars, h.URL.Raw(), url.QueryEscape)
+
+	var body io.Reader
+	if h.Body != "" {
+		escape := func(s string) string { return s }
+		switch {
+		case strings.Contains(h.ContentType, "json"):
+			escape = jsonEscape
+		case strings.HasPrefix(h.ContentType, "application/x-www-form-urlencoded"):
+			escape = url.QueryEscape
 		}
+
+		body = strings.NewReader(replace(repl, vars, h.Body, escape))
 	}
 
-	if h.Forward.URL {
-		req.Header.Add("X-Auth-URL", org.RequestURI)
+	req, err := http.NewRequest(h.Method, uri, body)
+	if err != nil {
+		return nil, err
 	}
 
-	if h.Forward.Method {
-		req.Header.Add("X-Auth-Method", org.Method)
+	if h.ContentType != "" {
+		req.Header.Set("Content-Type", h.ContentType)
 	}
 
-	if h.Forward.IP {
-		req.Header.Add("X-Auth-IP", org.RemoteAddr)
+	return req, nil
+}
+
+func (h *Upstream) accepted(code int) bool {
+	for _, c := range h.AcceptStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Upstream) assert(resp *http.Response) (bool, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return false, err
+	}
+
+	var doc interface{}
+	if json.Unmarshal(body, &doc) != nil {
+		doc = nil
+	}
+
+	for _, a := range h.Assertions {
+		if !a.check(body, doc) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// placeholder matches Caddy placeholders but not the braces of JSON objects
+var placeholder = regexp.MustCompile(`\{[\w.\-:]+\}`)
+
+// replace expands the placeholders in the input from vars or the replacer,
+// escaping their values. Unknown placeholders are left as is.
+func replace(repl *caddy.Replacer, vars map[string]string, input string, escape func(string) string) string {
+	return placeholder.ReplaceAllStringFunc(input, func(match string) string {
+		key := match[1 : len(match)-1]
+		if v, found := vars[key]; found {
+			return escape(v)
+		}
+
+		val, found := repl.Get(key)
+		if !found {
+			return match
+		}
+		if val == nil {
+			return ""
+		}
+		return escape(fmt.Sprint(val))
+	})
+}
+
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// Sanitize clears the headers only the upstream may set
+func (h *Upstream) Sanitize(r *http.Request) {
+	for _, header := range h.clearedHeaders() {
+		r.Header.Del(header)
+	}
+}
+
+// clearedHeaders are the user, groups and copied headers
+func (h *Upstream) clearedHeaders() []string {
+	headers := append([]string{}, h.CopyHeaders...)
+	for _, header := range []string{h.UserHeader, h.GroupsHeader} {
+		if header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+func (h *Upstream) identity(un string, resp *http.Response) *backends.Identity {
+	identity := &backends.Identity{ID: un}
+
+	if h.UserHeader != "" {
+		identity.ID = resp.Header.Get(h.UserHeader)
+	}
+
+	if identity.ID == "" {
+		return nil
+	}
+
+	identity.Metadata = map[string]string{}
+	identity.RequestHeader = http.Header{}
+
+	if h.GroupsHeader != "" {
+		if groups := resp.Header.Get(h.GroupsHeader); groups != "" {
+			identity.Metadata["groups"] = groups
+		}
+	}
+
+	// Headers the upstream didn't answer with are still cleared from the
+	// request so the client can't supply them itself.
+	for _, header := range h.clearedHeaders() {
+		identity.RequestHeader[http.CanonicalHeaderKey(header)] = nil
+	}
+
+	for _, header := range h.CopyHeaders {
+		if v := resp.Header.Get(header); v != "" {
+			identity.Metadata[metadataKey(header)] = v
+			identity.RequestHeader.Set(header, v)
+		}
 	}
 
-	for _, header := range h.Forward.Headers {
-		if tmp := org.Header.Get(header); tmp != "" {
-			req.Header.Add("X-Auth-Header-"+header, tmp)
+	if h.RelayCookies {
+		if cookies := resp.Header["Set-Cookie"]; len(cookies) > 0 {
+			identity.ResponseHeader = http.Header{"Set-Cookie": cookies}
 		}
 	}
+
+	return identity
+}
+
+// metadataKey converts a header name into a snake cased metadata key
+func metadataKey(header string) string {
+	return strings.ToLower(strings.Replace(header, "-", "_", -1))
+}
+
+func (h *Upstream) copyRequest(org *http.Request, req *http.Request) {
+	if h.PassCookies {
+		for _, c := range org.Cookies() {
+			req.AddCookie(c)
+		}
+	}
+
+	h.Forward.apply(org, req)
 }
@@ -0,0 +1,255 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// forwardAuth answers like a forward auth service, naming the user and their
+// groups in response headers
+func forwardAuth(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie("session"); err != nil || c.Value != "valid" {
+		if un, pw, _ := r.BasicAuth(); un != "alice" || pw != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Remote-User", "alice")
+	w.Header().Set("Remote-Groups", "admins,users")
+	w.Header().Set("Remote-Email", "alice@example.com")
+	w.Header().Set("X-Internal-Token", "secret")
+	http.SetCookie(w, &http.Cookie{Name: "session", Value: "valid"})
+	http.SetCookie(w, &http.Cookie{Name: "refreshed", Value: "yes"})
+}
+
+func TestForwardAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(forwardAuth))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		userHeader   string
+		passCookies  bool
+		relayCookies bool
+		username     string
+		password     string
+		session      string
+		user         string
+		cookies      string
+	}{
+		{name: "basic auth", userHeader: "Remote-User", username: "alice", password: "password", user: "alice"},
+		{name: "refused", userHeader: "Remote-User", username: "bob", password: "password"},
+		{name: "missing user header", userHeader: "Remote-Missing", username: "alice", password: "password"},
+		{name: "without user header", username: "alice", password: "password", user: "alice"},
+		{name: "no credentials", userHeader: "Remote-User", passCookies: true, relayCookies: true},
+		{name: "session", userHeader: "Remote-User", passCookies: true, relayCookies: true, session: "valid", user: "alice", cookies: "refreshed=yes,session=valid"},
+		{name: "session not passed", userHeader: "Remote-User", session: "valid"},
+		{name: "cookies not relayed", userHeader: "Remote-User", passCookies: true, session: "valid", user: "alice"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.URL = &jsontypes.URL{}
+			if err := h.URL.Unmarshal(srv.URL + "/auth"); err != nil {
+				t.Fatal(err)
+			}
+			h.UserHeader = test.userHeader
+			h.PassCookies = test.passCookies
+			h.RelayCookies = test.relayCookies
+
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer h.Cleanup()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.username != "" {
+				r.SetBasicAuth(test.username, test.password)
+			}
+			if test.session != "" {
+				r.AddCookie(&http.Cookie{Name: "session", Value: test.session})
+			}
+
+			identity, err := h.AuthenticateIdentity(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.user == "" {
+				if identity != nil {
+					t.Errorf("expected to be refused, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil || identity.ID != test.user {
+				t.Fatalf("expected %q, got %+v", test.user, identity)
+			}
+
+			var cookies []string
+			for _, c := range (&http.Response{Header: identity.ResponseHeader}).Cookies() {
+				cookies = append(cookies, c.Name+"="+c.Value)
+			}
+			sort.Strings(cookies)
+
+			if relayed := strings.Join(cookies, ","); relayed != test.cookies {
+				t.Errorf("expected cookies %q to be relayed, got %q", test.cookies, relayed)
+			}
+		})
+	}
+}
+
+func TestUserHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(forwardAuth))
+	defer srv.Close()
+
+	h := NewDriver()
+	h.URL = &jsontypes.URL{}
+	if err := h.URL.Unmarshal(srv.URL + "/auth"); err != nil {
+		t.Fatal(err)
+	}
+	h.UserHeader = "Remote-User"
+	h.GroupsHeader = "Remote-Groups"
+	h.CopyHeaders = []string{"Remote-Email", "Remote-Name"}
+
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("alice", "password")
+
+	identity, err := h.AuthenticateIdentity(r)
+	if err != nil || identity == nil {
+		t.Fatalf("expected to authenticate, got %+v, %v", identity, err)
+	}
+
+	if identity.ID != "alice" || identity.Metadata["groups"] != "admins,users" || identity.Metadata["remote_email"] != "alice@example.com" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	if v := identity.RequestHeader.Get("Remote-Email"); v != "alice@example.com" {
+		t.Errorf("expected the copied header to be set on the request, got %q", v)
+	}
+
+	// Copies the client might have sent of headers the upstream didn't
+	// answer with, and of the user and groups headers, are cleared
+	for _, header := range []string{"Remote-Name", "Remote-User", "Remote-Groups"} {
+		if v, found := identity.RequestHeader[header]; !found || len(v) != 0 {
+			t.Errorf("expected %s to be cleared from the request, got %v, %v", header, v, found)
+		}
+	}
+
+	// Only the allow-listed headers are copied
+	if _, found := identity.RequestHeader["X-Internal-Token"]; found {
+		t.Error("expected headers that aren't listed not to be copied")
+	}
+
+	if _, found := identity.Metadata["x_internal_token"]; found {
+		t.Error("expected headers that aren't listed not to be added to the metadata")
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	h := NewDriver()
+	h.UserHeader = "Remote-User"
+	h.GroupsHeader = "Remote-Groups"
+	h.CopyHeaders = []string{"Remote-Email"}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, header := range []string{"Remote-User", "Remote-Groups", "Remote-Email", "X-Other"} {
+		r.Header.Set(header, "admin")
+	}
+
+	h.Sanitize(r)
+
+	for header, expected := range map[string]string{"Remote-User": "", "Remote-Groups": "", "Remote-Email": "", "X-Other": "admin"} {
+		if v := r.Header.Get(header); v != expected {
+			t.Errorf("expected %s to be %q, got %q", header, expected, v)
+		}
+	}
+}
+
+func TestInsecureSkipVerifyPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name   string
+		legacy bool
+		tls    *jsontypes.TLSClient
+		ok     bool
+	}{
+		{name: "legacy flag with pin", legacy: true, tls: &jsontypes.TLSClient{Pins: []string{pin}}, ok: true},
+		{name: "legacy flag with other pin", legacy: true, tls: &jsontypes.TLSClient{Pins: []string{other}}},
+		{name: "legacy flag", legacy: true, ok: true},
+		{name: "tls client with pin", tls: &jsontypes.TLSClient{Pins: []string{pin}, InsecureSkipVerify: true}, ok: true},
+		{name: "pin without skipping verification", tls: &jsontypes.TLSClient{Pins: []string{pin}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewDriver()
+			h.URL = &jsontypes.URL{}
+			if err := h.URL.Unmarshal(srv.URL); err != nil {
+				t.Fatal(err)
+			}
+			h.InsecureSkipVerify = test.legacy
+			h.TLSClient = test.tls
+
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer h.Cleanup()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth("bob", "password")
+
+			identity, err := h.AuthenticateIdentity(r)
+			if test.ok && (err != nil || identity == nil) {
+				t.Errorf("expected to authenticate, got %+v, %v", identity, err)
+			}
+
+			if !test.ok && err == nil {
+				t.Errorf("expected the handshake to fail, got %+v", identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Forward controls which details of the original request are passed to the
+// upstream and the headers they are passed in.
+//
+// When the request comes from one of the TrustedProxies the client IP,
+// scheme and host are taken from the headers named by Source, either the
+// RFC 7239 Forwarded header or the X-Forwarded-* headers (named as they are
+// sent on), never a mix of the two. The chain of proxies is walked from the
+// nearest, skipping trusted ones, and the first untrusted hop is the client.
+// The URI comes from the URIHeader of a trusted proxy. Otherwise these all
+// come from the request itself. Without any trusted proxies the IP header
+// carries the peer address as it always has.
+//
+// Standard sends the client IP, scheme, host, URI and method in the
+// X-Forwarded-* headers understood by most forward auth services.
+type Forward struct {
+	URL            bool              `json:"url,omitempty"`
+	Method         bool              `json:"method,omitempty"`
+	IP             bool              `json:"ip,omitempty"`
+	Standard       bool              `json:"standard,omitempty"`
+	Headers        []string          `json:"headers,omitempty"`
+	TrustedProxies []*jsontypes.CIDR `json:"trusted_proxies,omitempty"`
+	Source         string            `json:"source,omitempty"`
+
+	URLHeader    string `json:"url_header,omitempty"`
+	MethodHeader string `json:"method_header,omitempty"`
+	IPHeader     string `json:"ip_header,omitempty"`
+	HeaderPrefix string `json:"header_prefix,omitempty"`
+
+	ForHeader             string `json:"for_header,omitempty"`
+	ProtoHeader           string `json:"proto_header,omitempty"`
+	HostHeader            string `json:"host_header,omitempty"`
+	URIHeader             string `json:"uri_header,omitempty"`
+	ForwardedMethodHeader string `json:"forwarded_method_header,omitempty"`
+}
+
+// Headers trusted proxies forward the client's details in
+const (
+	SourceXForwarded = "x-forwarded"
+	SourceForwarded  = "forwarded"
+)
+
+// NewForward returns Forward settings with the default header names
+func NewForward() Forward {
+	return Forward{
+		URLHeader:             "X-Auth-URL",
+		MethodHeader:          "X-Auth-Method",
+		IPHeader:              "X-Auth-IP",
+		HeaderPrefix:          "X-Auth-Header-",
+		Source:                SourceXForwarded,
+		ForHeader:             "X-Forwarded-For",
+		ProtoHeader:           "X-Forwarded-Proto",
+		HostHeader:            "X-Forwarded-Host",
+		URIHeader:             "X-Forwarded-Uri",
+		ForwardedMethodHeader: "X-Forwarded-Method",
+	}
+}
+
+func (f Forward) validate() error {
+	for _, name := range []string{f.URLHeader, f.MethodHeader, f.IPHeader, f.ForHeader, f.ProtoHeader, f.HostHeader, f.URIHeader, f.ForwardedMethodHeader} {
+		if name == "" {
+			return errors.New("forward header names must not be empty")
+		}
+	}
+
+	switch f.Source {
+	case SourceXForwarded, SourceForwarded:
+	default:
+		return fmt.Errorf("unknown forward source %q, expected %s or %s", f.Source, SourceXForwarded, SourceForwarded)
+	}
+
+	return nil
+}
+
+func (f Forward) apply(org *http.Request, req *http.Request) {
+	trusted := len(f.TrustedProxies) > 0 && jsontypes.ContainsAddr(f.TrustedProxies, org.RemoteAddr)
+
+	if f.URL {
+		req.Header.Add(f.URLHeader, f.uri(org, trusted, org.RequestURI))
+	}
+
+	if f.Method {
+		req.Header.Add(f.MethodHeader, org.Method)
+	}
+
+	if f.IP {
+		if len(f.TrustedProxies) == 0 {
+			req.Header.Add(f.IPHeader, org.RemoteAddr)
+		} else {
+			req.Header.Add(f.IPHeader, f.clientIP(org, trusted))
+		}
+	}
+
+	if f.Standard {
+		req.Header.Set(f.ForHeader, f.clientIP(org, trusted))
+		req.Header.Set(f.ProtoHeader, f.scheme(org, trusted))
+		req.Header.Set(f.HostHeader, f.host(org, trusted))
+		req.Header.Set(f.URIHeader, f.uri(org, trusted, org.URL.RequestURI()))
+		req.Header.Set(f.ForwardedMethodHeader, org.Method)
+	}
+
+	for _, header := range f.Headers {
+		if tmp := org.Header.Get(header); tmp != "" {
+			req.Header.Add(f.HeaderPrefix+header, tmp)
+		}
+	}
+}
+
+// hop is a proxy's view of who it received the request from
+type hop struct {
+	addr  string
+	proto string
+	host  string
+}
+
+// client walks the chain of proxies from the nearest, returning the first
+// hop that isn't trusted, or the furthest if they all are. Requests from
+// untrusted peers have no hops worth believing.
+func (f Forward) client(r *http.Request, trusted bool) hop {
+	if !trusted {
+		return hop{}
+	}
+
+	hops := f.hops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !jsontypes.ContainsAddr(f.TrustedProxies, hops[i].addr) {
+			return hops[i]
+		}
+	}
+
+	if len(hops) > 0 {
+		return hops[0]
+	}
+
+	return hop{}
+}
+
+func (f Forward) hops(r *http.Request) []hop {
+	if f.Source == SourceForwarded {
+		var hops []hop
+		for _, element := range forwardedElements(r) {
+			hops = append(hops, hop{addr: stripPort(element["for"]), proto: element["proto"], host: element["host"]})
+		}
+		return hops
+	}
+
+	addrs := headerList(r, f.ForHeader)
+	protos := headerList(r, f.ProtoHeader)
+	hosts := headerList(r, f.HostHeader)
+
+	hops := make([]hop, len(addrs))
+	for i, addr := range addrs {
+		hops[i] = hop{addr: stripPort(addr), proto: aligned(protos, i, len(addrs)), host: aligned(hosts, i, len(addrs))}
+	}
+	return hops
+}
+
+// aligned returns the value for the i'th of n hops. Lists as long as the
+// chain line up with it, otherwise the value from the nearest proxy, which
+// likely replaced the header, applies to every hop.
+func aligned(values []string, i, n int) string {
+	switch {
+	case len(values) == n:
+		return values[i]
+	case len(values) > 0:
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+func (f Forward) clientIP(r *http.Request, trusted bool) string {
+	if addr := f.client(r, trusted).addr; addr != "" {
+		return addr
+	}
+
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	return peer
+}
+
+func (f Forward) scheme(r *http.Request, trusted bool) string {
+	if proto := f.client(r, trusted).proto; proto != "" {
+		return proto
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (f Forward) host(r *http.Request, trusted bool) string {
+	if host := f.client(r, trusted).host; host != "" {
+		return host
+	}
+
+	return r.Host
+}
+
+func (f Forward) uri(r *http.Request, trusted bool, fallback string) string {
+	if trusted {
+		if uri := r.Header.Get(f.URIHeader); uri != "" {
+			return uri
+		}
+	}
+
+	return fallback
+}
+
+// headerList splits the comma separated values of every line of the header
+func headerList(r *http.Request, name string) []string {
+	var values []string
+	for _, line := range r.Header.Values(name) {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// forwardedElements parses the RFC 7239 Forwarded header
+func forwardedElements(r *http.Request) []map[string]string {
+	var elements []map[string]string
+	for _, line := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(line, ",") {
+			params := map[string]string{}
+			for _, pair := range strings.Split(element, ";") {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:eq]))
+				params[key] = strings.Trim(strings.TrimSpace(pair[eq+1:]), `"`)
+			}
+			elements = append(elements, params)
+		}
+	}
+	return elements
+}
+
+// stripPort removes any port from an address, including the bracketed
+// IPv6 form used by the Forwarded header.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,189 @@
+package upstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestForward(t *testing.T, proxies string) Forward {
+	f := NewForward()
+	f.IP = true
+	f.Standard = true
+	if err := json.Unmarshal([]byte(proxies), &f.TrustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestForwardClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		remoteAddr string
+		header     http.Header
+		ip         string
+		proto      string
+		host       string
+	}{
+		{
+			name:       "untrusted peer ignores headers",
+			remoteAddr: "203.0.113.9:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https"}},
+			ip:         "203.0.113.9",
+			proto:      "http",
+			host:       "example.com",
+		},
+		{
+			name:       "trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"app.example.com"}},
+			ip:         "198.51.100.1",
+			proto:      "https",
+			host:       "app.example.com",
+		},
+		{
+			name:       "spoofed entries before the first untrusted hop are skipped",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.66, 198.51.100.1, 10.0.0.2"}},
+			ip:         "198.51.100.1",
+			proto:      "http",
+			host:       "example.com",
+		},
+		{
+			name:       "rfc 7239",
+			source:     SourceForwarded,
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https;host=app.example.com`}},
+			ip:         "2001:db8::1",
+			proto:      "https",
+			host:       "app.example.com",
+		},
+		{
+			name:       "spoofed forwarded alongside a trusted x-forwarded-for",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For": {"198.51.100.1"},
+				"Forwarded":       {"for=10.0.0.1;proto=https;host=admin.internal"},
+			},
+			ip:    "198.51.100.1",
+			proto: "http",
+			host:  "example.com",
+		},
+		{
+			name:       "spoofed x-forwarded alongside a trusted forwarded",
+			source:     SourceForwarded,
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Forwarded":         {"for=198.51.100.1"},
+				"X-Forwarded-For":   {"10.0.0.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"admin.internal"},
+			},
+			ip:    "198.51.100.1",
+			proto: "http",
+			host:  "example.com",
+		},
+		{
+			name:       "spoofed forwarded elements before the first untrusted hop are skipped",
+			source:     SourceForwarded,
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=10.0.0.1;proto=https;host=admin.internal, for=198.51.100.1;proto=https;host=app.example.com, for=10.0.0.2"}},
+			ip:         "198.51.100.1",
+			proto:      "https",
+			host:       "app.example.com",
+		},
+		{
+			name:       "proto appended by the trusted proxy wins",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https, http"}},
+			ip:         "198.51.100.1",
+			proto:      "http",
+			host:       "example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestForward(t, `["10.0.0.0/8"]`)
+			if test.source != "" {
+				f.Source = test.source
+			}
+
+			org := httptest.NewRequest("GET", "http://example.com/some/path?q=1", nil)
+			org.RemoteAddr = test.remoteAddr
+			org.Header = test.header
+
+			req := httptest.NewRequest("GET", "http://upstream/", nil)
+			f.apply(org, req)
+
+			if got := req.Header.Get("X-Auth-IP"); got != test.ip {
+				t.Errorf("X-Auth-IP: expected %q, got %q", test.ip, got)
+			}
+			if got := req.Header.Get("X-Forwarded-For"); got != test.ip {
+				t.Errorf("X-Forwarded-For: expected %q, got %q", test.ip, got)
+			}
+			if got := req.Header.Get("X-Forwarded-Proto"); got != test.proto {
+				t.Errorf("X-Forwarded-Proto: expected %q, got %q", test.proto, got)
+			}
+			if got := req.Header.Get("X-Forwarded-Host"); got != test.host {
+				t.Errorf("X-Forwarded-Host: expected %q, got %q", test.host, got)
+			}
+			if got := req.Header.Get("X-Forwarded-Uri"); got != "/some/path?q=1" {
+				t.Errorf("X-Forwarded-Uri: expected %q, got %q", "/some/path?q=1", got)
+			}
+		})
+	}
+}
+
+func TestForwardLegacyIP(t *testing.T) {
+	f := NewForward()
+	f.IP = true
+	f.IPHeader = "X-Real-IP"
+
+	org := httptest.NewRequest("GET", "/", nil)
+	org.RemoteAddr = "10.0.0.1:1234"
+	org.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	f.apply(org, req)
+
+	if got := req.Header.Get("X-Real-IP"); got != "10.0.0.1:1234" {
+		t.Errorf("expected the peer address without trusted proxies, got %q", got)
+	}
+}
+
+func TestForwardURIHeader(t *testing.T) {
+	f := newTestForward(t, `["10.0.0.0/8"]`)
+	f.URL = true
+	f.URIHeader = "X-Original-Uri"
+
+	org := httptest.NewRequest("GET", "http://example.com/local", nil)
+	org.RemoteAddr = "10.0.0.1:1234"
+	org.Header.Set("X-Original-Uri", "/original?q=1")
+	org.Header.Set("X-Forwarded-Uri", "/spoofed")
+
+	req := httptest.NewRequest("GET", "http://upstream/", nil)
+	f.apply(org, req)
+
+	if got := req.Header.Get("X-Original-Uri"); got != "/original?q=1" {
+		t.Errorf("X-Original-Uri: expected %q, got %q", "/original?q=1", got)
+	}
+
+	if got := req.Header.Get("X-Auth-URL"); got != "/original?q=1" {
+		t.Errorf("X-Auth-URL: expected %q, got %q", "/original?q=1", got)
+	}
+}
+
+func TestForwardValidate(t *testing.T) {
+	f := NewForward()
+	if err := f.validate(); err != nil {
+		t.Errorf("expected the defaults to validate, got %v", err)
+	}
+
+	f.Source = "x-real-ip"
+	if err := f.validate(); err == nil {
+		t.Error("expected an unknown source to be rejected")
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+// Interface guards
+var (
+	_ backends.IdentityDriver = (*Webhook)(nil)
+	_ caddy.Provisioner       = (*Webhook)(nil)
+	_ caddy.CleanerUpper      = (*Webhook)(nil)
+)
+
+// BackendName name
+const BackendName = "webhook"
+
+const defaultTimeout = 10 * time.Second
+const defaultMaxCacheTTL = 5 * time.Minute
+const defaultMaxCacheEntries = 1024
+const maxResponseSize = 64 << 10
+
+// Headers used to sign requests
+const (
+	TimestampHeader = "X-Reauth-Timestamp"
+	SignatureHeader = "X-Reauth-Signature"
+)
+
+// Webhook backend provides authentication by POSTing the credentials and some
+// details of the request as JSON to an endpoint, which answers with a JSON
+// Response.
+//
+// A 200 response is authenticated if it says so, 401 and 403 responses are
+// rejections and anything else is an error.
+//
+// When a SigningKey is configured requests carry the unix time in
+// X-Reauth-Timestamp and "sha256=" followed by the hex encoded HMAC-SHA256
+// of the timestamp, a full stop, and the body in X-Reauth-Signature.
+//
+// Responses may ask to be cached for up to MaxCacheTTL, cached responses are
+// keyed on the username, password and client IP.
+type Webhook struct {
+	URL                *jsontypes.URL       `json:"url,omitempty"`
+	Timeout            jsontypes.Duration   `json:"timeout,omitempty"`
+	InsecureSkipVerify bool                 `json:"insecure_skip_verify,omitempty"`
+	TLSClient          *jsontypes.TLSClient `json:"tls_client,omitempty"`
+	ForwardHeaders     []string             `json:"forward_headers,omitempty"`
+	SigningKey         string               `json:"signing_key,omitempty"`
+	MaxCacheTTL        jsontypes.Duration   `json:"max_cache_ttl,omitempty"`
+	MaxCacheEntries    int                  `json:"max_cache_entries,omitempty"`
+	Transport          backends.Transport   `json:"transport,omitempty"`
+
+	key    []byte
+	client *http.Client
+	cache  *cache
+}
+
+// Request is the document POSTed to the endpoint
+type Request struct {
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	ClientIP string            `json:"client_ip"`
+	Method   string            `json:"method"`
+	URI      string            `json:"uri"`
+	Host     string            `json:"host"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// Response is the document expected back from the endpoint, CacheTTL is in
+// seconds.
+type Response struct {
+	Authenticated bool              `json:"authenticated"`
+	User          string            `json:"user,omitempty"`
+	Groups        []string          `json:"groups,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	CacheTTL      int               `json:"cache_ttl,omitempty"`
+}
+
+// NewDriver returns a new instance of Webhook with some defaults
+func NewDriver() *Webhook {
+	return &Webhook{
+		Timeout:         jsontypes.Duration{Duration: defaultTimeout},
+		MaxCacheTTL:     jsontypes.Duration{Duration: defaultMaxCacheTTL},
+		MaxCacheEntries: defaultMaxCacheEntries,
+		Transport:       backends.NewTransport(),
+	}
+}
+
+// Validate verifies that this module is functional with the given configuration
+func (h *Webhook) Validate() error {
+	if h.URL == nil {
+		return errors.New("url to auth against is a required parameter")
+	}
+
+	if h.Timeout.Duration <= 0 {
+		return errors.New("timeout must be greater than 0")
+	}
+
+	if h.MaxCacheTTL.Duration < 0 || h.MaxCacheEntries < 0 {
+		return errors.New("cache settings must not be negative")
+	}
+
+	h.key = nil
+	if h.SigningKey != "" {
+		key, err := base64.StdEncoding.DecodeString(h.SigningKey)
+		if err != nil {
+			return fmt.Errorf("signing key is not valid base64: %v", err)
+		}
+		h.key = key
+	}
+
+	return h.Transport.Validate()
+}
+
+func noRedirectsPolicy(req *http.Request, via []*http.Request) error {
+	return errors.New("follow redirects disabled")
+}
+
+// Provision sets up the client and cache
+func (h *Webhook) Provision(ctx caddy.Context) error {
+	tlsConfig, err := h.TLSClient.ConfigSkipVerify(h.InsecureSkipVerify)
+	if err != nil {
+		return fmt.Errorf("tls client: %v", err)
+	}
+
+	h.client = &http.Client{
+		Timeout:       h.Timeout.Duration,
+		Transport:     h.Transport.New(tlsConfig),
+		CheckRedirect: noRedirectsPolicy,
+	}
+
+	h.cache = newCache(h.MaxCacheEntries)
+
+	return nil
+}
+
+// Cleanup closes idle connections
+func (h *Webhook) Cleanup() error {
+	if h.client != nil {
+		h.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Authenticate fulfils the backend interface
+func (h *Webhook) Authenticate(r *http.Request) (string, error) {
+	identity, err := h.AuthenticateIdentity(r)
+	if identity == nil {
+		return "", err
+	}
+
+	return identity.ID, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h *Webhook) AuthenticateIdentity(r *http.Request) (*backends.Identity, error) {
+	un, pw, k := r.BasicAuth()
+	if !k {
+		return nil, nil
+	}
+
+	if h.client == nil {
+		return nil, errors.New("webhook has not been provisioned")
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	cacheKey := h.cacheKey(un, pw, clientIP)
+	resp, found := h.cache.get(cacheKey)
+	if !found {
+		if resp, err = h.call(r, un, pw, clientIP); err != nil {
+			return nil, err
+		}
+
+		if ttl := time.Duration(resp.CacheTTL) * time.Second; ttl > 0 {
+			if ttl > h.MaxCacheTTL.Duration {
+				ttl = h.MaxCacheTTL.Duration
+			}
+			h.cache.set(cacheKey, resp, ttl)
+		}
+	}
+
+	if !resp.Authenticated {
+		return nil, nil
+	}
+
+	identity := &backends.Identity{ID: resp.User, Metadata: map[string]string{}}
+	if identity.ID == "" {
+		identity.ID = un
+	}
+
+	for k, v := range resp.Metadata {
+		identity.Metadata[k] = v
+	}
+
+	if len(resp.Groups) > 0 {
+		identity.Metadata["groups"] = strings.Join(resp.Groups, ",")
+	}
+
+	return identity, nil
+}
+
+func (h *Webhook) call(r *http.Request, un, pw, clientIP string) (*Response, error) {
+	doc := &Request{
+		Username: un,
+		Password: pw,
+		ClientIP: clientIP,
+		Method:   r.Method,
+		URI:      r.RequestURI,
+		Host:     r.Host,
+	}
+
+	for _, header := range h.ForwardHeaders {
+		if v := r.Header.Get(header); v != "" {
+			if doc.Headers == nil {
+				doc.Headers = map[string]string{}
+			}
+			doc.Headers[header] = v
+		}
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", h.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(r.Context())
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	if h.key != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(h.key, timestamp, body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+		resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &Response{}, nil
+	default:
+		return nil, fmt.Errorf("unexpected status code from webhook: %d (%s)", resp.StatusCode, resp.Status)
+	}
+
+	result := &Response{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(result); err != nil {
+		return nil, fmt.Errorf("invalid response from webhook: %v", err)
+	}
+
+	return result, nil
+}
+
+func (h *Webhook) cacheKey(un, pw, clientIP string) string {
+	sum := sha256.Sum256([]byte(un + "\x00" + pw + "\x00" + clientIP))
+	return string(sum[:])
+}
+
+// Sign returns the hex encoded signature for a request body sent at timestamp
+func Sign(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
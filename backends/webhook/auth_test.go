@@ -0,0 +1,316 @@
+package webhook
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/freman/caddy2-reauth/jsontypes"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+// testHook answers webhook requests by password, counting the calls
+type testHook struct {
+	calls   int32
+	release chan struct{}
+	srv     *httptest.Server
+	t       *testing.T
+}
+
+func newTestHook(t *testing.T) *testHook {
+	hook := &testHook{release: make(chan struct{}), t: t}
+	hook.srv = httptest.NewServer(http.HandlerFunc(hook.serve))
+	t.Cleanup(func() {
+		close(hook.release)
+		hook.srv.Close()
+	})
+	return hook
+}
+
+func (hook *testHook) serve(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&hook.calls, 1)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		hook.t.Error(err)
+		return
+	}
+
+	if signature := r.Header.Get(SignatureHeader); signature != "" {
+		if signature != "sha256="+Sign(testKey, r.Header.Get(TimestampHeader), body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch req.Password {
+	case "password":
+		fmt.Fprintf(w, `{"authenticated": true, "user": "alice", "groups": ["admins", "users"], "metadata": {"mail": "alice@example.com"}}`)
+	case "cached":
+		fmt.Fprintf(w, `{"authenticated": true, "cache_ttl": 60}`)
+	case "denied":
+		fmt.Fprintf(w, `{"authenticated": false, "cache_ttl": 60}`)
+	case "unauthorized":
+		w.WriteHeader(http.StatusUnauthorized)
+	case "forbidden":
+		w.WriteHeader(http.StatusForbidden)
+	case "broken":
+		w.WriteHeader(http.StatusBadGateway)
+	case "garbage":
+		fmt.Fprintf(w, `not json`)
+	case "slow":
+		select {
+		case <-hook.release:
+		case <-r.Context().Done():
+		}
+	default:
+		fmt.Fprintf(w, `{"authenticated": false}`)
+	}
+}
+
+func (hook *testHook) Calls() int {
+	return int(atomic.LoadInt32(&hook.calls))
+}
+
+func provision(t *testing.T, h *Webhook) {
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Cleanup() })
+}
+
+func testURL(t *testing.T, s string) *jsontypes.URL {
+	u := &jsontypes.URL{}
+	if err := u.Unmarshal(s); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestResponses(t *testing.T) {
+	hook := newTestHook(t)
+
+	h := NewDriver()
+	h.URL = testURL(t, hook.srv.URL)
+	h.Timeout = jsontypes.Duration{Duration: 200 * time.Millisecond}
+	provision(t, h)
+
+	tests := []struct {
+		password string
+		user     string
+		groups   string
+		mail     string
+		err      bool
+	}{
+		{password: "password", user: "alice", groups: "admins,users", mail: "alice@example.com"},
+		{password: "cached", user: "bob"},
+		{password: "wrong"},
+		{password: "unauthorized"},
+		{password: "forbidden"},
+		{password: "broken", err: true},
+		{password: "garbage", err: true},
+		{password: "slow", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.password, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth("bob", test.password)
+
+			identity, err := h.AuthenticateIdentity(r)
+			if test.err != (err != nil) {
+				t.Fatalf("expected error to be %v, got %v", test.err, err)
+			}
+
+			if test.user == "" {
+				if identity != nil {
+					t.Errorf("expected to be refused, got %+v", identity)
+				}
+				return
+			}
+
+			if identity == nil || identity.ID != test.user || identity.Metadata["groups"] != test.groups || identity.Metadata["mail"] != test.mail {
+				t.Errorf("expected %s with groups %q and mail %q, got %+v", test.user, test.groups, test.mail, identity)
+			}
+		})
+	}
+}
+
+func TestSigning(t *testing.T) {
+	var headers http.Header
+	var body []byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"authenticated": true}`)
+	}))
+	defer srv.Close()
+
+	// HMAC-SHA256 with the key "key" of "1.{}"
+	if sig := Sign([]byte("key"), "1", []byte("{}")); sig != "1ba6b8171186efc613e8bcc0cbdab2748f24984d7c5a84faa2637afa0e40d224" {
+		t.Errorf("expected the hmac of the timestamp and body, got %q", sig)
+	}
+
+	for _, key := range []string{base64.StdEncoding.EncodeToString(testKey), ""} {
+		h := NewDriver()
+		h.URL = testURL(t, srv.URL)
+		h.SigningKey = key
+		provision(t, h)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("bob", "password")
+
+		before := time.Now().Unix()
+		if user, err := h.Authenticate(r); err != nil || user != "bob" {
+			t.Fatalf("expected to authenticate, got %q, %v", user, err)
+		}
+
+		var req Request
+		if err := json.Unmarshal(body, &req); err != nil || req.Username != "bob" || req.Password != "password" {
+			t.Errorf("expected the credentials in the body, got %s", body)
+		}
+
+		if key == "" {
+			if headers.Get(SignatureHeader) != "" || headers.Get(TimestampHeader) != "" {
+				t.Error("expected unsigned requests without a signing key")
+			}
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(headers.Get(TimestampHeader), 10, 64)
+		if err != nil || timestamp < before || timestamp > time.Now().Unix() {
+			t.Errorf("expected a current unix timestamp, got %q", headers.Get(TimestampHeader))
+		}
+
+		expected := "sha256=" + Sign(testKey, headers.Get(TimestampHeader), body)
+		if signature := headers.Get(SignatureHeader); signature != expected {
+			t.Errorf("expected signature %q, got %q", expected, signature)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	type request struct {
+		user     string
+		password string
+		remote   string
+	}
+
+	tests := []struct {
+		name     string
+		maxTTL   time.Duration
+		requests []request
+		sleep    time.Duration
+		calls    int
+	}{
+		{
+			name:     "cached",
+			requests: []request{{"bob", "cached", "10.0.0.1:1234"}, {"bob", "cached", "10.0.0.1:1234"}, {"bob", "cached", "10.0.0.1:1234"}},
+			calls:    1,
+		},
+		{
+			name:     "rejection cached",
+			requests: []request{{"bob", "denied", "10.0.0.1:1234"}, {"bob", "denied", "10.0.0.1:1234"}},
+			calls:    1,
+		},
+		{
+			name:     "no ttl",
+			requests: []request{{"bob", "password", "10.0.0.1:1234"}, {"bob", "password", "10.0.0.1:1234"}, {"bob", "unauthorized", "10.0.0.1:1234"}, {"bob", "unauthorized", "10.0.0.1:1234"}},
+			calls:    4,
+		},
+		{
+			name:     "keyed on user and client ip",
+			requests: []request{{"bob", "cached", "10.0.0.1:1234"}, {"bob", "cached", "10.0.0.1:5678"}, {"bob", "cached", "10.0.0.2:1234"}, {"alice", "cached", "10.0.0.1:1234"}},
+			calls:    3,
+		},
+		{
+			name:     "max ttl",
+			maxTTL:   50 * time.Millisecond,
+			requests: []request{{"bob", "cached", "10.0.0.1:1234"}, {"bob", "cached", "10.0.0.1:1234"}},
+			sleep:    100 * time.Millisecond,
+			calls:    2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook := newTestHook(t)
+
+			h := NewDriver()
+			h.URL = testURL(t, hook.srv.URL)
+			if test.maxTTL > 0 {
+				h.MaxCacheTTL = jsontypes.Duration{Duration: test.maxTTL}
+			}
+			provision(t, h)
+
+			send := func(req request) {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.RemoteAddr = req.remote
+				r.SetBasicAuth(req.user, req.password)
+				h.AuthenticateIdentity(r)
+			}
+
+			for _, req := range test.requests {
+				send(req)
+			}
+
+			// Expired entries are asked for again
+			if test.sleep > 0 {
+				time.Sleep(test.sleep)
+				send(test.requests[0])
+			}
+
+			if calls := hook.Calls(); calls != test.calls {
+				t.Errorf("expected the webhook to be called %d times, was called %d times", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(2)
+	c.set("a", &Response{}, time.Minute)
+	c.set("b", &Response{}, time.Millisecond)
+
+	time.Sleep(5 * time.Millisecond)
+	c.set("c", &Response{}, time.Minute)
+
+	if _, found := c.get("a"); !found {
+		t.Error("expected the expired entry to be evicted before a live one")
+	}
+
+	c.set("d", &Response{}, time.Minute)
+	if len(c.entries) != 2 {
+		t.Errorf("expected the cache to stay at its size, have %d", len(c.entries))
+	}
+
+	c = newCache(0)
+	c.set("a", &Response{}, time.Minute)
+	if _, found := c.get("a"); found {
+		t.Error("expected nothing to be cached with no entries allowed")
+	}
+}
@@ -2,7 +2,9 @@ package basic
 
 import (
 	"net/http"
+	"strings"
 
+	"github.com/freman/caddy2-reauth/backends"
 	"github.com/freman/caddy2-reauth/failures"
 )
 
@@ -34,8 +36,22 @@ func (h Basic) Handle(w http.ResponseWriter, r *http.Request) error {
 		realm = h.Realm
 	}
 
+	// Relay challenges (such as a prompt for an OTP) via the realm, which
+	// is the only thing most clients will show the user.
+	reason := failures.ReasonFromRequest(r)
+	if reason != nil && reason.Code == backends.ReasonChallenge && reason.Message != "" {
+		realm = reason.Message
+	}
+
+	realm = strings.NewReplacer(`"`, `'`, "\r", " ", "\n", " ").Replace(realm)
+
 	w.Header().Add("WWW-Authenticate", `Basic realm="`+realm+`"`)
 	w.WriteHeader(http.StatusUnauthorized)
 
+	if reason != nil && reason.Message != "" {
+		_, err := w.Write([]byte(reason.Message + "\n"))
+		return err
+	}
+
 	return nil
 }
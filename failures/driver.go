@@ -1,9 +1,31 @@
 package failures
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 // Driver is an interface to an failure provider.
 type Driver interface {
 	Handle(w http.ResponseWriter, r *http.Request) error
 	Validate() error
 }
+
+// Reason is why authentication failed, when a backend was able to say.
+type Reason struct {
+	Code    string
+	Message string
+}
+
+type reasonCtxKey struct{}
+
+// WithReason returns a shallow copy of the request carrying the reason
+func WithReason(r *http.Request, reason *Reason) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), reasonCtxKey{}, reason))
+}
+
+// ReasonFromRequest returns the reason carried by the request, if any
+func ReasonFromRequest(r *http.Request) *Reason {
+	reason, _ := r.Context().Value(reasonCtxKey{}).(*Reason)
+	return reason
+}
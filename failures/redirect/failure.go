@@ -18,9 +18,13 @@ const defaultRedirectCode = 303
 // Interface guard
 var _ failures.Driver = (*Redirect)(nil)
 
+// Redirect sends the client to another URL, which may contain {uri},
+// {reason} and {message}. When a backend gives a reason, such as
+// password_expired, the URL for it in ReasonURLs is used instead.
 type Redirect struct {
-	URL  *jsontypes.URL `json:"url,omitempty"`
-	Code int            `json:"code,omitempty"`
+	URL        *jsontypes.URL            `json:"url,omitempty"`
+	Code       int                       `json:"code,omitempty"`
+	ReasonURLs map[string]*jsontypes.URL `json:"reason_urls,omitempty"`
 }
 
 // NewDriver returns a new instance of Redirect
@@ -36,17 +40,32 @@ func (h Redirect) Validate() error {
 		return errors.New("url to redirect to is a required parameter")
 	}
 
+	for reason, u := range h.ReasonURLs {
+		if u == nil {
+			return errors.New("url to redirect to for " + reason + " must not be empty")
+		}
+	}
+
 	return nil
 }
 
 // Handle the error
 func (h Redirect) Handle(w http.ResponseWriter, r *http.Request) error {
+	var code, message string
+	target := h.URL
+	if reason := failures.ReasonFromRequest(r); reason != nil {
+		code, message = reason.Code, reason.Message
+		if u, found := h.ReasonURLs[code]; found {
+			target = u
+		}
+	}
+
 	uri := r.URL
 	uri.Host = ""
 	uri.Scheme = ""
 
 	// Handle redirection back to hosts that aren't the auth server.
-	if h.URL.Host != "" && h.URL.Host != r.Host {
+	if target.Host != "" && target.Host != r.Host {
 		uri.Host = r.Host
 		uri.Scheme = "http"
 		if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
@@ -54,7 +73,11 @@ func (h Redirect) Handle(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	redirect := strings.Replace(h.URL.String(), "{uri}", url.QueryEscape(uri.String()), -1)
+	redirect := strings.NewReplacer(
+		"{uri}", url.QueryEscape(uri.String()),
+		"{reason}", url.QueryEscape(code),
+		"{message}", url.QueryEscape(message),
+	).Replace(target.String())
 	w.Header().Add("Location", redirect)
 	http.Redirect(w, r, redirect, h.Code)
 
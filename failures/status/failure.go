@@ -1,7 +1,12 @@
 package status
 
 import (
+	"fmt"
+	"html"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/freman/caddy2-reauth/failures"
 )
@@ -14,9 +19,12 @@ const defaultCode = http.StatusForbidden
 // Interface guard
 var _ failures.Driver = (*Status)(nil)
 
-// Status simply returns a http status code
+// Status simply returns a http status code, along with the page in
+// ReasonPages for the reason a backend gave, which may contain {reason} and
+// {message}
 type Status struct {
-	Code int `json:"code,omitempty"`
+	Code        int               `json:"code,omitempty"`
+	ReasonPages map[string]string `json:"reason_pages,omitempty"`
 }
 
 // NewDriver returns an instance of Status with some configured defaults
@@ -28,11 +36,48 @@ func NewDriver() *Status {
 
 // Validate verifies that this module is functional with the given configuration
 func (h Status) Validate() error {
+	for reason, page := range h.ReasonPages {
+		if _, err := os.Stat(page); err != nil {
+			return fmt.Errorf("page for %s: %v", reason, err)
+		}
+	}
+
 	return nil
 }
 
 // Handle the failure
 func (h Status) Handle(w http.ResponseWriter, r *http.Request) error {
+	reason := failures.ReasonFromRequest(r)
+	if reason != nil {
+		if page, found := h.ReasonPages[reason.Code]; found {
+			return h.page(w, page, reason)
+		}
+	}
+
+	if reason == nil || reason.Message == "" {
+		w.WriteHeader(h.Code)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(h.Code)
-	return nil
+	_, err := w.Write([]byte(reason.Message + "\n"))
+	return err
+}
+
+func (h Status) page(w http.ResponseWriter, page string, reason *failures.Reason) error {
+	body, err := ioutil.ReadFile(page)
+	if err != nil {
+		return err
+	}
+
+	body = []byte(strings.NewReplacer(
+		"{reason}", html.EscapeString(reason.Code),
+		"{message}", html.EscapeString(reason.Message),
+	).Replace(string(body)))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(h.Code)
+	_, err = w.Write(body)
+	return err
 }
@@ -4,7 +4,11 @@ go 1.14
 
 require (
 	github.com/caddyserver/caddy/v2 v2.0.0
+	github.com/caddyserver/certmagic v0.10.12
+	github.com/go-asn1-ber/asn1-ber v1.3.1
 	github.com/go-ldap/ldap/v3 v3.1.10
+	github.com/go-sql-driver/mysql v1.4.1
+	github.com/mattn/go-sqlite3 v1.14.0
 	go.uber.org/zap v1.15.0
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 )
@@ -0,0 +1,60 @@
+package jsontypes
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+type CIDR struct {
+	*net.IPNet
+}
+
+func (c *CIDR) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return c.Unmarshal(s)
+}
+
+// Unmarshal parses a CIDR, bare addresses are treated as a single host.
+func (c *CIDR) Unmarshal(s string) (err error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+	}
+	_, c.IPNet, err = net.ParseCIDR(s)
+	return
+}
+
+func (c CIDR) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.IPNet.String())
+}
+
+// ContainsAddr reports whether the host portion of a host:port address, or a
+// bare address, is within any of the CIDRs.
+func ContainsAddr(cidrs []*CIDR, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, c := range cidrs {
+		if c != nil && c.IPNet != nil && c.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
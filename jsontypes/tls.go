@@ -0,0 +1,204 @@
+package jsontypes
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSClient configures TLS for outbound connections.
+//
+// Pins are base64 or hex encoded SHA-256 hashes of a certificate's subject
+// public key info, at least one certificate in the verified chain must
+// match one of them. Combined with InsecureSkipVerify the pins are the only
+// check made, which suits self signed certificates, and only the server's
+// own certificate is matched as nothing else it sends can be trusted.
+type TLSClient struct {
+	RootCAFiles        []string `json:"root_ca_files,omitempty"`
+	ClientCertFile     string   `json:"client_cert_file,omitempty"`
+	ClientKeyFile      string   `json:"client_key_file,omitempty"`
+	ServerName         string   `json:"server_name,omitempty"`
+	MinVersion         string   `json:"min_version,omitempty"`
+	MaxVersion         string   `json:"max_version,omitempty"`
+	CipherSuites       []string `json:"cipher_suites,omitempty"`
+	Pins               []string `json:"pins,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+}
+
+// Config builds a tls.Config, reading any files it refers to. A nil
+// TLSClient results in an empty config.
+func (t *TLSClient) Config() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if t == nil {
+		return cfg, nil
+	}
+
+	cfg.ServerName = t.ServerName
+	cfg.InsecureSkipVerify = t.InsecureSkipVerify
+
+	if len(t.RootCAFiles) > 0 {
+		cfg.RootCAs = x509.NewCertPool()
+		for _, file := range t.RootCAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read root ca file: %v", err)
+			}
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in root ca file %q", file)
+			}
+		}
+	}
+
+	if t.ClientCertFile != "" || t.ClientKeyFile != "" {
+		if t.ClientCertFile == "" || t.ClientKeyFile == "" {
+			return nil, errors.New("both client_cert_file and client_key_file are required")
+		}
+		cert, err := tls.LoadX509KeyPair(t.ClientCertFile, t.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	var err error
+	if cfg.MinVersion, err = tlsVersion(t.MinVersion); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxVersion, err = tlsVersion(t.MaxVersion); err != nil {
+		return nil, err
+	}
+
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return nil, errors.New("min_version must not be greater than max_version")
+	}
+
+	if cfg.CipherSuites, err = cipherSuites(t.CipherSuites); err != nil {
+		return nil, err
+	}
+
+	if len(t.Pins) > 0 {
+		pins, err := decodePins(t.Pins)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyPeerCertificate = verifyPins(pins, t.InsecureSkipVerify)
+	}
+
+	return cfg, nil
+}
+
+// ConfigSkipVerify is Config for backends that still have their own
+// insecure_skip_verify option, skip is applied before the pins are so they
+// are checked the same way as if it had been given here.
+func (t *TLSClient) ConfigSkipVerify(skip bool) (*tls.Config, error) {
+	if !skip {
+		return t.Config()
+	}
+
+	c := TLSClient{}
+	if t != nil {
+		c = *t
+	}
+	c.InsecureSkipVerify = true
+
+	return c.Config()
+}
+
+func tlsVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	version, found := tlsVersions[strings.TrimPrefix(strings.ToLower(v), "tls")]
+	if !found {
+		return 0, fmt.Errorf("unknown tls version %q", v)
+	}
+
+	return version, nil
+}
+
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, list := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, cs := range list {
+			known[cs.Name] = cs.ID
+		}
+	}
+
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids[i] = id
+	}
+
+	return ids, nil
+}
+
+func decodePins(pins []string) ([][]byte, error) {
+	decoded := make([][]byte, len(pins))
+	for i, pin := range pins {
+		pin = strings.TrimPrefix(pin, "sha256/")
+
+		b, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+		if err != nil || len(b) != sha256.Size {
+			if b, err = base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("pin %q is not a hex or base64 encoded sha256 hash", pin)
+			}
+		}
+		decoded[i] = b
+	}
+
+	return decoded, nil
+}
+
+// verifyPins matches the pins against the verified chains or, when
+// verification is skipped, the leaf alone. Any other certificate the peer
+// sends is unverified and could be appended by anyone.
+func verifyPins(pins [][]byte, skipVerify bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var candidates []*x509.Certificate
+		if skipVerify {
+			if len(rawCerts) > 0 {
+				if cert, err := x509.ParseCertificate(rawCerts[0]); err == nil {
+					candidates = append(candidates, cert)
+				}
+			}
+		} else {
+			for _, chain := range verifiedChains {
+				candidates = append(candidates, chain...)
+			}
+		}
+
+		for _, cert := range candidates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if string(pin) == string(sum[:]) {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("no certificate matched a pinned public key")
+	}
+}
@@ -0,0 +1,152 @@
+package jsontypes
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func testPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestTLSClientPinEncoding(t *testing.T) {
+	ca, _ := testCert(t, "ca", nil, nil)
+	sum := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		pin string
+		ok  bool
+	}{
+		{pin: testPin(ca), ok: true},
+		{pin: "sha256/" + testPin(ca), ok: true},
+		{pin: base64.StdEncoding.EncodeToString(sum[:])[:10], ok: false},
+		{pin: "not a pin", ok: false},
+		{pin: "abcd", ok: false},
+	}
+
+	for _, test := range tests {
+		_, err := (&TLSClient{Pins: []string{test.pin}}).Config()
+		if (err == nil) != test.ok {
+			t.Errorf("pin %q: expected ok %v, got %v", test.pin, test.ok, err)
+		}
+	}
+}
+
+func TestTLSClientPins(t *testing.T) {
+	ca, caKey := testCert(t, "ca", nil, nil)
+	leaf, _ := testCert(t, "server", ca, caKey)
+	attacker, _ := testCert(t, "attacker", nil, nil)
+
+	tests := []struct {
+		name   string
+		pin    *x509.Certificate
+		skip   bool
+		raw    []*x509.Certificate
+		chains [][]*x509.Certificate
+		ok     bool
+	}{
+		{
+			name:   "leaf",
+			pin:    leaf,
+			raw:    []*x509.Certificate{leaf, ca},
+			chains: [][]*x509.Certificate{{leaf, ca}},
+			ok:     true,
+		},
+		{
+			name:   "root of the verified chain",
+			pin:    ca,
+			raw:    []*x509.Certificate{leaf},
+			chains: [][]*x509.Certificate{{leaf, ca}},
+			ok:     true,
+		},
+		{
+			name:   "appended to an unrelated chain",
+			pin:    ca,
+			raw:    []*x509.Certificate{attacker, ca},
+			chains: [][]*x509.Certificate{{attacker}},
+		},
+		{
+			name: "skip verify leaf",
+			pin:  leaf,
+			skip: true,
+			raw:  []*x509.Certificate{leaf},
+			ok:   true,
+		},
+		{
+			name: "skip verify appended",
+			pin:  leaf,
+			skip: true,
+			raw:  []*x509.Certificate{attacker, leaf},
+		},
+		{
+			name: "skip verify mismatch",
+			pin:  leaf,
+			skip: true,
+			raw:  []*x509.Certificate{attacker},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := (&TLSClient{Pins: []string{testPin(test.pin)}, InsecureSkipVerify: test.skip}).Config()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.InsecureSkipVerify != test.skip {
+				t.Errorf("expected insecure skip verify %v", test.skip)
+			}
+
+			var raw [][]byte
+			for _, cert := range test.raw {
+				raw = append(raw, cert.Raw)
+			}
+
+			err = cfg.VerifyPeerCertificate(raw, test.chains)
+			if (err == nil) != test.ok {
+				t.Errorf("expected ok %v, got %v", test.ok, err)
+			}
+		})
+	}
+}
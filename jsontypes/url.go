@@ -7,10 +7,12 @@ import (
 
 type URL struct {
 	*url.URL
+
+	raw string
 }
 
 func (u URL) MarshalJSON() ([]byte, error) {
-	return json.Marshal(u.URL.String())
+	return json.Marshal(u.Raw())
 }
 
 func (u *URL) UnmarshalJSON(data []byte) error {
@@ -24,5 +26,15 @@ func (u *URL) UnmarshalJSON(data []byte) error {
 
 func (u *URL) Unmarshal(s string) (err error) {
 	u.URL, err = url.Parse(s)
+	u.raw = s
 	return
 }
+
+// Raw returns the URL exactly as configured, which matters when it contains
+// placeholders that url.URL would otherwise escape.
+func (u URL) Raw() string {
+	if u.raw == "" && u.URL != nil {
+		return u.URL.String()
+	}
+	return u.raw
+}
@@ -0,0 +1,37 @@
+package jsontypes
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestURLRoundTrip(t *testing.T) {
+	tests := []string{
+		"https://auth.example.com/login",
+		"https://auth.example.com/check?user={reauth.username}&path={http.request.uri.path}",
+		"https://auth.example.com/users/{reauth.username}",
+		"https://auth.example.com/a%2Fb/{http.request.uri.path}",
+		"ldaps://dc.example.com:636",
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var u URL
+		if err := json.Unmarshal(data, &u); err != nil {
+			t.Fatalf("%s: %v", test, err)
+		}
+
+		out, err := json.Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(out) != string(data) {
+			t.Errorf("expected %s, got %s", data, out)
+		}
+	}
+}
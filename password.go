@@ -0,0 +1,114 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2020 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/freman/caddy2-reauth/backends/ldap"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(PasswordChange{})
+}
+
+// PasswordChange module serves a form for LDAP users to change their
+// password with, configured the same way as the ldap backend.
+type PasswordChange struct {
+	LDAP       json.RawMessage `json:"ldap,omitempty"`
+	Title      string          `json:"title,omitempty"`
+	SuccessURL string          `json:"success_url,omitempty"`
+
+	driver  *ldap.LDAP
+	handler *ldap.PasswordHandler
+	logger  *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (PasswordChange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.reauth_password",
+		New: func() caddy.Module { return new(PasswordChange) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (p *PasswordChange) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+
+	p.driver = ldap.NewDriver()
+	if err := json.Unmarshal(p.LDAP, p.driver); err != nil {
+		return fmt.Errorf("invalid ldap configuration: %v", err)
+	}
+
+	// Refuse to start rather than fail every change
+	if err := p.driver.Validate(); err != nil {
+		return fmt.Errorf("ldap: %v", err)
+	}
+
+	if err := p.driver.CanChangePasswords(); err != nil {
+		return fmt.Errorf("ldap: %v", err)
+	}
+
+	if err := p.driver.Provision(ctx); err != nil {
+		return fmt.Errorf("ldap: %v", err)
+	}
+
+	p.handler = &ldap.PasswordHandler{
+		LDAP:       p.driver,
+		Title:      p.Title,
+		SuccessURL: p.SuccessURL,
+	}
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (p *PasswordChange) Cleanup() error {
+	if p.driver != nil {
+		return p.driver.Cleanup()
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p PasswordChange) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if err := p.handler.Handle(w, r); err != nil {
+		p.logger.Error("changing password", zap.Error(err))
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*PasswordChange)(nil)
+	_ caddy.CleanerUpper          = (*PasswordChange)(nil)
+	_ caddyhttp.MiddlewareHandler = (*PasswordChange)(nil)
+)
@@ -1,11 +1,14 @@
 package reauth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/freman/caddy2-reauth/backends"
+	"github.com/freman/caddy2-reauth/failures"
 	"go.uber.org/zap"
 )
 
@@ -33,6 +36,24 @@ func (Reauth) CaddyModule() caddy.ModuleInfo {
 func (r *Reauth) Provision(ctx caddy.Context) error {
 	r.logger = ctx.Logger(r)
 	r.logger.Info("provisioning plugin instance")
+
+	for i := range r.Backends {
+		if err := r.Backends[i].Provision(ctx); err != nil {
+			return fmt.Errorf("backends[%d] (%s) failed provisioning: %s", i, r.Backends[i].Type, err)
+		}
+	}
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (r *Reauth) Cleanup() error {
+	for i := range r.Backends {
+		if err := r.Backends[i].Cleanup(); err != nil {
+			r.logger.Error("cleaning up backend", zap.String("backend", r.Backends[i].Type), zap.Error(err))
+		}
+	}
+
 	return nil
 }
 
@@ -53,17 +74,49 @@ func (r Reauth) Validate() error {
 
 // Authenticate the request
 func (r Reauth) Authenticate(w http.ResponseWriter, req *http.Request) (caddyauth.User, bool, error) {
+	for i := range r.Backends {
+		r.Backends[i].Sanitize(req)
+	}
+
 	for _, b := range r.Backends {
-		user, err := b.Authenticate(req)
+		identity, err := b.Authenticate(req)
 		if err != nil {
+			var rejection *backends.Rejection
+			if errors.As(err, &rejection) {
+				for k, v := range rejection.ResponseHeader {
+					for _, vv := range v {
+						w.Header().Add(k, vv)
+					}
+				}
+				reason := &failures.Reason{Code: rejection.Reason, Message: rejection.Message}
+				return caddyauth.User{}, false, r.Failure.Handle(w, failures.WithReason(req, reason))
+			}
 			return caddyauth.User{}, false, err
 		}
-		if user != "" {
+		if identity != nil && identity.ID != "" {
+			metadata := map[string]string{}
+			for k, v := range identity.Metadata {
+				metadata[k] = v
+			}
+			metadata["reauth_backend"] = b.Type
+
+			for k, v := range identity.RequestHeader {
+				if len(v) == 0 {
+					req.Header.Del(k)
+					continue
+				}
+				req.Header[k] = v
+			}
+
+			for k, v := range identity.ResponseHeader {
+				for _, vv := range v {
+					w.Header().Add(k, vv)
+				}
+			}
+
 			return caddyauth.User{
-				ID: user,
-				Metadata: map[string]string{
-					"reauth_backend": b.Type,
-				},
+				ID:       identity.ID,
+				Metadata: metadata,
 			}, true, nil
 		}
 	}
@@ -74,6 +127,7 @@ func (r Reauth) Authenticate(w http.ResponseWriter, req *http.Request) (caddyaut
 // Interface guards
 var (
 	_ caddy.Provisioner       = (*Reauth)(nil)
+	_ caddy.CleanerUpper      = (*Reauth)(nil)
 	_ caddy.Validator         = (*Reauth)(nil)
 	_ caddyauth.Authenticator = (*Reauth)(nil)
 )
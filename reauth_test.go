@@ -1,11 +1,14 @@
 package reauth_test
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
 	"github.com/caddyserver/caddy/v2/caddytest"
+	reauth "github.com/freman/caddy2-reauth"
 )
 
 func TestReauth(t *testing.T) {
@@ -32,3 +35,79 @@ func TestReauth(t *testing.T) {
 	tester.AssertGetResponse(authenticatedURL.String(), 200, "tell no-one")
 
 }
+
+func TestStripsWhenAnotherBackendWins(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		headers []string
+	}{
+		{
+			name:    "header",
+			backend: `{"type":"header","trusted_proxies":["10.0.0.0/8"]}`,
+			headers: []string{"X-Remote-User", "X-Forwarded-Groups"},
+		},
+		{
+			name:    "upstream",
+			backend: `{"type":"upstream","url":"https://auth.example.com/","user_header":"Remote-User","groups_header":"Remote-Groups","copy_headers":["Remote-Email"]}`,
+			headers: []string{"Remote-User", "Remote-Groups", "Remote-Email"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r reauth.Reauth
+			if err := json.Unmarshal([]byte(`{"backends":[
+				{"type":"simple","credentials":{"username":"password"}},
+				`+test.backend+`
+			]}`), &r); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := r.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/secret", nil)
+			req.RemoteAddr = "192.168.1.1:1234"
+			req.SetBasicAuth("username", "password")
+			for _, header := range test.headers {
+				req.Header.Set(header, "admin")
+			}
+
+			user, ok, err := r.Authenticate(httptest.NewRecorder(), req)
+			if err != nil || !ok || user.ID != "username" {
+				t.Fatalf("expected the simple backend to authenticate, got %+v, %v, %v", user, ok, err)
+			}
+
+			for _, header := range test.headers {
+				if v := req.Header.Get(header); v != "" {
+					t.Errorf("expected %s to be stripped, have %q", header, v)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendMarshalRoundTrip(t *testing.T) {
+	config := `{"type":"simple","credentials":{"username":"password"},"totp":{"secrets_file":"secrets.json","separator":"+","skew":1,"challenge":true}}`
+
+	var b reauth.Backend
+	if err := json.Unmarshal([]byte(config), &b); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var again reauth.Backend
+	if err := json.Unmarshal(data, &again); err != nil {
+		t.Fatalf("expected the marshalled backend to unmarshal, got %v from %s", err, data)
+	}
+
+	if again.Type != "simple" || again.TOTP == nil || again.TOTP.SecretsFile != "secrets.json" || !again.TOTP.Challenge {
+		t.Errorf("expected the type and totp layer to survive marshalling, got %s", data)
+	}
+}